@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/v1"
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+// terminology-server serves the CodeSystems and ValueSets of the embedded spec, plus
+// the ones found in -dir, with the FHIR terminology REST API. It stands in for a real
+// terminology server when testing an HTTPTerminologyService.
+func main() {
+	addr := flag.String("addr", "localhost:8081", "address to listen on")
+	dir := flag.String("dir", "", "directory with extra CodeSystem and ValueSet JSON files")
+	flag.Parse()
+
+	sources := []fs.FS{fhirspec.FS}
+	if *dir != "" {
+		sources = append(sources, os.DirFS(*dir))
+	}
+
+	spec, err := v1.LoadSpecFS(sources...)
+	if err != nil {
+		log.Fatalf("Error loading definitions: %v", err)
+	}
+
+	handler := v1.NewTerminologyHandler(v1.LocalTerminologyService{Spec: spec})
+
+	log.Printf("Terminology server listening on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
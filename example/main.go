@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/robertoAraneda/go-fhir-validator/pkg/v1"
 	"log"
+	"os"
 )
 
 func main() {
+	// Keep the evaluated constraints next to the resource for debugging
+	dump, err := os.Create("payload.json")
+	if err != nil {
+		log.Fatalf("Error creating payload file: %v", err)
+	}
+	defer dump.Close()
+
 	// Initialize JSON data in memory
-	_, err := v1.LoadData()
+	validator, err := v1.New(v1.WithDebugDump(dump))
 	if err != nil {
 		log.Fatalf("Error loading JSON data: %v", err)
 	}
@@ -20,7 +29,7 @@ func main() {
 		return
 	}
 
-	outcome, err := v1.ValidateResource(data)
+	outcome, err := validator.Validate(context.Background(), data)
 
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,159 @@
+import * as fhirpath from "fhirpath";
+import * as fhirpath_r4_model from "fhirpath/fhir-context/r4";
+
+export interface Bundle {
+    constraintExpression: string;
+    data: any;
+    rootData: any;
+    constraintKey: string;
+    parentPath: string;
+    constraintHuman: string;
+    constraintSource: string;
+    constraintSeverity: string;
+    dataType?: string;
+}
+
+// Constraint as sent by the Go validator; rootIndex points into Request.resources. data is
+// left out when the constraint is evaluated on the root resource itself.
+export interface Constraint {
+    rootIndex: number;
+    constraintExpression: string;
+    data?: any;
+    constraintKey: string;
+    parentPath: string;
+    constraintHuman: string;
+    constraintSource: string;
+    constraintSeverity: string;
+    // FHIR type of data when it is not a resource, e.g. "Period" or the backbone path
+    // "Patient.contact"; parentPath is an instance path such as Patient.identifier[0].period.
+    dataType?: string;
+}
+
+export interface Request {
+    resources: any[];
+    constraints: Constraint[];
+}
+
+export interface ResponseBundle {
+    result: boolean;
+    key: string;
+    path: string;
+    human: string;
+    source: string;
+    severity: string;
+}
+
+// ConstraintError reports a constraint whose expression could not be evaluated.
+export interface ConstraintError {
+    key: string;
+    path: string;
+    source: string;
+    severity: string;
+    message: string;
+}
+
+// TraceEntry holds the values traced under one label while evaluating one constraint.
+export interface TraceEntry {
+    label: string;
+    key: string;
+    path: string;
+    values: any[];
+}
+
+// Response is the JSON envelope returned to the Go validator.
+export interface Response {
+    results: ResponseBundle[];
+    errors: ConstraintError[];
+    trace: TraceEntry[];
+}
+
+export type TraceFunction = (x: any, label: string) => void;
+
+// dom-3 uses as() on collections, which fhirpath.js rejects; evaluate it with ofType() instead.
+const containedExpression = `
+contained.where((('#'+id in (%resource.descendants().reference | %resource.descendants().ofType(canonical) | %resource.descendants().ofType(uri) | %resource.descendants().ofType(url))) or descendants().where(reference = '#').exists() or descendants().where(ofType(canonical) = '#').exists() or descendants().where(ofType(canonical) = '#').exists()).not()).trace('unmatched', id).empty()
+`;
+
+// expandRequest resolves each constraint's root resource, which is also its data when
+// the constraint carries none.
+export function expandRequest(request: Request): Bundle[] {
+    return request.constraints.map((constraint) => {
+        const rootData = request.resources[constraint.rootIndex];
+        if (rootData === undefined) {
+            throw new Error(`constraint ${constraint.constraintKey} refers to unknown resource ${constraint.rootIndex}`);
+        }
+        return { ...constraint, data: constraint.data ?? rootData, rootData };
+    });
+}
+
+// typeContext is the type an element is evaluated as: its dataType, or the definition
+// path of its instance path when the validator did not send one.
+function typeContext(bundle: Bundle): string {
+    return bundle.dataType || bundle.parentPath.replace(/\[\d+\]/g, "");
+}
+
+export function evaluateBundle(bundle: Bundle, traceFn?: TraceFunction): ResponseBundle {
+    let result: boolean[] = [];
+    const resourceType = bundle.data.resourceType as string;
+    const options = traceFn ? { traceFn } : undefined;
+
+    if (bundle.constraintExpression.startsWith("contained.where(")) {
+        bundle.constraintExpression = containedExpression;
+
+        result = fhirpath.evaluate(
+            bundle.data,
+            resourceType ? bundle.constraintExpression : { base: typeContext(bundle), expression: bundle.constraintExpression },
+            { resource: bundle.rootData },
+            fhirpath_r4_model,
+            options
+        ) as boolean[];
+    } else {
+        result = fhirpath.evaluate(
+            bundle.data,
+            resourceType ? bundle.constraintExpression : { base: typeContext(bundle), expression: bundle.constraintExpression },
+            { rootResource: bundle.rootData },
+            fhirpath_r4_model,
+            options
+        ) as boolean[];
+    }
+
+    return {
+        result: result[0],
+        key: bundle.constraintKey,
+        path: bundle.parentPath,
+        human: bundle.constraintHuman,
+        source: bundle.constraintSource,
+        severity: bundle.constraintSeverity,
+    };
+}
+
+// evaluateRequest evaluates every constraint of the request. A constraint that throws is
+// reported in errors and does not stop the evaluation of the others.
+export function evaluateRequest(request: Request): Response {
+    const response: Response = { results: [], errors: [], trace: [] };
+
+    for (const bundle of expandRequest(request)) {
+        const traceFn: TraceFunction = (x, label) => {
+            response.trace.push({
+                label,
+                key: bundle.constraintKey,
+                path: bundle.parentPath,
+                values: Array.isArray(x) ? x : [x],
+            });
+        };
+
+        try {
+            response.results.push(evaluateBundle(bundle, traceFn));
+        } catch (error: any) {
+            response.errors.push({
+                key: bundle.constraintKey,
+                path: bundle.parentPath,
+                source: bundle.constraintSource,
+                severity: bundle.constraintSeverity,
+                message: error?.message ?? String(error),
+            });
+        }
+    }
+
+    return response;
+}
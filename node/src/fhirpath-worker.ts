@@ -0,0 +1,45 @@
+import * as readline from "readline";
+import { Request, Response, evaluateRequest } from "./evaluate";
+
+// Long-lived worker used by the Go FhirPathWorkerPool. It reads one JSON request per
+// line from stdin and writes one JSON response per line to stdout.
+
+interface WorkerRequest extends Request {
+    id: number;
+}
+
+interface WorkerResponse extends Partial<Response> {
+    id: number;
+    error?: string;
+}
+
+// stdout is reserved for protocol messages, so route any logging to stderr.
+console.log = (...args: any[]) => console.error(...args);
+
+function write(response: WorkerResponse): void {
+    process.stdout.write(JSON.stringify(response) + "\n");
+}
+
+const rl = readline.createInterface({ input: process.stdin, terminal: false });
+
+rl.on("line", (line: string) => {
+    if (line.trim() === "") {
+        return;
+    }
+
+    let request: WorkerRequest;
+    try {
+        request = JSON.parse(line);
+    } catch (error: any) {
+        write({ id: 0, error: `invalid request: ${error.message}` });
+        return;
+    }
+
+    try {
+        write({ id: request.id, ...evaluateRequest(request) });
+    } catch (error: any) {
+        write({ id: request.id, error: error.message });
+    }
+});
+
+rl.on("close", () => process.exit(0));
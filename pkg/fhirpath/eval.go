@@ -0,0 +1,776 @@
+package fhirpath
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// evalContext holds the state of a single evaluation.
+type evalContext struct {
+	env   *Environment
+	model Model
+
+	context      Collection // %context
+	resource     Collection // %resource
+	rootResource Collection // %rootResource
+
+	this     Collection // $this
+	index    int        // $index
+	hasIndex bool
+	total    Collection // $total
+}
+
+// nodeFor wraps an environment value, falling back to def when v is nil.
+func (c *evalContext) nodeFor(v interface{}, def Collection) Collection {
+	if v == nil {
+		return def
+	}
+	if n := newRootNode(v, "", c.model); n != nil {
+		return Collection{*n}
+	}
+	return Collection{}
+}
+
+// withThis returns a copy of the context whose $this is item.
+func (c *evalContext) withThis(item Node, index int) *evalContext {
+	clone := *c
+	clone.this = Collection{item}
+	clone.index = index
+	clone.hasIndex = true
+	return &clone
+}
+
+func (c *evalContext) eval(e expr, focus Collection) (Collection, error) {
+	switch e := e.(type) {
+	case *literalExpr:
+		return e.value, nil
+
+	case *identifierExpr:
+		return c.member(focus, e.name, true), nil
+
+	case *functionExpr:
+		// Functions drive all iteration (where, repeat, descendants...), so this is
+		// where a long evaluation notices cancellation.
+		if c.env.Context != nil {
+			if err := c.env.Context.Err(); err != nil {
+				return nil, err
+			}
+		}
+		return c.callFunction(e, focus)
+
+	case *invocationExpr:
+		target, err := c.eval(e.target, focus)
+		if err != nil {
+			return nil, err
+		}
+		switch m := e.member.(type) {
+		case *identifierExpr:
+			return c.member(target, m.name, false), nil
+		case *functionExpr:
+			return c.callFunction(m, target)
+		default:
+			return c.eval(m, target)
+		}
+
+	case *indexerExpr:
+		target, err := c.eval(e.target, focus)
+		if err != nil {
+			return nil, err
+		}
+		index, err := c.eval(e.index, c.this)
+		if err != nil {
+			return nil, err
+		}
+		if len(index) == 0 {
+			return Collection{}, nil
+		}
+		i, ok := toSystem(index[0]).(int64)
+		if !ok {
+			return nil, fmt.Errorf("indexer must be an integer")
+		}
+		if i < 0 || int(i) >= len(target) {
+			return Collection{}, nil
+		}
+		return Collection{target[i]}, nil
+
+	case *unaryExpr:
+		operand, err := c.eval(e.operand, focus)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "+" || len(operand) == 0 {
+			return operand, nil
+		}
+		if len(operand) > 1 {
+			return nil, fmt.Errorf("unary minus requires a single item")
+		}
+		switch v := toSystem(operand[0]).(type) {
+		case int64:
+			return Collection{{Value: -v}}, nil
+		case float64:
+			return Collection{{Value: -v, Type: "System.Decimal"}}, nil
+		case Quantity:
+			return Collection{{Value: Quantity{Value: -v.Value, Unit: v.Unit}}}, nil
+		}
+		return nil, fmt.Errorf("unary minus requires a number")
+
+	case *binaryExpr:
+		return c.evalBinary(e, focus)
+
+	case *typeExpr:
+		operand, err := c.eval(e.operand, focus)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "is" {
+			if len(operand) == 0 {
+				return Collection{}, nil
+			}
+			if len(operand) > 1 {
+				return nil, fmt.Errorf("'is' requires a single item")
+			}
+			return boolean(c.isType(operand[0], e.typeName)), nil
+		}
+		return c.ofType(operand, e.typeName), nil
+
+	case *externalExpr:
+		return c.external(e.name)
+
+	case *variableExpr:
+		switch e.name {
+		case "$this":
+			return c.this, nil
+		case "$index":
+			if !c.hasIndex {
+				return Collection{}, nil
+			}
+			return Collection{{Value: int64(c.index)}}, nil
+		case "$total":
+			return c.total, nil
+		}
+		return nil, fmt.Errorf("unknown variable %s", e.name)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", e)
+}
+
+func (c *evalContext) external(name string) (Collection, error) {
+	switch name {
+	case "context":
+		return c.context, nil
+	case "resource":
+		return c.resource, nil
+	case "rootResource":
+		return c.rootResource, nil
+	case "ucum":
+		return str("http://unitsofmeasure.org"), nil
+	case "sct":
+		return str("http://snomed.info/sct"), nil
+	case "loinc":
+		return str("http://loinc.org"), nil
+	}
+	if v, ok := c.env.Variables[name]; ok {
+		switch v := v.(type) {
+		case Collection:
+			return v, nil
+		case Node:
+			return Collection{v}, nil
+		}
+		return c.nodeFor(v, Collection{}), nil
+	}
+	if strings.HasPrefix(name, "vs-") {
+		return str("http://hl7.org/fhir/ValueSet/" + name[3:]), nil
+	}
+	if strings.HasPrefix(name, "ext-") {
+		return str("http://hl7.org/fhir/StructureDefinition/" + name[4:]), nil
+	}
+	return nil, fmt.Errorf("unknown external constant %%%s", name)
+}
+
+func str(s string) Collection {
+	return Collection{{Value: s, Type: "System.String"}}
+}
+
+func boolean(b bool) Collection {
+	return Collection{{Value: b, Type: "System.Boolean"}}
+}
+
+// member navigates to the children named name of each item in focus. At the start of
+// a path an identifier naming the type of the focus selects the focus itself.
+func (c *evalContext) member(focus Collection, name string, root bool) Collection {
+	if root && name != "" && unicode.IsUpper(rune(name[0])) {
+		var matched Collection
+		for _, n := range focus {
+			if n.Type != "" && (n.Type == name || IsSubtypeOf(n.Type, name)) {
+				matched = append(matched, n)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+
+	result := Collection{}
+	for _, n := range focus {
+		result = append(result, c.children(n, name)...)
+	}
+	return result
+}
+
+// elementInfo looks up the definition of name under the definition path of n,
+// walking up the type hierarchy for inherited elements.
+func (c *evalContext) elementInfo(n Node, name string) (ElementInfo, string, bool) {
+	if c.model == nil || n.path == "" {
+		return ElementInfo{}, "", false
+	}
+	path := n.path
+	for path != "" {
+		childPath := path + "." + name
+		if info, ok := c.model.ElementInfo(childPath); ok {
+			if info.ContentReference != "" {
+				if ref, ok := c.model.ElementInfo(info.ContentReference); ok {
+					return ref, info.ContentReference, true
+				}
+			}
+			return info, childPath, true
+		}
+		if strings.Contains(path, ".") {
+			return ElementInfo{}, "", false
+		}
+		path = BaseType(path)
+	}
+	return ElementInfo{}, "", false
+}
+
+// children returns the child items named name of n, resolving choice elements.
+func (c *evalContext) children(n Node, name string) Collection {
+	// Primitive extensions and ids live in the "_name" object.
+	if n.ext != nil && (name == "extension" || name == "id") {
+		if _, isMap := n.Value.(map[string]interface{}); !isMap {
+			return c.wrap(n, name, n.ext[name], nil, "", "")
+		}
+	}
+
+	m, ok := n.Value.(map[string]interface{})
+	if !ok {
+		return Collection{}
+	}
+
+	info, childPath, known := c.elementInfo(n, name)
+
+	if known && info.Choice {
+		result := Collection{}
+		for _, t := range info.Types {
+			key := name + UpperFirst(t)
+			if v, ok := m[key]; ok || m["_"+key] != nil {
+				result = append(result, c.wrap(n, key, v, m["_"+key], t, "")...)
+			}
+		}
+		return result
+	}
+
+	v, present := m[name]
+	ext := m["_"+name]
+	if present || ext != nil {
+		typeName := ""
+		if known && len(info.Types) == 1 {
+			typeName = info.Types[0]
+		}
+		return c.wrap(n, name, v, ext, typeName, childPath)
+	}
+
+	if known {
+		return Collection{}
+	}
+
+	// Without model information, resolve choice elements from the key suffix.
+	result := Collection{}
+	for _, key := range SortedKeys(m) {
+		if t, ok := ChoiceTypeSuffix(name, key); ok {
+			result = append(result, c.wrap(n, key, m[key], m["_"+key], t, "")...)
+		}
+	}
+	return result
+}
+
+// wrap converts a JSON property value into nodes, flattening arrays and pairing
+// primitive values with their extension objects.
+func (c *evalContext) wrap(parent Node, key string, v, ext interface{}, typeName, defPath string) Collection {
+	result := Collection{}
+	if arr, ok := v.([]interface{}); ok {
+		extArr, _ := ext.([]interface{})
+		for i, item := range arr {
+			var itemExt interface{}
+			if i < len(extArr) {
+				itemExt = extArr[i]
+			}
+			if n, ok := c.makeNode(item, itemExt, typeName, defPath); ok {
+				result = append(result, n)
+			}
+		}
+		return result
+	}
+	if v == nil {
+		if extArr, ok := ext.([]interface{}); ok {
+			for _, item := range extArr {
+				if n, ok := c.makeNode(nil, item, typeName, defPath); ok {
+					result = append(result, n)
+				}
+			}
+			return result
+		}
+	}
+	if n, ok := c.makeNode(v, ext, typeName, defPath); ok {
+		result = append(result, n)
+	}
+	return result
+}
+
+func (c *evalContext) makeNode(v, ext interface{}, typeName, defPath string) (Node, bool) {
+	extMap, _ := ext.(map[string]interface{})
+	if v == nil && extMap == nil {
+		return Node{}, false
+	}
+	n := Node{Value: v, Type: typeName, ext: extMap}
+
+	if strings.HasPrefix(typeName, "http://hl7.org/fhirpath/System.") {
+		n.Type = "System." + strings.TrimPrefix(typeName, "http://hl7.org/fhirpath/System.")
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		if rt, ok := m["resourceType"].(string); ok {
+			n.Type, n.path = rt, rt
+			return n, true
+		}
+		switch n.Type {
+		case "BackboneElement", "Element":
+			n.path = defPath
+		case "":
+			n.path = ""
+		default:
+			n.path = n.Type
+		}
+	}
+	return n, true
+}
+
+// allChildren returns every child item of n.
+func (c *evalContext) allChildren(n Node) Collection {
+	result := Collection{}
+	if n.ext != nil {
+		if _, isMap := n.Value.(map[string]interface{}); !isMap {
+			for _, key := range []string{"id", "extension"} {
+				result = append(result, c.wrap(n, key, n.ext[key], nil, "", "")...)
+			}
+			return result
+		}
+	}
+	m, ok := n.Value.(map[string]interface{})
+	if !ok {
+		return result
+	}
+	seen := map[string]bool{}
+	for _, key := range SortedKeys(m) {
+		name := strings.TrimPrefix(key, "_")
+		if key == "resourceType" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		info, childPath, known := c.elementInfo(n, name)
+		typeName := ""
+		if known && len(info.Types) == 1 {
+			typeName = info.Types[0]
+		} else if !known {
+			// Choice elements are declared as "value[x]", so look up by prefix.
+			for i := len(name) - 1; i > 0; i-- {
+				if t, ok := ChoiceTypeSuffix(name[:i], name); ok {
+					if choiceInfo, _, ok := c.elementInfo(n, name[:i]); ok && choiceInfo.Choice {
+						typeName = t
+						break
+					}
+				}
+			}
+		}
+		result = append(result, c.wrap(n, name, m[name], m["_"+name], typeName, childPath)...)
+	}
+	return result
+}
+
+// nodeType returns the FHIR or System type name of n, inferring it from the value
+// when no type information is available.
+func nodeType(n Node) (string, bool) {
+	if n.Type != "" {
+		if strings.HasPrefix(n.Type, "System.") {
+			return strings.TrimPrefix(n.Type, "System."), true
+		}
+		return n.Type, false
+	}
+	if m, ok := n.Value.(map[string]interface{}); ok {
+		if rt, ok := m["resourceType"].(string); ok {
+			return rt, false
+		}
+		return "", false
+	}
+	return systemTypeName(toSystem(n)), true
+}
+
+// isType reports whether n is of the (optionally namespace-qualified) type typeName.
+func (c *evalContext) isType(n Node, typeName string) bool {
+	namespace := ""
+	if i := strings.IndexByte(typeName, '.'); i >= 0 {
+		namespace, typeName = typeName[:i], typeName[i+1:]
+	}
+
+	actual, system := nodeType(n)
+	if actual == "" {
+		return false
+	}
+	switch namespace {
+	case "System":
+		if system {
+			return actual == typeName
+		}
+		return false
+	case "FHIR":
+		return !system && IsSubtypeOf(actual, typeName)
+	}
+	if system {
+		return actual == typeName
+	}
+	return IsSubtypeOf(actual, typeName)
+}
+
+func (c *evalContext) ofType(focus Collection, typeName string) Collection {
+	result := Collection{}
+	for _, n := range focus {
+		if c.isType(n, typeName) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+func (c *evalContext) evalBinary(e *binaryExpr, focus Collection) (Collection, error) {
+	left, err := c.eval(e.left, focus)
+	if err != nil {
+		return nil, err
+	}
+
+	// Boolean operators short-circuit where the result is already known.
+	switch e.op {
+	case "and", "or", "xor", "implies":
+		l, lok, err := singletonBoolean(left)
+		if err != nil {
+			return nil, err
+		}
+		if lok {
+			if (e.op == "and" && !l) || (e.op == "or" && l) {
+				return boolean(l), nil
+			}
+			if e.op == "implies" && !l {
+				return boolean(true), nil
+			}
+		}
+		right, err := c.eval(e.right, focus)
+		if err != nil {
+			return nil, err
+		}
+		r, rok, err := singletonBoolean(right)
+		if err != nil {
+			return nil, err
+		}
+		return logical(e.op, l, lok, r, rok), nil
+	}
+
+	right, err := c.eval(e.right, focus)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "|":
+		return union(left, right), nil
+	case "=", "!=":
+		if len(left) == 0 || len(right) == 0 {
+			return Collection{}, nil
+		}
+		eq, ok := collectionsEqual(left, right)
+		if !ok {
+			return Collection{}, nil
+		}
+		return boolean(eq == (e.op == "=")), nil
+	case "~", "!~":
+		eq := collectionsEquivalent(left, right)
+		return boolean(eq == (e.op == "~")), nil
+	case "<", ">", "<=", ">=":
+		if len(left) == 0 || len(right) == 0 {
+			return Collection{}, nil
+		}
+		if len(left) > 1 || len(right) > 1 {
+			return nil, fmt.Errorf("comparison requires single items")
+		}
+		cmp, ok, err := compareValues(toSystem(left[0]), toSystem(right[0]))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return Collection{}, nil
+		}
+		switch e.op {
+		case "<":
+			return boolean(cmp < 0), nil
+		case ">":
+			return boolean(cmp > 0), nil
+		case "<=":
+			return boolean(cmp <= 0), nil
+		default:
+			return boolean(cmp >= 0), nil
+		}
+	case "in", "contains":
+		item, set := left, right
+		if e.op == "contains" {
+			item, set = right, left
+		}
+		if len(item) == 0 {
+			return Collection{}, nil
+		}
+		if len(item) > 1 {
+			return nil, fmt.Errorf("'%s' requires a single item", e.op)
+		}
+		return boolean(containsNode(set, item[0])), nil
+	case "&":
+		ls, _ := singletonString(left)
+		rs, _ := singletonString(right)
+		return str(ls + rs), nil
+	case "+", "-", "*", "/", "div", "mod":
+		return arithmetic(e.op, left, right)
+	}
+	return nil, fmt.Errorf("unsupported operator %s", e.op)
+}
+
+// singletonBoolean converts a collection to a boolean following the singleton evaluation rules.
+func singletonBoolean(c Collection) (bool, bool, error) {
+	if len(c) == 0 {
+		return false, false, nil
+	}
+	if len(c) > 1 {
+		return false, false, fmt.Errorf("expected a single boolean, found %d items", len(c))
+	}
+	if b, ok := toSystem(c[0]).(bool); ok {
+		return b, true, nil
+	}
+	// A single non-boolean item evaluates to true.
+	return true, true, nil
+}
+
+func singletonString(c Collection) (string, bool) {
+	if len(c) != 1 {
+		return "", false
+	}
+	return toStringValue(toSystem(c[0]))
+}
+
+// logical applies three-valued boolean logic.
+func logical(op string, l, lok, r, rok bool) Collection {
+	switch op {
+	case "and":
+		if (lok && !l) || (rok && !r) {
+			return boolean(false)
+		}
+		if lok && rok {
+			return boolean(true)
+		}
+	case "or":
+		if (lok && l) || (rok && r) {
+			return boolean(true)
+		}
+		if lok && rok {
+			return boolean(false)
+		}
+	case "xor":
+		if lok && rok {
+			return boolean(l != r)
+		}
+	case "implies":
+		if lok && !l {
+			return boolean(true)
+		}
+		if rok && r {
+			return boolean(true)
+		}
+		if lok && rok {
+			return boolean(false)
+		}
+	}
+	return Collection{}
+}
+
+func collectionsEqual(a, b Collection) (bool, bool) {
+	if len(a) != len(b) {
+		return false, true
+	}
+	for i := range a {
+		eq, ok := valuesEqual(toSystem(a[i]), toSystem(b[i]))
+		if !ok {
+			return false, false
+		}
+		if !eq {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+func collectionsEquivalent(a, b Collection) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	used := make([]bool, len(b))
+	for i := range a {
+		found := false
+		for j := range b {
+			if !used[j] && valuesEquivalent(toSystem(a[i]), toSystem(b[j])) {
+				used[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsNode(set Collection, n Node) bool {
+	v := toSystem(n)
+	for _, item := range set {
+		if eq, ok := valuesEqual(v, toSystem(item)); ok && eq {
+			return true
+		}
+	}
+	return false
+}
+
+// union merges two collections, removing duplicates.
+func union(a, b Collection) Collection {
+	result := Collection{}
+	for _, n := range append(append(Collection{}, a...), b...) {
+		if !containsNode(result, n) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+func arithmetic(op string, left, right Collection) (Collection, error) {
+	if len(left) == 0 || len(right) == 0 {
+		return Collection{}, nil
+	}
+	if len(left) > 1 || len(right) > 1 {
+		return nil, fmt.Errorf("'%s' requires single items", op)
+	}
+	l, r := toSystem(left[0]), toSystem(right[0])
+
+	if op == "+" {
+		if ls, ok := l.(string); ok {
+			if rs, ok := r.(string); ok {
+				return str(ls + rs), nil
+			}
+		}
+	}
+
+	// Date arithmetic with calendar durations.
+	if q, ok := r.(Quantity); ok && (op == "+" || op == "-") {
+		sign := 1
+		if op == "-" {
+			sign = -1
+		}
+		switch d := l.(type) {
+		case Date:
+			if t, ok := addDuration(d.temporal, q, sign); ok {
+				return Collection{{Value: Date{t}}}, nil
+			}
+		case DateTime:
+			if t, ok := addDuration(d.temporal, q, sign); ok {
+				return Collection{{Value: DateTime{t}}}, nil
+			}
+		case Quantity:
+			if converted, ok := convertQuantity(q, d.Unit); ok {
+				return Collection{{Value: Quantity{Value: d.Value + float64(sign)*converted.Value, Unit: d.Unit}}}, nil
+			}
+			return Collection{}, nil
+		}
+	}
+
+	if lq, ok := l.(Quantity); ok {
+		if f, ok := toFloat(r); ok && (op == "*" || op == "/") {
+			if op == "*" {
+				return Collection{{Value: Quantity{Value: lq.Value * f, Unit: lq.Unit}}}, nil
+			}
+			if f == 0 {
+				return Collection{}, nil
+			}
+			return Collection{{Value: Quantity{Value: lq.Value / f, Unit: lq.Unit}}}, nil
+		}
+	}
+
+	li, lInt := l.(int64)
+	ri, rInt := r.(int64)
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply '%s' to %s and %s", op, systemTypeName(l), systemTypeName(r))
+	}
+
+	if lInt && rInt {
+		switch op {
+		case "+":
+			return Collection{{Value: li + ri}}, nil
+		case "-":
+			return Collection{{Value: li - ri}}, nil
+		case "*":
+			return Collection{{Value: li * ri}}, nil
+		case "div":
+			if ri == 0 {
+				return Collection{}, nil
+			}
+			return Collection{{Value: li / ri}}, nil
+		case "mod":
+			if ri == 0 {
+				return Collection{}, nil
+			}
+			return Collection{{Value: li % ri}}, nil
+		}
+	}
+
+	decimal := func(f float64) Collection {
+		return Collection{{Value: f, Type: "System.Decimal"}}
+	}
+	switch op {
+	case "+":
+		return decimal(lf + rf), nil
+	case "-":
+		return decimal(lf - rf), nil
+	case "*":
+		return decimal(lf * rf), nil
+	case "/":
+		if rf == 0 {
+			return Collection{}, nil
+		}
+		return decimal(lf / rf), nil
+	case "div":
+		if rf == 0 {
+			return Collection{}, nil
+		}
+		return Collection{{Value: int64(math.Trunc(lf / rf))}}, nil
+	case "mod":
+		if rf == 0 {
+			return Collection{}, nil
+		}
+		return decimal(math.Mod(lf, rf)), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", op)
+}
@@ -0,0 +1,300 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testModel is a Model backed by a map of element paths.
+type testModel map[string]ElementInfo
+
+func (m testModel) ElementInfo(path string) (ElementInfo, bool) {
+	info, ok := m[path]
+	return info, ok
+}
+
+var model = testModel{
+	"Patient.name":                 {Types: []string{"HumanName"}},
+	"Patient.birthDate":            {Types: []string{"date"}},
+	"Patient.deceased":             {Types: []string{"boolean", "dateTime"}, Choice: true},
+	"Patient.contact":              {Types: []string{"BackboneElement"}},
+	"Patient.contact.name":         {Types: []string{"HumanName"}},
+	"Patient.managingOrganization": {Types: []string{"Reference"}},
+	"HumanName.given":              {Types: []string{"string"}},
+	"HumanName.family":             {Types: []string{"string"}},
+	"Observation.value":            {Types: []string{"Quantity", "string", "CodeableConcept"}, Choice: true},
+	"Observation.subject":          {Types: []string{"Reference"}},
+	"Observation.effective":        {Types: []string{"dateTime", "Period"}, Choice: true},
+	"Quantity.value":               {Types: []string{"decimal"}},
+	"Quantity.unit":                {Types: []string{"string"}},
+	"Reference.reference":          {Types: []string{"string"}},
+}
+
+func decode(t *testing.T, source string) map[string]interface{} {
+	t.Helper()
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(source), &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+const patient = `{
+	"resourceType": "Patient",
+	"id": "p1",
+	"name": [{"family": "Chalmers", "given": ["Peter", "James"]}, {"given": ["Jim"]}],
+	"birthDate": "1974-12-25",
+	"_birthDate": {"extension": [{"url": "http://hl7.org/fhir/StructureDefinition/patient-birthTime", "valueDateTime": "1974-12-25T14:35:45-05:00"}]},
+	"deceasedBoolean": false,
+	"contact": [{"name": {"family": "du Marché"}}],
+	"contained": [{"resourceType": "Organization", "id": "o1", "name": "Acme"}],
+	"managingOrganization": {"reference": "#o1"}
+}`
+
+const observation = `{
+	"resourceType": "Observation",
+	"id": "o1",
+	"valueQuantity": {"value": 72.5, "unit": "kg", "code": "kg"},
+	"effectiveDateTime": "2020-01-31T10:00:00Z",
+	"subject": {"reference": "Patient/p1"}
+}`
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name       string
+		resource   string
+		expression string
+		want       []interface{}
+	}{
+		// Navigation
+		{"path", patient, "Patient.name.given", []interface{}{"Peter", "James", "Jim"}},
+		{"type prefix of subtype", patient, "DomainResource.id", []interface{}{"p1"}},
+		{"indexer", patient, "name[1].given", []interface{}{"Jim"}},
+		{"where", patient, "name.where(family = 'Chalmers').given.first()", []interface{}{"Peter"}},
+		{"select count", patient, "name.select(given.count())", []interface{}{int64(2), int64(1)}},
+		{"backbone", patient, "contact.name.family", []interface{}{"du Marché"}},
+		{"choice", patient, "deceased", []interface{}{false}},
+		{"primitive extension", patient, "birthDate.extension.value", []interface{}{"1974-12-25T14:35:45-05:00"}},
+
+		// Types
+		{"ofType", observation, "value.ofType(Quantity).unit", []interface{}{"kg"}},
+		{"ofType other", observation, "value.ofType(string)", []interface{}{}},
+		{"is", observation, "value is Quantity", []interface{}{true}},
+		{"is function", observation, "value.is(CodeableConcept)", []interface{}{false}},
+		{"is primitive", patient, "birthDate is date", []interface{}{true}},
+		{"is System", patient, "birthDate.toString() is System.String", []interface{}{true}},
+		{"is resource", patient, "contained.first() is Organization", []interface{}{true}},
+		{"as", observation, "(value as Quantity).value", []interface{}{72.5}},
+		{"as function", observation, "effective.as(dateTime)", []interface{}{"2020-01-31T10:00:00Z"}},
+		{"as other", observation, "value.as(string)", []interface{}{}},
+
+		// resolve()
+		{"resolve contained", patient, "managingOrganization.resolve().name", []interface{}{"Acme"}},
+		{"resolve stub", observation, "subject.resolve() is Patient", []interface{}{true}},
+		{"resolve missing", patient, "managingOrganization.reference.replace('o1', 'o2').resolve()", []interface{}{}},
+
+		// Tree navigation
+		{"descendants", patient, "descendants().where($this is HumanName).count()", []interface{}{int64(3)}},
+		{"descendants references", patient, "descendants().reference", []interface{}{"#o1"}},
+		{"children", patient, "contact.children().count()", []interface{}{int64(1)}},
+
+		// Environment
+		{"resource", patient, "%resource.id", []interface{}{"p1"}},
+		{"rootResource", patient, "contained.select(%rootResource.id)", []interface{}{"p1"}},
+		{"context", patient, "%context.birthDate", []interface{}{"1974-12-25"}},
+		{"ucum", patient, "%ucum", []interface{}{"http://unitsofmeasure.org"}},
+
+		// Dates
+		{"add month clamps", patient, "@2020-01-31 + 1 month", []interface{}{"2020-02-29"}},
+		{"subtract month clamps", patient, "@2020-03-31 - 1 month", []interface{}{"2020-02-29"}},
+		{"add year from leap day", patient, "@2020-02-29 + 1 year", []interface{}{"2021-02-28"}},
+		{"add UCUM month", patient, "@2019-01-31 + 1 'mo'", []interface{}{"2019-02-28"}},
+		{"add days", patient, "@2020-12-30 + 3 days", []interface{}{"2021-01-02"}},
+		{"add hours", patient, "@2020-01-01T23:00:00Z + 2 hours", []interface{}{"2020-01-02T01:00:00Z"}},
+		{"compare dates", patient, "birthDate < @1975-01-01", []interface{}{true}},
+		{"compare precision", patient, "@2020-01 = @2020-01-01", []interface{}{}},
+		{"compare zones", patient, "@2020-01-01T10:00:00+02:00 = @2020-01-01T08:00:00Z", []interface{}{true}},
+		{"date from string", observation, "effective > @2020-01-30", []interface{}{true}},
+
+		// Quantities
+		{"same unit", patient, "1 'kg' = 1 'kg'", []interface{}{true}},
+		{"converted units", patient, "1 'kg' = 1000 'g'", []interface{}{true}},
+		{"converted ratio", patient, "10 'mg/dL' = 100 'mg/L'", []interface{}{true}},
+		{"converted comparison", patient, "1 'kg' > 999 'g'", []interface{}{true}},
+		{"calendar and UCUM", patient, "1 hour = 60 'min'", []interface{}{true}},
+		{"different dimensions", patient, "1 'kg' = 1 'm'", []interface{}{false}},
+		{"incomparable", patient, "1 'kg' < 1 'm'", []interface{}{}},
+		{"addition converts", patient, "1 'kg' + 500 'g'", []interface{}{"1.5 'kg'"}},
+		{"resource quantity", observation, "value > 70 'kg'", []interface{}{true}},
+		{"resource quantity converted", observation, "value < 73000 'g'", []interface{}{true}},
+
+		// Functions
+		{"conformsTo own type", patient, "conformsTo('http://hl7.org/fhir/StructureDefinition/Patient')", []interface{}{true}},
+		{"conformsTo base type", patient, "conformsTo('http://hl7.org/fhir/StructureDefinition/DomainResource')", []interface{}{true}},
+		{"conformsTo other type", patient, "conformsTo('http://hl7.org/fhir/StructureDefinition/Observation')", []interface{}{false}},
+		{"conformsTo profile", patient, "conformsTo('http://example.org/StructureDefinition/my-patient')", []interface{}{}},
+		{"iif", patient, "iif(name.exists(), 'named', 'anonymous')", []interface{}{"named"}},
+		{"string functions", patient, "name.first().family.substring(0, 4).upper()", []interface{}{"CHAL"}},
+		{"matches", patient, "id.matches('^[a-z][0-9]$')", []interface{}{true}},
+		{"integer division", patient, "7 div 2", []interface{}{int64(3)}},
+		{"decimal division", patient, "7 / 2", []interface{}{3.5}},
+		{"empty propagation", patient, "nothing + 1", []interface{}{}},
+		{"three-valued and", patient, "nothing.exists().not() and {}", []interface{}{}},
+		{"implies", patient, "false implies nothing", []interface{}{true}},
+		{"union distinct", patient, "(1 | 2 | 1).count()", []interface{}{int64(2)}},
+		{"combine keeps duplicates", patient, "(1).combine(1).count()", []interface{}{int64(2)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Evaluate(decode(t, tt.resource), tt.expression, &Environment{Model: model})
+			if err != nil {
+				t.Fatalf("Evaluate: %v", err)
+			}
+			if got := result.Values(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %#v, want %#v", tt.expression, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateWithoutModel(t *testing.T) {
+	// Choice elements are found by the type suffix of their property name
+	result, err := Evaluate(decode(t, observation), "value.ofType(Quantity).value", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Values(); !reflect.DeepEqual(got, []interface{}{72.5}) {
+		t.Errorf("got %v, want [72.5]", got)
+	}
+}
+
+func TestEvaluateEnvironment(t *testing.T) {
+	bundle := decode(t, `{
+		"resourceType": "Bundle",
+		"id": "b1",
+		"entry": [
+			{"fullUrl": "http://example.org/Patient/p1", "resource": {"resourceType": "Patient", "id": "p1", "gender": "male"}},
+			{"fullUrl": "http://example.org/Observation/o1", "resource": `+observation+`}
+		]
+	}`)
+	entries := bundle["entry"].([]interface{})
+	obs := entries[1].(map[string]interface{})["resource"]
+
+	env := &Environment{Model: model, Resource: obs, RootResource: bundle}
+	result, err := Evaluate(obs, "subject.resolve().gender", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Values(); !reflect.DeepEqual(got, []interface{}{"male"}) {
+		t.Errorf("resolve() in a Bundle = %v, want [male]", got)
+	}
+
+	result, err = Evaluate(obs, "%rootResource.id & '/' & %resource.id", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Values(); !reflect.DeepEqual(got, []interface{}{"b1/o1"}) {
+		t.Errorf("got %v, want [b1/o1]", got)
+	}
+
+	// A backbone element is typed by its path
+	contact := decode(t, `{"name": {"family": "du Marché"}}`)
+	result, err = Evaluate(contact, "name.family", &Environment{Model: model, Type: "Patient.contact"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Values(); !reflect.DeepEqual(got, []interface{}{"du Marché"}) {
+		t.Errorf("got %v, want [du Marché]", got)
+	}
+
+	// External constants
+	result, err = Evaluate(contact, "%limit + 1", &Environment{Variables: map[string]interface{}{"limit": int64(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Values(); !reflect.DeepEqual(got, []interface{}{int64(3)}) {
+		t.Errorf("got %v, want [3]", got)
+	}
+	if _, err := Evaluate(contact, "%missing", nil); err == nil {
+		t.Error("an unknown external constant should be an error")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var labels []string
+	var traced []interface{}
+	env := &Environment{Model: model, Trace: func(label string, values Collection) {
+		labels = append(labels, label)
+		traced = append(traced, values.Values()...)
+	}}
+
+	result, err := Evaluate(decode(t, patient), "name.trace('names', family).given.count()", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Values(); !reflect.DeepEqual(got, []interface{}{int64(3)}) {
+		t.Errorf("trace() changed the result: %v", got)
+	}
+	if !reflect.DeepEqual(labels, []string{"names"}) || !reflect.DeepEqual(traced, []interface{}{"Chalmers"}) {
+		t.Errorf("traced %v %v, want [names] [Chalmers]", labels, traced)
+	}
+}
+
+// TestCoreInvariants evaluates the R4 invariants that every resource and element carries.
+func TestCoreInvariants(t *testing.T) {
+	const (
+		dom2 = "contained.contained.empty()"
+		dom3 = "contained.where((('#'+id in (%resource.descendants().reference | %resource.descendants().as(canonical) | %resource.descendants().as(uri) | %resource.descendants().as(url))) or descendants().where(reference = '#').exists() or descendants().where(as(canonical) = '#').exists() or descendants().where(as(canonical) = '#').exists()).not()).trace('unmatched', id).empty()"
+		dom4 = "contained.meta.versionId.empty() and contained.meta.lastUpdated.empty()"
+		dom5 = "contained.meta.security.empty()"
+		dom6 = "text.`div`.exists()"
+		ele1 = "hasValue() or (children().count() > id.count())"
+	)
+
+	tests := []struct {
+		name       string
+		input      interface{}
+		typeName   string
+		expression string
+		want       bool
+	}{
+		{"dom-2 flat", decode(t, patient), "", dom2, true},
+		{"dom-2 nested", decode(t, `{"resourceType": "Patient", "contained": [{"resourceType": "Organization", "id": "o1", "contained": [{"resourceType": "Patient", "id": "x"}]}]}`), "", dom2, false},
+		{"dom-3 referenced", decode(t, patient), "", dom3, true},
+		{"dom-3 unreferenced", decode(t, `{"resourceType": "Patient", "contained": [{"resourceType": "Organization", "id": "o1"}]}`), "", dom3, false},
+		{"dom-3 back reference", decode(t, `{"resourceType": "Patient", "id": "p", "contained": [{"resourceType": "Organization", "id": "o1", "partOf": {"reference": "#"}}]}`), "", dom3, true},
+		{"dom-4 no meta", decode(t, patient), "", dom4, true},
+		{"dom-4 versionId", decode(t, `{"resourceType": "Patient", "contained": [{"resourceType": "Organization", "id": "o1", "meta": {"versionId": "2"}}]}`), "", dom4, false},
+		{"dom-5 no security", decode(t, patient), "", dom5, true},
+		{"dom-5 security", decode(t, `{"resourceType": "Patient", "contained": [{"resourceType": "Organization", "id": "o1", "meta": {"security": [{"code": "R"}]}}]}`), "", dom5, false},
+		{"dom-6 narrative", decode(t, `{"resourceType": "Patient", "text": {"status": "generated", "div": "<div xmlns=\"http://www.w3.org/1999/xhtml\">x</div>"}}`), "", dom6, true},
+		{"dom-6 no narrative", decode(t, patient), "", dom6, false},
+		{"ele-1 children", decode(t, `{"family": "Chalmers"}`), "HumanName", ele1, true},
+		{"ele-1 id only", decode(t, `{"id": "n1"}`), "HumanName", ele1, false},
+		{"ele-1 empty", decode(t, `{}`), "HumanName", ele1, false},
+		{"ele-1 primitive", "Chalmers", "string", ele1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Evaluate(tt.input, tt.expression, &Environment{Model: model, Type: tt.typeName})
+			if err != nil {
+				t.Fatalf("Evaluate: %v", err)
+			}
+			got, ok := result.Boolean()
+			if !ok || got != tt.want {
+				t.Errorf("got %v, want %v", result.Values(), tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	for _, expression := range []string{"unknownFunction()", "name.given.substring()", "1 + 'a'", "name.given + 1", "-'a'"} {
+		if _, err := Evaluate(decode(t, patient), expression, &Environment{Model: model}); err == nil {
+			t.Errorf("Evaluate(%q) succeeded, want an error", expression)
+		}
+	}
+}
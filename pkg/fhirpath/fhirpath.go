@@ -0,0 +1,189 @@
+// Package fhirpath implements a FHIRPath lexer, parser and evaluator for FHIR R4
+// resources decoded from JSON into map[string]interface{} values.
+package fhirpath
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Node is a single item of a FHIRPath collection.
+type Node struct {
+	// Value is a JSON value (map[string]interface{}, string, float64, bool), a
+	// System value (int64, Date, DateTime, Time, Quantity) or nil for a primitive
+	// that only carries extensions.
+	Value interface{}
+	// Type is the FHIR type code ("HumanName", "date") or a System type
+	// ("System.String"). It is empty when the type is unknown.
+	Type string
+
+	path string                 // element definition path used for model lookups
+	ext  map[string]interface{} // primitive extension object (the "_name" property)
+}
+
+// Collection is an ordered FHIRPath collection.
+type Collection []Node
+
+// Values returns the items of the collection as plain Go values suitable for JSON encoding.
+func (c Collection) Values() []interface{} {
+	values := make([]interface{}, 0, len(c))
+	for _, n := range c {
+		if s, ok := toStringValue(n.Value); ok {
+			switch n.Value.(type) {
+			case Date, DateTime, Time, Quantity:
+				values = append(values, s)
+				continue
+			}
+		}
+		values = append(values, n.Value)
+	}
+	return values
+}
+
+// Strings returns the string representation of each primitive item of the collection.
+func (c Collection) Strings() []string {
+	values := make([]string, 0, len(c))
+	for _, n := range c {
+		if s, ok := toStringValue(toSystem(n)); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// Boolean converts the collection to a single boolean. The second result is false
+// when the collection is empty or does not contain a single boolean.
+func (c Collection) Boolean() (bool, bool) {
+	if len(c) != 1 {
+		return false, false
+	}
+	b, ok := toSystem(c[0]).(bool)
+	return b, ok
+}
+
+// Environment carries the evaluation context of an expression.
+type Environment struct {
+	// Resource and RootResource are exposed as %resource and %rootResource.
+	// They default to the input when nil.
+	Resource     interface{}
+	RootResource interface{}
+	// Variables holds additional external constants, keyed without the '%'.
+	Variables map[string]interface{}
+	// Type is the FHIR type of the input when it carries no resourceType,
+	// e.g. "Period" or the backbone path "Patient.contact".
+	Type string
+	// Model provides element types for navigation; may be nil.
+	Model Model
+	// Trace receives the values passed to trace().
+	Trace func(label string, values Collection)
+	// Context, when set, aborts the evaluation with its error once it is done.
+	Context context.Context
+}
+
+// Expression is a compiled FHIRPath expression.
+type Expression struct {
+	source string
+	tree   expr
+}
+
+// Compile parses a FHIRPath expression.
+func Compile(source string) (*Expression, error) {
+	tree, err := parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{source: source, tree: tree}, nil
+}
+
+// MustCompile is like Compile but panics if the expression cannot be parsed.
+func MustCompile(source string) *Expression {
+	e, err := Compile(source)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate evaluates the expression against input, a decoded JSON value.
+func (e *Expression) Evaluate(input interface{}, env *Environment) (result Collection, err error) {
+	if env == nil {
+		env = &Environment{}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("fhirpath: evaluating %q: %v", e.source, r)
+		}
+	}()
+
+	root := newRootNode(input, env.Type, env.Model)
+	ctx := &evalContext{env: env, model: env.Model}
+	ctx.context = Collection{}
+	if root != nil {
+		ctx.context = Collection{*root}
+	}
+	ctx.resource = ctx.nodeFor(env.Resource, ctx.context)
+	ctx.rootResource = ctx.nodeFor(env.RootResource, ctx.resource)
+	ctx.this = ctx.context
+
+	result, err = ctx.eval(e.tree, ctx.context)
+	if err != nil {
+		return nil, fmt.Errorf("fhirpath: evaluating %q: %w", e.source, err)
+	}
+	return result, nil
+}
+
+// Evaluate compiles and evaluates expression against input.
+func Evaluate(input interface{}, expression string, env *Environment) (Collection, error) {
+	e, err := Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	return e.Evaluate(input, env)
+}
+
+// newRootNode wraps an input value, typing it from its resourceType or typeName.
+func newRootNode(input interface{}, typeName string, model Model) *Node {
+	if input == nil {
+		return nil
+	}
+	if n, ok := input.(Node); ok {
+		return &n
+	}
+	n := Node{Value: input}
+	if m, ok := input.(map[string]interface{}); ok {
+		if rt, ok := m["resourceType"].(string); ok {
+			n.Type, n.path = rt, rt
+			return &n
+		}
+	}
+	if typeName != "" {
+		n.Type, n.path = typeName, typeName
+		// A backbone path such as "Patient.contact" is typed by its model definition.
+		if model != nil {
+			if info, ok := model.ElementInfo(typeName); ok && len(info.Types) == 1 {
+				if t := info.Types[0]; t != "BackboneElement" && t != "Element" {
+					n.Type, n.path = t, t
+				} else {
+					n.Type = t
+				}
+			}
+		}
+	}
+	return &n
+}
+
+// SortedKeys returns the keys of m in a stable order.
+func SortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
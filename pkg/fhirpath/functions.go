@@ -0,0 +1,1174 @@
+package fhirpath
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type function struct {
+	minArgs, maxArgs int
+	fn               func(c *evalContext, focus Collection, args []expr) (Collection, error)
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		// Existence
+		"empty":      {0, 0, fnEmpty},
+		"exists":     {0, 1, fnExists},
+		"all":        {1, 1, fnAll},
+		"allTrue":    {0, 0, boolAggregate(true, true)},
+		"anyTrue":    {0, 0, boolAggregate(false, true)},
+		"allFalse":   {0, 0, boolAggregate(true, false)},
+		"anyFalse":   {0, 0, boolAggregate(false, false)},
+		"subsetOf":   {1, 1, fnSubsetOf},
+		"supersetOf": {1, 1, fnSupersetOf},
+		"count":      {0, 0, fnCount},
+		"distinct":   {0, 0, fnDistinct},
+		"isDistinct": {0, 0, fnIsDistinct},
+		"hasValue":   {0, 0, fnHasValue},
+		"getValue":   {0, 0, fnGetValue},
+
+		// Filtering and projection
+		"where":     {1, 1, fnWhere},
+		"select":    {1, 1, fnSelect},
+		"repeat":    {1, 1, fnRepeat},
+		"ofType":    {1, 1, fnOfType},
+		"as":        {1, 1, fnOfType},
+		"is":        {1, 1, fnIs},
+		"aggregate": {1, 2, fnAggregate},
+
+		// Subsetting
+		"single":    {0, 0, fnSingle},
+		"first":     {0, 0, fnFirst},
+		"last":      {0, 0, fnLast},
+		"tail":      {0, 0, fnTail},
+		"skip":      {1, 1, fnSkip},
+		"take":      {1, 1, fnTake},
+		"intersect": {1, 1, fnIntersect},
+		"exclude":   {1, 1, fnExclude},
+
+		// Combining
+		"union":   {1, 1, fnUnion},
+		"combine": {1, 1, fnCombine},
+
+		// Boolean and conversion
+		"not":                {0, 0, fnNot},
+		"iif":                {2, 3, fnIif},
+		"toBoolean":          {0, 0, convert(toBoolean)},
+		"convertsToBoolean":  {0, 0, convertsTo(toBoolean)},
+		"toInteger":          {0, 0, convert(toInteger)},
+		"convertsToInteger":  {0, 0, convertsTo(toInteger)},
+		"toDecimal":          {0, 0, convert(toDecimal)},
+		"convertsToDecimal":  {0, 0, convertsTo(toDecimal)},
+		"toString":           {0, 0, convert(toStringNode)},
+		"convertsToString":   {0, 0, convertsTo(toStringNode)},
+		"toDate":             {0, 0, convert(toDate)},
+		"convertsToDate":     {0, 0, convertsTo(toDate)},
+		"toDateTime":         {0, 0, convert(toDateTime)},
+		"convertsToDateTime": {0, 0, convertsTo(toDateTime)},
+		"toTime":             {0, 0, convert(toTime)},
+		"convertsToTime":     {0, 0, convertsTo(toTime)},
+		"toQuantity":         {0, 1, convert(toQuantity)},
+		"convertsToQuantity": {0, 1, convertsTo(toQuantity)},
+
+		// Strings
+		"indexOf":        {1, 1, fnIndexOf},
+		"substring":      {1, 2, fnSubstring},
+		"startsWith":     {1, 1, stringPredicate(strings.HasPrefix)},
+		"endsWith":       {1, 1, stringPredicate(strings.HasSuffix)},
+		"contains":       {1, 1, stringPredicate(strings.Contains)},
+		"upper":          {0, 0, stringMap(strings.ToUpper)},
+		"lower":          {0, 0, stringMap(strings.ToLower)},
+		"trim":           {0, 0, stringMap(strings.TrimSpace)},
+		"replace":        {2, 2, fnReplace},
+		"matches":        {1, 1, fnMatches},
+		"replaceMatches": {2, 2, fnReplaceMatches},
+		"length":         {0, 0, fnLength},
+		"toChars":        {0, 0, fnToChars},
+		"split":          {1, 1, fnSplit},
+		"join":           {0, 1, fnJoin},
+
+		// Math
+		"abs":      {0, 0, mathFn(math.Abs, "")},
+		"ceiling":  {0, 0, mathFn(math.Ceil, "Integer")},
+		"floor":    {0, 0, mathFn(math.Floor, "Integer")},
+		"truncate": {0, 0, mathFn(math.Trunc, "Integer")},
+		"exp":      {0, 0, mathFn(math.Exp, "Decimal")},
+		"ln":       {0, 0, mathFn(math.Log, "Decimal")},
+		"sqrt":     {0, 0, mathFn(math.Sqrt, "Decimal")},
+		"log":      {1, 1, fnLog},
+		"power":    {1, 1, fnPower},
+		"round":    {0, 1, fnRound},
+
+		// Tree navigation
+		"children":    {0, 0, fnChildren},
+		"descendants": {0, 0, fnDescendants},
+
+		// Utility
+		"trace":     {1, 2, fnTrace},
+		"now":       {0, 0, fnNow},
+		"today":     {0, 0, fnToday},
+		"timeOfDay": {0, 0, fnTimeOfDay},
+
+		// FHIR specific
+		"extension":      {1, 1, fnExtension},
+		"resolve":        {0, 0, fnResolve},
+		"memberOf":       {1, 1, fnUnknown},
+		"conformsTo":     {1, 1, fnConformsTo},
+		"htmlChecks":     {0, 0, fnHtmlChecks},
+		"checkModifiers": {0, 1, fnIdentity},
+	}
+}
+
+func (c *evalContext) callFunction(e *functionExpr, focus Collection) (Collection, error) {
+	f, ok := functions[e.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s()", e.name)
+	}
+	if len(e.args) < f.minArgs || len(e.args) > f.maxArgs {
+		return nil, fmt.Errorf("wrong number of arguments for %s()", e.name)
+	}
+	return f.fn(c, focus, e.args)
+}
+
+// arg evaluates a non-lambda argument against $this.
+func (c *evalContext) arg(e expr) (Collection, error) {
+	return c.eval(e, c.this)
+}
+
+func (c *evalContext) stringArg(e expr) (string, bool, error) {
+	v, err := c.arg(e)
+	if err != nil {
+		return "", false, err
+	}
+	s, ok := singletonString(v)
+	return s, ok, nil
+}
+
+func (c *evalContext) intArg(e expr) (int64, bool, error) {
+	v, err := c.arg(e)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(v) != 1 {
+		return 0, false, nil
+	}
+	i, ok := toSystem(v[0]).(int64)
+	if !ok {
+		return 0, false, fmt.Errorf("expected an integer argument")
+	}
+	return i, true, nil
+}
+
+// typeArg extracts the type name passed to ofType(), as() and is().
+func typeArg(e expr) (string, error) {
+	switch e := e.(type) {
+	case *identifierExpr:
+		return e.name, nil
+	case *invocationExpr:
+		ns, ok1 := e.target.(*identifierExpr)
+		name, ok2 := e.member.(*identifierExpr)
+		if ok1 && ok2 {
+			return ns.name + "." + name.name, nil
+		}
+	}
+	return "", fmt.Errorf("expected a type name")
+}
+
+// lambda evaluates e for each item of focus with $this and $index bound.
+func (c *evalContext) lambda(focus Collection, e expr, each func(i int, item Node, result Collection) (bool, error)) error {
+	for i, item := range focus {
+		inner := c.withThis(item, i)
+		result, err := inner.eval(e, inner.this)
+		if err != nil {
+			return err
+		}
+		cont, err := each(i, item, result)
+		if err != nil || !cont {
+			return err
+		}
+	}
+	return nil
+}
+
+func fnEmpty(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	return boolean(len(focus) == 0), nil
+}
+
+func fnExists(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	if len(args) == 0 {
+		return boolean(len(focus) > 0), nil
+	}
+	filtered, err := fnWhere(c, focus, args)
+	if err != nil {
+		return nil, err
+	}
+	return boolean(len(filtered) > 0), nil
+}
+
+func fnAll(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	all := true
+	err := c.lambda(focus, args[0], func(_ int, _ Node, result Collection) (bool, error) {
+		b, ok, err := singletonBoolean(result)
+		if err != nil {
+			return false, err
+		}
+		if !ok || !b {
+			all = false
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return boolean(all), nil
+}
+
+// boolAggregate implements allTrue, anyTrue, allFalse and anyFalse.
+func boolAggregate(all, want bool) func(*evalContext, Collection, []expr) (Collection, error) {
+	return func(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+		for _, n := range focus {
+			b, ok := toSystem(n).(bool)
+			if !ok {
+				return nil, fmt.Errorf("expected boolean items")
+			}
+			if all && b != want {
+				return boolean(false), nil
+			}
+			if !all && b == want {
+				return boolean(true), nil
+			}
+		}
+		return boolean(all), nil
+	}
+}
+
+func fnSubsetOf(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	other, err := c.arg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range focus {
+		if !containsNode(other, n) {
+			return boolean(false), nil
+		}
+	}
+	return boolean(true), nil
+}
+
+func fnSupersetOf(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	other, err := c.arg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range other {
+		if !containsNode(focus, n) {
+			return boolean(false), nil
+		}
+	}
+	return boolean(true), nil
+}
+
+func fnCount(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	return Collection{{Value: int64(len(focus))}}, nil
+}
+
+func fnDistinct(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	return union(focus, nil), nil
+}
+
+func fnIsDistinct(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	return boolean(len(union(focus, nil)) == len(focus)), nil
+}
+
+func fnHasValue(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	if len(focus) != 1 {
+		return boolean(false), nil
+	}
+	switch focus[0].Value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return boolean(false), nil
+	}
+	return boolean(true), nil
+}
+
+func fnGetValue(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	has, _ := fnHasValue(c, focus, args)
+	if b, _ := has.Boolean(); !b {
+		return Collection{}, nil
+	}
+	return Collection{{Value: toSystem(focus[0])}}, nil
+}
+
+func fnWhere(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	filtered := Collection{}
+	err := c.lambda(focus, args[0], func(_ int, item Node, result Collection) (bool, error) {
+		b, ok, err := singletonBoolean(result)
+		if err != nil {
+			return false, err
+		}
+		if ok && b {
+			filtered = append(filtered, item)
+		}
+		return true, nil
+	})
+	return filtered, err
+}
+
+func fnSelect(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	projected := Collection{}
+	err := c.lambda(focus, args[0], func(_ int, _ Node, result Collection) (bool, error) {
+		projected = append(projected, result...)
+		return true, nil
+	})
+	return projected, err
+}
+
+func fnRepeat(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	result := Collection{}
+	queue := focus
+	for len(queue) > 0 {
+		next, err := fnSelect(c, queue, args)
+		if err != nil {
+			return nil, err
+		}
+		queue = Collection{}
+		for _, n := range next {
+			if !containsNode(result, n) {
+				result = append(result, n)
+				queue = append(queue, n)
+			}
+		}
+	}
+	return result, nil
+}
+
+func fnOfType(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	typeName, err := typeArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return c.ofType(focus, typeName), nil
+}
+
+func fnIs(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	typeName, err := typeArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(focus) == 0 {
+		return Collection{}, nil
+	}
+	if len(focus) > 1 {
+		return nil, fmt.Errorf("is() requires a single item")
+	}
+	return boolean(c.isType(focus[0], typeName)), nil
+}
+
+func fnAggregate(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	total := Collection{}
+	if len(args) > 1 {
+		init, err := c.arg(args[1])
+		if err != nil {
+			return nil, err
+		}
+		total = init
+	}
+	for i, item := range focus {
+		inner := c.withThis(item, i)
+		inner.total = total
+		result, err := inner.eval(args[0], inner.this)
+		if err != nil {
+			return nil, err
+		}
+		total = result
+	}
+	return total, nil
+}
+
+func fnSingle(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	if len(focus) > 1 {
+		return nil, fmt.Errorf("single() called on a collection with %d items", len(focus))
+	}
+	return focus, nil
+}
+
+func fnFirst(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	if len(focus) == 0 {
+		return Collection{}, nil
+	}
+	return focus[:1], nil
+}
+
+func fnLast(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	if len(focus) == 0 {
+		return Collection{}, nil
+	}
+	return focus[len(focus)-1:], nil
+}
+
+func fnTail(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	if len(focus) == 0 {
+		return Collection{}, nil
+	}
+	return focus[1:], nil
+}
+
+func fnSkip(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	n, ok, err := c.intArg(args[0])
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	if n <= 0 {
+		return focus, nil
+	}
+	if int(n) >= len(focus) {
+		return Collection{}, nil
+	}
+	return focus[n:], nil
+}
+
+func fnTake(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	n, ok, err := c.intArg(args[0])
+	if err != nil || !ok || n <= 0 {
+		return Collection{}, err
+	}
+	if int(n) >= len(focus) {
+		return focus, nil
+	}
+	return focus[:n], nil
+}
+
+func fnIntersect(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	other, err := c.arg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	result := Collection{}
+	for _, n := range focus {
+		if containsNode(other, n) && !containsNode(result, n) {
+			result = append(result, n)
+		}
+	}
+	return result, nil
+}
+
+func fnExclude(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	other, err := c.arg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	result := Collection{}
+	for _, n := range focus {
+		if !containsNode(other, n) {
+			result = append(result, n)
+		}
+	}
+	return result, nil
+}
+
+func fnUnion(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	other, err := c.arg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return union(focus, other), nil
+}
+
+func fnCombine(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	other, err := c.arg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return append(append(Collection{}, focus...), other...), nil
+}
+
+func fnNot(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	b, ok, err := singletonBoolean(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	return boolean(!b), nil
+}
+
+func fnIif(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	if len(focus) > 1 {
+		return nil, fmt.Errorf("iif() requires a single item")
+	}
+	inner := c
+	if len(focus) == 1 {
+		inner = c.withThis(focus[0], 0)
+	}
+	criterion, err := inner.eval(args[0], inner.this)
+	if err != nil {
+		return nil, err
+	}
+	b, ok, err := singletonBoolean(criterion)
+	if err != nil {
+		return nil, err
+	}
+	if ok && b {
+		return inner.eval(args[1], inner.this)
+	}
+	if len(args) > 2 {
+		return inner.eval(args[2], inner.this)
+	}
+	return Collection{}, nil
+}
+
+// converter converts a single item; ok is false when the item cannot be converted.
+type converter func(n Node) (Node, bool)
+
+func convert(f converter) func(*evalContext, Collection, []expr) (Collection, error) {
+	return func(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+		if len(focus) == 0 {
+			return Collection{}, nil
+		}
+		if len(focus) > 1 {
+			return nil, fmt.Errorf("conversion requires a single item")
+		}
+		if n, ok := f(focus[0]); ok {
+			return Collection{n}, nil
+		}
+		return Collection{}, nil
+	}
+}
+
+func convertsTo(f converter) func(*evalContext, Collection, []expr) (Collection, error) {
+	return func(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+		if len(focus) == 0 {
+			return Collection{}, nil
+		}
+		if len(focus) > 1 {
+			return nil, fmt.Errorf("conversion requires a single item")
+		}
+		_, ok := f(focus[0])
+		return boolean(ok), nil
+	}
+}
+
+func toBoolean(n Node) (Node, bool) {
+	switch v := toSystem(n).(type) {
+	case bool:
+		return Node{Value: v}, true
+	case int64:
+		if v == 0 || v == 1 {
+			return Node{Value: v == 1}, true
+		}
+	case float64:
+		if v == 0 || v == 1 {
+			return Node{Value: v == 1}, true
+		}
+	case string:
+		switch strings.ToLower(v) {
+		case "true", "t", "yes", "y", "1", "1.0":
+			return Node{Value: true}, true
+		case "false", "f", "no", "n", "0", "0.0":
+			return Node{Value: false}, true
+		}
+	}
+	return Node{}, false
+}
+
+func toInteger(n Node) (Node, bool) {
+	switch v := toSystem(n).(type) {
+	case int64:
+		return Node{Value: v}, true
+	case bool:
+		if v {
+			return Node{Value: int64(1)}, true
+		}
+		return Node{Value: int64(0)}, true
+	case string:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return Node{Value: i}, true
+		}
+	}
+	return Node{}, false
+}
+
+func toDecimal(n Node) (Node, bool) {
+	switch v := toSystem(n).(type) {
+	case int64:
+		return Node{Value: float64(v), Type: "System.Decimal"}, true
+	case float64:
+		return Node{Value: v, Type: "System.Decimal"}, true
+	case bool:
+		if v {
+			return Node{Value: 1.0, Type: "System.Decimal"}, true
+		}
+		return Node{Value: 0.0, Type: "System.Decimal"}, true
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return Node{Value: f, Type: "System.Decimal"}, true
+		}
+	}
+	return Node{}, false
+}
+
+func toStringNode(n Node) (Node, bool) {
+	if s, ok := toStringValue(toSystem(n)); ok {
+		return Node{Value: s, Type: "System.String"}, true
+	}
+	return Node{}, false
+}
+
+func toDate(n Node) (Node, bool) {
+	switch v := toSystem(n).(type) {
+	case Date:
+		return Node{Value: v}, true
+	case DateTime:
+		d := v.temporal
+		d.precision = min(d.precision, PrecisionDay)
+		d.hasZone = false
+		d.raw = formatTemporal(d)
+		return Node{Value: Date{d}}, true
+	case string:
+		if d, ok := ParseDate(v); ok {
+			return Node{Value: d}, true
+		}
+		if dt, ok := ParseDateTime(v); ok {
+			return toDate(Node{Value: dt})
+		}
+	}
+	return Node{}, false
+}
+
+func toDateTime(n Node) (Node, bool) {
+	switch v := toSystem(n).(type) {
+	case DateTime:
+		return Node{Value: v}, true
+	case Date:
+		return Node{Value: DateTime{v.temporal}}, true
+	case string:
+		if d, ok := ParseDateTime(v); ok {
+			return Node{Value: d}, true
+		}
+	}
+	return Node{}, false
+}
+
+func toTime(n Node) (Node, bool) {
+	switch v := toSystem(n).(type) {
+	case Time:
+		return Node{Value: v}, true
+	case string:
+		if t, ok := ParseTime(v); ok {
+			return Node{Value: t}, true
+		}
+	}
+	return Node{}, false
+}
+
+var quantityString = regexp.MustCompile(`^\s*([+-]?\d+(\.\d+)?)\s*('([^']+)'|([a-zA-Z]+))?\s*$`)
+
+func toQuantity(n Node) (Node, bool) {
+	switch v := toSystem(n).(type) {
+	case Quantity:
+		return Node{Value: v}, true
+	case int64:
+		return Node{Value: Quantity{Value: float64(v), Unit: "1"}}, true
+	case float64:
+		return Node{Value: Quantity{Value: v, Unit: "1"}}, true
+	case string:
+		m := quantityString.FindStringSubmatch(v)
+		if m == nil {
+			return Node{}, false
+		}
+		f, _ := strconv.ParseFloat(m[1], 64)
+		unit := "1"
+		switch {
+		case m[4] != "":
+			unit = m[4]
+		case m[5] != "":
+			if !calendarKeywords[m[5]] {
+				return Node{}, false
+			}
+			unit = m[5]
+		}
+		return Node{Value: Quantity{Value: f, Unit: unit}}, true
+	}
+	return Node{}, false
+}
+
+func stringFocus(focus Collection) (string, bool, error) {
+	if len(focus) == 0 {
+		return "", false, nil
+	}
+	if len(focus) > 1 {
+		return "", false, fmt.Errorf("expected a single string, found %d items", len(focus))
+	}
+	s, ok := toSystem(focus[0]).(string)
+	if !ok {
+		return "", false, fmt.Errorf("expected a string")
+	}
+	return s, true, nil
+}
+
+func fnIndexOf(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	sub, ok, err := c.stringArg(args[0])
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	i := strings.Index(s, sub)
+	if i > 0 {
+		i = utf8.RuneCountInString(s[:i])
+	}
+	return Collection{{Value: int64(i)}}, nil
+}
+
+func fnSubstring(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	start, ok, err := c.intArg(args[0])
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	runes := []rune(s)
+	if start < 0 || int(start) >= len(runes) {
+		return Collection{}, nil
+	}
+	end := int64(len(runes))
+	if len(args) > 1 {
+		length, ok, err := c.intArg(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			end = min(start+max(length, 0), end)
+		}
+	}
+	return str(string(runes[start:end])), nil
+}
+
+func stringPredicate(f func(s, arg string) bool) func(*evalContext, Collection, []expr) (Collection, error) {
+	return func(c *evalContext, focus Collection, args []expr) (Collection, error) {
+		s, ok, err := stringFocus(focus)
+		if err != nil || !ok {
+			return Collection{}, err
+		}
+		arg, ok, err := c.stringArg(args[0])
+		if err != nil || !ok {
+			return Collection{}, err
+		}
+		return boolean(f(s, arg)), nil
+	}
+}
+
+func stringMap(f func(string) string) func(*evalContext, Collection, []expr) (Collection, error) {
+	return func(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+		s, ok, err := stringFocus(focus)
+		if err != nil || !ok {
+			return Collection{}, err
+		}
+		return str(f(s)), nil
+	}
+}
+
+func fnReplace(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	pattern, ok1, err := c.stringArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	substitution, ok2, err := c.stringArg(args[1])
+	if err != nil || !ok1 || !ok2 {
+		return Collection{}, err
+	}
+	return str(strings.ReplaceAll(s, pattern, substitution)), nil
+}
+
+var regexCache sync.Map
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+	}
+	regexCache.Store(pattern, re)
+	return re, nil
+}
+
+func fnMatches(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	pattern, ok, err := c.stringArg(args[0])
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return boolean(re.MatchString(s)), nil
+}
+
+func fnReplaceMatches(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	pattern, ok1, err := c.stringArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	substitution, ok2, err := c.stringArg(args[1])
+	if err != nil || !ok1 || !ok2 {
+		return Collection{}, err
+	}
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return str(re.ReplaceAllString(s, substitution)), nil
+}
+
+func fnLength(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	return Collection{{Value: int64(utf8.RuneCountInString(s))}}, nil
+}
+
+func fnToChars(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	result := Collection{}
+	for _, r := range s {
+		result = append(result, str(string(r))...)
+	}
+	return result, nil
+}
+
+func fnSplit(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	s, ok, err := stringFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	sep, ok, err := c.stringArg(args[0])
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	result := Collection{}
+	for _, part := range strings.Split(s, sep) {
+		result = append(result, str(part)...)
+	}
+	return result, nil
+}
+
+func fnJoin(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	sep := ""
+	if len(args) > 0 {
+		s, _, err := c.stringArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		sep = s
+	}
+	return str(strings.Join(focus.Strings(), sep)), nil
+}
+
+func numberFocus(focus Collection) (interface{}, bool, error) {
+	if len(focus) == 0 {
+		return nil, false, nil
+	}
+	if len(focus) > 1 {
+		return nil, false, fmt.Errorf("expected a single number")
+	}
+	v := toSystem(focus[0])
+	switch v.(type) {
+	case int64, float64, Quantity:
+		return v, true, nil
+	}
+	return nil, false, fmt.Errorf("expected a number")
+}
+
+// mathFn applies f to a number. resultType is "Integer", "Decimal" or "" to keep the input type.
+func mathFn(f func(float64) float64, resultType string) func(*evalContext, Collection, []expr) (Collection, error) {
+	return func(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+		v, ok, err := numberFocus(focus)
+		if err != nil || !ok {
+			return Collection{}, err
+		}
+		if q, ok := v.(Quantity); ok {
+			return Collection{{Value: Quantity{Value: f(q.Value), Unit: q.Unit}}}, nil
+		}
+		x, _ := toFloat(v)
+		r := f(x)
+		if math.IsNaN(r) || math.IsInf(r, 0) {
+			return Collection{}, nil
+		}
+		if resultType == "" {
+			resultType = systemTypeName(v)
+		}
+		if resultType == "Integer" {
+			return Collection{{Value: int64(r)}}, nil
+		}
+		return Collection{{Value: r, Type: "System.Decimal"}}, nil
+	}
+}
+
+func fnLog(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	v, ok, err := numberFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	base, err := c.arg(args[0])
+	if err != nil || len(base) != 1 {
+		return Collection{}, err
+	}
+	x, _ := toFloat(v)
+	b, ok := toFloat(toSystem(base[0]))
+	if !ok {
+		return nil, fmt.Errorf("log() base must be a number")
+	}
+	return Collection{{Value: math.Log(x) / math.Log(b), Type: "System.Decimal"}}, nil
+}
+
+func fnPower(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	v, ok, err := numberFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	exp, err := c.arg(args[0])
+	if err != nil || len(exp) != 1 {
+		return Collection{}, err
+	}
+	e := toSystem(exp[0])
+	x, _ := toFloat(v)
+	y, ok := toFloat(e)
+	if !ok {
+		return nil, fmt.Errorf("power() exponent must be a number")
+	}
+	r := math.Pow(x, y)
+	if math.IsNaN(r) {
+		return Collection{}, nil
+	}
+	_, xInt := v.(int64)
+	_, yInt := e.(int64)
+	if xInt && yInt && y >= 0 {
+		return Collection{{Value: int64(r)}}, nil
+	}
+	return Collection{{Value: r, Type: "System.Decimal"}}, nil
+}
+
+func fnRound(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	v, ok, err := numberFocus(focus)
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	precision := int64(0)
+	if len(args) > 0 {
+		p, ok, err := c.intArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			precision = p
+		}
+	}
+	x, _ := toFloat(v)
+	factor := math.Pow(10, float64(precision))
+	return Collection{{Value: math.Round(x*factor) / factor, Type: "System.Decimal"}}, nil
+}
+
+func fnChildren(c *evalContext, focus Collection, _ []expr) (Collection, error) {
+	result := Collection{}
+	for _, n := range focus {
+		result = append(result, c.allChildren(n)...)
+	}
+	return result, nil
+}
+
+func fnDescendants(c *evalContext, focus Collection, _ []expr) (Collection, error) {
+	result := Collection{}
+	queue := focus
+	for len(queue) > 0 {
+		next := Collection{}
+		for _, n := range queue {
+			next = append(next, c.allChildren(n)...)
+		}
+		result = append(result, next...)
+		queue = next
+	}
+	return result, nil
+}
+
+func fnTrace(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	label, _, err := c.stringArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if c.env.Trace == nil {
+		return focus, nil
+	}
+	values := focus
+	if len(args) > 1 {
+		values, err = fnSelect(c, focus, args[1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.env.Trace(label, values)
+	return focus, nil
+}
+
+func fnNow(_ *evalContext, _ Collection, _ []expr) (Collection, error) {
+	now := time.Now()
+	d, _ := ParseDateTime(now.Format("2006-01-02T15:04:05.000Z07:00"))
+	return Collection{{Value: d}}, nil
+}
+
+func fnToday(_ *evalContext, _ Collection, _ []expr) (Collection, error) {
+	d, _ := ParseDate(time.Now().Format("2006-01-02"))
+	return Collection{{Value: d}}, nil
+}
+
+func fnTimeOfDay(_ *evalContext, _ Collection, _ []expr) (Collection, error) {
+	t, _ := ParseTime(time.Now().Format("15:04:05.000"))
+	return Collection{{Value: t}}, nil
+}
+
+func fnExtension(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	url, ok, err := c.stringArg(args[0])
+	if err != nil || !ok {
+		return Collection{}, err
+	}
+	result := Collection{}
+	for _, ext := range c.member(focus, "extension", false) {
+		if m, ok := ext.Value.(map[string]interface{}); ok && m["url"] == url {
+			result = append(result, ext)
+		}
+	}
+	return result, nil
+}
+
+// fnResolve resolves references against contained resources and Bundle entries of
+// %rootResource. Unresolvable relative references ("Patient/123") resolve to a stub
+// resource carrying only resourceType and id, so type tests still work.
+func fnResolve(c *evalContext, focus Collection, _ []expr) (Collection, error) {
+	result := Collection{}
+	for _, n := range focus {
+		var ref string
+		switch v := n.Value.(type) {
+		case string:
+			ref = v
+		case map[string]interface{}:
+			ref, _ = v["reference"].(string)
+		}
+		if ref == "" {
+			continue
+		}
+		if resolved, ok := c.resolveReference(ref); ok {
+			result = append(result, resolved)
+		}
+	}
+	return result, nil
+}
+
+func (c *evalContext) resolveReference(ref string) (Node, bool) {
+	var roots []map[string]interface{}
+	for _, coll := range []Collection{c.resource, c.rootResource} {
+		for _, n := range coll {
+			if m, ok := n.Value.(map[string]interface{}); ok {
+				roots = append(roots, m)
+			}
+		}
+	}
+
+	if strings.HasPrefix(ref, "#") {
+		for _, root := range roots {
+			contained, _ := root["contained"].([]interface{})
+			for _, item := range contained {
+				if m, ok := item.(map[string]interface{}); ok && m["id"] == ref[1:] {
+					return *newRootNode(m, "", c.model), true
+				}
+			}
+		}
+		return Node{}, false
+	}
+
+	for _, root := range roots {
+		entries, _ := root["entry"].([]interface{})
+		for _, e := range entries {
+			entry, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			resource, ok := entry["resource"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			fullURL, _ := entry["fullUrl"].(string)
+			rt, _ := resource["resourceType"].(string)
+			id, _ := resource["id"].(string)
+			if fullURL == ref || (rt != "" && id != "" && (ref == rt+"/"+id || strings.HasSuffix(fullURL, "/"+ref))) {
+				return *newRootNode(resource, "", c.model), true
+			}
+		}
+	}
+
+	parts := strings.Split(strings.Split(ref, "/_history/")[0], "/")
+	if len(parts) >= 2 {
+		rt, id := parts[len(parts)-2], parts[len(parts)-1]
+		if rt != "" && IsResourceType(rt) {
+			return *newRootNode(map[string]interface{}{"resourceType": rt, "id": id}, "", c.model), true
+		}
+	}
+	return Node{}, false
+}
+
+// fnConformsTo checks the base definitions of the R4 types, e.g.
+// http://hl7.org/fhir/StructureDefinition/Patient, against the type of the focus. Other
+// profiles cannot be checked here, so they give an empty result.
+func fnConformsTo(c *evalContext, focus Collection, args []expr) (Collection, error) {
+	url, ok, err := c.stringArg(args[0])
+	if err != nil || !ok || len(focus) != 1 {
+		return Collection{}, err
+	}
+	typeName, core := strings.CutPrefix(url, "http://hl7.org/fhir/StructureDefinition/")
+	if !core || !(IsResourceType(typeName) || dataTypes[typeName]) {
+		return Collection{}, nil
+	}
+	actual, system := nodeType(focus[0])
+	return boolean(!system && IsSubtypeOf(actual, typeName)), nil
+}
+
+// fnUnknown implements functions whose result cannot be determined locally.
+func fnUnknown(_ *evalContext, _ Collection, _ []expr) (Collection, error) {
+	return Collection{}, nil
+}
+
+func fnHtmlChecks(_ *evalContext, _ Collection, _ []expr) (Collection, error) {
+	return boolean(true), nil
+}
+
+func fnIdentity(_ *evalContext, focus Collection, _ []expr) (Collection, error) {
+	return focus, nil
+}
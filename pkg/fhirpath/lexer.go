@@ -0,0 +1,219 @@
+package fhirpath
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenString
+	tokenNumber
+	tokenDate
+	tokenDateTime
+	tokenTime
+	tokenExternal
+	tokenSymbol
+)
+
+type token struct {
+	kind      tokenKind
+	text      string
+	pos       int
+	delimited bool // identifier written with backticks
+}
+
+var (
+	dateTimeLiteral = regexp.MustCompile(`^@\d{4}(-\d{2}(-\d{2})?)?(T(\d{2}(:\d{2}(:\d{2}(\.\d+)?)?)?)?(Z|[+-]\d{2}:\d{2})?)?`)
+	timeLiteral     = regexp.MustCompile(`^@T\d{2}(:\d{2}(:\d{2}(\.\d+)?)?)?`)
+)
+
+// symbols lists the punctuation and symbolic operators, longest first.
+var symbols = []string{"<=", ">=", "!=", "!~", "(", ")", "[", "]", "{", "}", ".", ",", "+", "-", "*", "/", "&", "|", "=", "~", "<", ">"}
+
+// tokenize splits a FHIRPath expression into tokens.
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case strings.HasPrefix(src[i:], "//"):
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end
+			}
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at %d", i)
+			}
+			i += end + 4
+			continue
+		}
+
+		start := i
+		switch {
+		case c == '\'' || c == '`':
+			text, next, err := readQuoted(src, i, c)
+			if err != nil {
+				return nil, err
+			}
+			kind := tokenString
+			if c == '`' {
+				kind = tokenIdentifier
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: start, delimited: c == '`'})
+			i = next
+
+		case c == '@':
+			if m := timeLiteral.FindString(src[i:]); m != "" {
+				tokens = append(tokens, token{kind: tokenTime, text: m[2:], pos: start})
+				i += len(m)
+			} else if m := dateTimeLiteral.FindString(src[i:]); m != "" {
+				kind := tokenDate
+				if strings.Contains(m, "T") {
+					kind = tokenDateTime
+				}
+				tokens = append(tokens, token{kind: kind, text: strings.TrimSuffix(m[1:], "T"), pos: start})
+				i += len(m)
+			} else {
+				return nil, fmt.Errorf("invalid date/time literal at %d", i)
+			}
+
+		case c == '%':
+			i++
+			if i < len(src) && (src[i] == '`' || src[i] == '\'') {
+				text, next, err := readQuoted(src, i, src[i])
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, token{kind: tokenExternal, text: text, pos: start})
+				i = next
+			} else {
+				j := i
+				for j < len(src) && isIdentifierChar(rune(src[j])) {
+					j++
+				}
+				if j == i {
+					return nil, fmt.Errorf("invalid external constant at %d", start)
+				}
+				tokens = append(tokens, token{kind: tokenExternal, text: src[i:j], pos: start})
+				i = j
+			}
+
+		case c == '$':
+			j := i + 1
+			for j < len(src) && isIdentifierChar(rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, text: src[i:j], pos: start})
+			i = j
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			if j+1 < len(src) && src[j] == '.' && src[j+1] >= '0' && src[j+1] <= '9' {
+				j++
+				for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+					j++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[i:j], pos: start})
+			i = j
+			if i < len(src) && src[i] == 'L' {
+				i++ // long literal suffix
+			}
+
+		case isIdentifierStart(rune(c)):
+			j := i
+			for j < len(src) && isIdentifierChar(rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, text: src[i:j], pos: start})
+			i = j
+
+		default:
+			matched := false
+			for _, s := range symbols {
+				if strings.HasPrefix(src[i:], s) {
+					tokens = append(tokens, token{kind: tokenSymbol, text: s, pos: start})
+					i += len(s)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(src)})
+	return tokens, nil
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentifierChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// readQuoted reads a string or delimited identifier starting at src[i] and returns its
+// unescaped content and the index after the closing quote.
+func readQuoted(src string, i int, quote byte) (string, int, error) {
+	var sb strings.Builder
+	j := i + 1
+	for j < len(src) {
+		c := src[j]
+		if c == quote {
+			return sb.String(), j + 1, nil
+		}
+		if c == '\\' && j+1 < len(src) {
+			j++
+			switch src[j] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'u':
+				if j+4 >= len(src) {
+					return "", 0, fmt.Errorf("invalid unicode escape at %d", j)
+				}
+				code, err := strconv.ParseUint(src[j+1:j+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid unicode escape at %d", j)
+				}
+				sb.WriteRune(rune(code))
+				j += 4
+			default:
+				sb.WriteByte(src[j])
+			}
+			j++
+			continue
+		}
+		sb.WriteByte(c)
+		j++
+	}
+	return "", 0, fmt.Errorf("unterminated literal starting at %d", i)
+}
@@ -0,0 +1,58 @@
+package fhirpath
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		source string
+		kinds  []tokenKind
+		texts  []string
+	}{
+		{"Patient.name", []tokenKind{tokenIdentifier, tokenSymbol, tokenIdentifier}, []string{"Patient", ".", "name"}},
+		{"`div`.exists()", []tokenKind{tokenIdentifier, tokenSymbol, tokenIdentifier, tokenSymbol, tokenSymbol}, []string{"div", ".", "exists", "(", ")"}},
+		{"'it\\'s' & 'a\\u0062'", []tokenKind{tokenString, tokenSymbol, tokenString}, []string{"it's", "&", "ab"}},
+		{"1.5 + 2", []tokenKind{tokenNumber, tokenSymbol, tokenNumber}, []string{"1.5", "+", "2"}},
+		{"10L", []tokenKind{tokenNumber}, []string{"10"}},
+		{"@2020-01-31", []tokenKind{tokenDate}, []string{"2020-01-31"}},
+		{"@2020-01-31T10:00:00.123+02:00", []tokenKind{tokenDateTime}, []string{"2020-01-31T10:00:00.123+02:00"}},
+		{"@2020T", []tokenKind{tokenDateTime}, []string{"2020"}},
+		{"@T14:30", []tokenKind{tokenTime}, []string{"14:30"}},
+		{"%resource | %`vs-name`", []tokenKind{tokenExternal, tokenSymbol, tokenExternal}, []string{"resource", "|", "vs-name"}},
+		{"$this != $index", []tokenKind{tokenIdentifier, tokenSymbol, tokenIdentifier}, []string{"$this", "!=", "$index"}},
+		{"a <= b >= c !~ d", []tokenKind{tokenIdentifier, tokenSymbol, tokenIdentifier, tokenSymbol, tokenIdentifier, tokenSymbol, tokenIdentifier}, []string{"a", "<=", "b", ">=", "c", "!~", "d"}},
+		{"a // comment\n/* block */ b", []tokenKind{tokenIdentifier, tokenIdentifier}, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			tokens, err := tokenize(tt.source)
+			if err != nil {
+				t.Fatalf("tokenize: %v", err)
+			}
+			if last := tokens[len(tokens)-1]; last.kind != tokenEOF {
+				t.Fatalf("last token is %v, want EOF", last)
+			}
+
+			var kinds []tokenKind
+			var texts []string
+			for _, tok := range tokens[:len(tokens)-1] {
+				kinds = append(kinds, tok.kind)
+				texts = append(texts, tok.text)
+			}
+			if !reflect.DeepEqual(kinds, tt.kinds) || !reflect.DeepEqual(texts, tt.texts) {
+				t.Errorf("got %v %q, want %v %q", kinds, texts, tt.kinds, tt.texts)
+			}
+		})
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	for _, source := range []string{"'unterminated", "/* open", "a # b", "@x", "% "} {
+		if _, err := tokenize(source); err == nil {
+			t.Errorf("tokenize(%q) succeeded, want an error", source)
+		}
+	}
+}
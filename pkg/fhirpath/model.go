@@ -0,0 +1,156 @@
+package fhirpath
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ElementInfo describes an element definition as needed for navigation.
+type ElementInfo struct {
+	// Types lists the type codes allowed for the element (e.g. ["HumanName"]).
+	Types []string
+	// Choice reports whether the element is a choice element (value[x]).
+	Choice bool
+	// ContentReference is the path of the element whose definition is reused
+	// (e.g. "Questionnaire.item"), without the leading '#'.
+	ContentReference string
+}
+
+// Model supplies element type information, usually backed by the loaded
+// StructureDefinitions. Paths are element definition paths such as
+// "Patient.contact.name"; choice elements are looked up without the [x] suffix.
+type Model interface {
+	ElementInfo(path string) (ElementInfo, bool)
+}
+
+// R4 primitive data types.
+var primitiveTypes = []string{
+	"base64Binary", "boolean", "canonical", "code", "date", "dateTime", "decimal", "id",
+	"instant", "integer", "markdown", "oid", "positiveInt", "string", "time",
+	"unsignedInt", "uri", "url", "uuid", "xhtml",
+}
+
+// R4 complex data types.
+var complexTypes = []string{
+	"Address", "Age", "Annotation", "Attachment", "BackboneElement", "CodeableConcept",
+	"Coding", "ContactDetail", "ContactPoint", "Contributor", "Count", "DataRequirement",
+	"Distance", "Dosage", "Duration", "Element", "ElementDefinition", "Expression",
+	"Extension", "HumanName", "Identifier", "MarketingStatus", "Meta", "Money",
+	"MoneyQuantity", "Narrative", "ParameterDefinition", "Period", "Population",
+	"ProdCharacteristic", "ProductShelfLife", "Quantity", "Range", "Ratio", "Reference",
+	"RelatedArtifact", "SampledData", "Signature", "SimpleQuantity", "SubstanceAmount",
+	"Timing", "TriggerDefinition", "UsageContext",
+}
+
+// parentTypes holds the R4 type hierarchy for data types and abstract resources.
+// Concrete resources not listed here derive from DomainResource.
+var parentTypes = map[string]string{
+	"Element":            "Base",
+	"BackboneElement":    "Element",
+	"Resource":           "Base",
+	"DomainResource":     "Resource",
+	"Bundle":             "Resource",
+	"Binary":             "Resource",
+	"Parameters":         "Resource",
+	"code":               "string",
+	"id":                 "string",
+	"markdown":           "string",
+	"url":                "uri",
+	"canonical":          "uri",
+	"oid":                "uri",
+	"uuid":               "uri",
+	"positiveInt":        "integer",
+	"unsignedInt":        "integer",
+	"Age":                "Quantity",
+	"Count":              "Quantity",
+	"Distance":           "Quantity",
+	"Duration":           "Quantity",
+	"MoneyQuantity":      "Quantity",
+	"SimpleQuantity":     "Quantity",
+	"Dosage":             "BackboneElement",
+	"ElementDefinition":  "BackboneElement",
+	"MarketingStatus":    "BackboneElement",
+	"Population":         "BackboneElement",
+	"ProdCharacteristic": "BackboneElement",
+	"ProductShelfLife":   "BackboneElement",
+	"SubstanceAmount":    "BackboneElement",
+	"Timing":             "BackboneElement",
+}
+
+// typeBySuffix maps the capitalised suffix used in choice element names
+// (e.g. "DateTime" in "onsetDateTime") to the type code.
+var typeBySuffix = map[string]string{}
+
+var dataTypes = map[string]bool{}
+
+func init() {
+	for _, t := range primitiveTypes {
+		typeBySuffix[UpperFirst(t)] = t
+		dataTypes[t] = true
+		if _, ok := parentTypes[t]; !ok {
+			parentTypes[t] = "Element"
+		}
+	}
+	for _, t := range complexTypes {
+		typeBySuffix[t] = t
+		dataTypes[t] = true
+		if _, ok := parentTypes[t]; !ok {
+			parentTypes[t] = "Element"
+		}
+	}
+}
+
+// IsPrimitiveType reports whether typeCode is a FHIR primitive data type.
+func IsPrimitiveType(typeCode string) bool {
+	if typeCode == "" {
+		return false
+	}
+	return typeBySuffix[UpperFirst(typeCode)] == typeCode && unicode.IsLower(rune(typeCode[0]))
+}
+
+// ChoiceTypeSuffix returns the type code named by the suffix of a choice element
+// key, e.g. ("onset", "onsetDateTime") -> "dateTime".
+func ChoiceTypeSuffix(name, key string) (string, bool) {
+	if !strings.HasPrefix(key, name) || len(key) == len(name) {
+		return "", false
+	}
+	t, ok := typeBySuffix[key[len(name):]]
+	return t, ok
+}
+
+// BaseType returns the parent of typeName in the R4 type hierarchy.
+func BaseType(typeName string) string {
+	if parent, ok := parentTypes[typeName]; ok {
+		return parent
+	}
+	if typeName == "" || typeName == "Base" || strings.HasPrefix(typeName, "System.") {
+		return ""
+	}
+	if unicode.IsUpper(rune(typeName[0])) {
+		return "DomainResource"
+	}
+	return ""
+}
+
+// IsSubtypeOf reports whether typeName is base or derives from it.
+func IsSubtypeOf(typeName, base string) bool {
+	for t := typeName; t != ""; t = BaseType(t) {
+		if t == base {
+			return true
+		}
+	}
+	return false
+}
+
+// IsResourceType reports whether typeName is a resource type.
+func IsResourceType(typeName string) bool {
+	return typeName != "Resource" && IsSubtypeOf(typeName, "Resource") && !dataTypes[typeName]
+}
+
+// UpperFirst returns s with its first letter in upper case, e.g. dateTime -> DateTime.
+func UpperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
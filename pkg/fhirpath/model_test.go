@@ -0,0 +1,78 @@
+package fhirpath
+
+import "testing"
+
+func TestIsPrimitiveType(t *testing.T) {
+	tests := map[string]bool{
+		"":                false,
+		"string":          true,
+		"dateTime":        true,
+		"base64Binary":    true,
+		"DateTime":        false,
+		"HumanName":       false,
+		"BackboneElement": false,
+		"Patient":         false,
+		"unknown":         false,
+	}
+	for typeCode, want := range tests {
+		if got := IsPrimitiveType(typeCode); got != want {
+			t.Errorf("IsPrimitiveType(%q) = %v, want %v", typeCode, got, want)
+		}
+	}
+}
+
+func TestChoiceTypeSuffix(t *testing.T) {
+	tests := []struct {
+		name, key, want string
+		ok              bool
+	}{
+		{"onset", "onsetDateTime", "dateTime", true},
+		{"value", "valueQuantity", "Quantity", true},
+		{"value", "valueBase64Binary", "base64Binary", true},
+		{"value", "value", "", false},
+		{"value", "valueUnknown", "", false},
+		{"onset", "valueString", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := ChoiceTypeSuffix(tt.name, tt.key)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ChoiceTypeSuffix(%q, %q) = %q, %v, want %q, %v", tt.name, tt.key, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTypeHierarchy(t *testing.T) {
+	tests := []struct {
+		typeName, base string
+		want           bool
+	}{
+		{"Patient", "DomainResource", true},
+		{"Patient", "Resource", true},
+		{"Bundle", "DomainResource", false},
+		{"Age", "Quantity", true},
+		{"code", "string", true},
+		{"HumanName", "Element", true},
+		{"Timing", "BackboneElement", true},
+		{"string", "Quantity", false},
+	}
+	for _, tt := range tests {
+		if got := IsSubtypeOf(tt.typeName, tt.base); got != tt.want {
+			t.Errorf("IsSubtypeOf(%q, %q) = %v, want %v", tt.typeName, tt.base, got, tt.want)
+		}
+	}
+
+	if !IsResourceType("Observation") || IsResourceType("Quantity") || IsResourceType("Resource") {
+		t.Error("IsResourceType does not tell resources from data types")
+	}
+	if got := BaseType(""); got != "" {
+		t.Errorf("BaseType(\"\") = %q, want \"\"", got)
+	}
+}
+
+func TestUpperFirst(t *testing.T) {
+	for s, want := range map[string]string{"": "", "dateTime": "DateTime", "Quantity": "Quantity"} {
+		if got := UpperFirst(s); got != want {
+			t.Errorf("UpperFirst(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
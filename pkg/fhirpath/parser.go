@@ -0,0 +1,372 @@
+package fhirpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expr is a node of the parsed expression tree.
+type expr interface{}
+
+type (
+	literalExpr struct {
+		value Collection
+	}
+	// identifierExpr navigates to a child element of the focus, or selects the
+	// focus when it names its type (e.g. "Patient" at the start of a path).
+	identifierExpr struct {
+		name string
+	}
+	functionExpr struct {
+		name string
+		args []expr
+	}
+	// invocationExpr evaluates member (an identifierExpr or functionExpr) on target.
+	invocationExpr struct {
+		target expr
+		member expr
+	}
+	indexerExpr struct {
+		target expr
+		index  expr
+	}
+	unaryExpr struct {
+		op      string
+		operand expr
+	}
+	binaryExpr struct {
+		op          string
+		left, right expr
+	}
+	typeExpr struct {
+		op       string
+		operand  expr
+		typeName string
+	}
+	externalExpr struct {
+		name string
+	}
+	variableExpr struct {
+		name string // $this, $index or $total
+	}
+)
+
+// binaryPrecedence lists binary operators from lowest to highest precedence.
+var binaryPrecedence = [][]string{
+	{"implies"},
+	{"or", "xor"},
+	{"and"},
+	{"in", "contains"},
+	{"=", "~", "!=", "!~"},
+	{"<=", "<", ">", ">="},
+	{"|"},
+	{"is", "as"},
+	{"+", "-", "&"},
+	{"*", "/", "div", "mod"},
+}
+
+var calendarKeywords = map[string]bool{
+	"year": true, "years": true, "month": true, "months": true, "week": true, "weeks": true,
+	"day": true, "days": true, "hour": true, "hours": true, "minute": true, "minutes": true,
+	"second": true, "seconds": true, "millisecond": true, "milliseconds": true,
+}
+
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+}
+
+func parse(src string) (expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: src, tokens: tokens}
+	e, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekAt(offset int) token {
+	if p.pos+offset < len(p.tokens) {
+		return p.tokens[p.pos+offset]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("fhirpath: %s at position %d in %q", fmt.Sprintf(format, args...), tok.pos, p.src)
+}
+
+func (p *parser) expect(symbol string) error {
+	tok := p.next()
+	if tok.kind != tokenSymbol || tok.text != symbol {
+		return p.errorf(tok, "expected %q, found %q", symbol, tok.text)
+	}
+	return nil
+}
+
+// binaryOperator returns the operator at the current position if it belongs to level.
+func (p *parser) binaryOperator(level int) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokenSymbol && (tok.kind != tokenIdentifier || tok.delimited) {
+		return "", false
+	}
+	for _, op := range binaryPrecedence[level] {
+		if tok.text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseExpression(level int) (expr, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseExpression(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.binaryOperator(level)
+		if !ok {
+			return left, nil
+		}
+		p.next()
+
+		if op == "is" || op == "as" {
+			typeName, err := p.parseTypeSpecifier()
+			if err != nil {
+				return nil, err
+			}
+			left = &typeExpr{op: op, operand: left, typeName: typeName}
+			continue
+		}
+
+		if op == "implies" {
+			// implies is right associative
+			right, err := p.parseExpression(level)
+			if err != nil {
+				return nil, err
+			}
+			return &binaryExpr{op: op, left: left, right: right}, nil
+		}
+
+		right, err := p.parseExpression(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseTypeSpecifier() (string, error) {
+	tok := p.next()
+	if tok.kind != tokenIdentifier {
+		return "", p.errorf(tok, "expected type name, found %q", tok.text)
+	}
+	name := tok.text
+	for p.peek().kind == tokenSymbol && p.peek().text == "." && p.peekAt(1).kind == tokenIdentifier {
+		p.next()
+		name += "." + p.next().text
+	}
+	return name, nil
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	tok := p.peek()
+	if tok.kind == tokenSymbol && (tok.text == "+" || tok.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: tok.text, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (expr, error) {
+	e, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		if tok.kind != tokenSymbol {
+			return e, nil
+		}
+		switch tok.text {
+		case ".":
+			p.next()
+			member, err := p.parseInvocation()
+			if err != nil {
+				return nil, err
+			}
+			e = &invocationExpr{target: e, member: member}
+		case "[":
+			p.next()
+			index, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = &indexerExpr{target: e, index: index}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// parseInvocation parses an identifier or function call.
+func (p *parser) parseInvocation() (expr, error) {
+	tok := p.next()
+	if tok.kind != tokenIdentifier {
+		return nil, p.errorf(tok, "expected identifier, found %q", tok.text)
+	}
+	if strings.HasPrefix(tok.text, "$") {
+		return &variableExpr{name: tok.text}, nil
+	}
+	if next := p.peek(); !tok.delimited && next.kind == tokenSymbol && next.text == "(" {
+		p.next()
+		var args []expr
+		if !(p.peek().kind == tokenSymbol && p.peek().text == ")") {
+			for {
+				arg, err := p.parseExpression(0)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if p.peek().kind == tokenSymbol && p.peek().text == "," {
+					p.next()
+					continue
+				}
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &functionExpr{name: tok.text, args: args}, nil
+	}
+	return &identifierExpr{name: tok.text}, nil
+}
+
+func (p *parser) parseTerm() (expr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokenString:
+		p.next()
+		return &literalExpr{value: Collection{{Value: tok.text, Type: "System.String"}}}, nil
+
+	case tokenNumber:
+		p.next()
+		var value interface{}
+		if strings.Contains(tok.text, ".") {
+			f, err := strconv.ParseFloat(tok.text, 64)
+			if err != nil {
+				return nil, p.errorf(tok, "invalid number %q", tok.text)
+			}
+			value = f
+		} else {
+			n, err := strconv.ParseInt(tok.text, 10, 64)
+			if err != nil {
+				return nil, p.errorf(tok, "invalid number %q", tok.text)
+			}
+			value = n
+		}
+
+		// Quantity literal: a number followed by a unit string or calendar keyword.
+		unit := p.peek()
+		if unit.kind == tokenString || (unit.kind == tokenIdentifier && !unit.delimited && calendarKeywords[unit.text]) {
+			p.next()
+			f, _ := toFloat(value)
+			return &literalExpr{value: Collection{{Value: Quantity{Value: f, Unit: unit.text}, Type: "System.Quantity"}}}, nil
+		}
+		return &literalExpr{value: Collection{{Value: value}}}, nil
+
+	case tokenDate:
+		p.next()
+		d, ok := ParseDate(tok.text)
+		if !ok {
+			return nil, p.errorf(tok, "invalid date %q", tok.text)
+		}
+		return &literalExpr{value: Collection{{Value: d}}}, nil
+
+	case tokenDateTime:
+		p.next()
+		d, ok := ParseDateTime(tok.text)
+		if !ok {
+			return nil, p.errorf(tok, "invalid dateTime %q", tok.text)
+		}
+		return &literalExpr{value: Collection{{Value: d}}}, nil
+
+	case tokenTime:
+		p.next()
+		t, ok := ParseTime(tok.text)
+		if !ok {
+			return nil, p.errorf(tok, "invalid time %q", tok.text)
+		}
+		return &literalExpr{value: Collection{{Value: t}}}, nil
+
+	case tokenExternal:
+		p.next()
+		return &externalExpr{name: tok.text}, nil
+
+	case tokenSymbol:
+		switch tok.text {
+		case "(":
+			p.next()
+			e, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		case "{":
+			p.next()
+			if err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			return &literalExpr{value: Collection{}}, nil
+		}
+
+	case tokenIdentifier:
+		if !tok.delimited && (tok.text == "true" || tok.text == "false") {
+			if next := p.peekAt(1); !(next.kind == tokenSymbol && next.text == "(") {
+				p.next()
+				return &literalExpr{value: Collection{{Value: tok.text == "true"}}}, nil
+			}
+		}
+		return p.parseInvocation()
+	}
+
+	return nil, p.errorf(tok, "unexpected %q", tok.text)
+}
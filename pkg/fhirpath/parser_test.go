@@ -0,0 +1,92 @@
+package fhirpath
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// render prints a parsed expression with explicit grouping.
+func render(e expr) string {
+	switch e := e.(type) {
+	case *literalExpr:
+		if len(e.value) == 0 {
+			return "{}"
+		}
+		if s, ok := e.value[0].Value.(string); ok {
+			return fmt.Sprintf("'%s'", s)
+		}
+		s, _ := toStringValue(e.value[0].Value)
+		return s
+	case *identifierExpr:
+		return e.name
+	case *functionExpr:
+		args := make([]string, len(e.args))
+		for i, arg := range e.args {
+			args[i] = render(arg)
+		}
+		return e.name + "(" + strings.Join(args, ", ") + ")"
+	case *invocationExpr:
+		return render(e.target) + "." + render(e.member)
+	case *indexerExpr:
+		return render(e.target) + "[" + render(e.index) + "]"
+	case *unaryExpr:
+		return "(" + e.op + render(e.operand) + ")"
+	case *binaryExpr:
+		return "(" + render(e.left) + " " + e.op + " " + render(e.right) + ")"
+	case *typeExpr:
+		return "(" + render(e.operand) + " " + e.op + " " + e.typeName + ")"
+	case *externalExpr:
+		return "%" + e.name
+	case *variableExpr:
+		return e.name
+	}
+	return fmt.Sprintf("?%T", e)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		source, want string
+	}{
+		{"Patient.name.given", "Patient.name.given"},
+		{"name[0].given.first()", "name[0].given.first()"},
+		{"a or b and c", "(a or (b and c))"},
+		{"a implies b implies c", "(a implies (b implies c))"},
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"a = b or c != d", "((a = b) or (c != d))"},
+		{"a | b | c", "((a | b) | c)"},
+		{"-1 + 2", "((-1) + 2)"},
+		{"value is Quantity", "(value is Quantity)"},
+		{"value as FHIR.Quantity", "(value as FHIR.Quantity)"},
+		{"value.ofType(Quantity).exists()", "value.ofType(Quantity).exists()"},
+		{"telecom.where(system = 'phone' and $this.use = 'home')", "telecom.where(((system = 'phone') and ($this.use = 'home')))"},
+		{"iif(true, 'a', {})", "iif(true, 'a', {})"},
+		{"%resource.id in %rootResource.contained.id", "(%resource.id in %rootResource.contained.id)"},
+		{"@2020-01-31 + 1 month", "(2020-01-31 + 1 'month')"},
+		{"5 'mg' < 1 'g'", "(5 'mg' < 1 'g')"},
+		{"text.`div`.exists()", "text.div.exists()"},
+		{"a contains 'x' xor b", "((a contains 'x') xor b)"},
+		{"10 div 3 mod 2", "((10 div 3) mod 2)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			tree, err := parse(tt.source)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if got := render(tree); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, source := range []string{"", "a.", "a(", "a[0", "(a", "a b", "1 +", "value is 1", "{1}"} {
+		if _, err := parse(source); err == nil {
+			t.Errorf("parse(%q) succeeded, want an error", source)
+		}
+	}
+}
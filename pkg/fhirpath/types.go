@@ -0,0 +1,637 @@
+package fhirpath
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Precision is the precision of a date, dateTime or time value.
+type Precision int
+
+const (
+	PrecisionYear Precision = iota
+	PrecisionMonth
+	PrecisionDay
+	PrecisionHour
+	PrecisionMinute
+	PrecisionSecond
+	PrecisionMillisecond
+)
+
+// temporal holds the shared representation of Date, DateTime and Time values.
+type temporal struct {
+	t         time.Time
+	precision Precision
+	hasZone   bool
+	raw       string
+}
+
+// Date is a System.Date value (YYYY, YYYY-MM or YYYY-MM-DD).
+type Date struct{ temporal }
+
+// DateTime is a System.DateTime value with optional time and timezone.
+type DateTime struct{ temporal }
+
+// Time is a System.Time value (hh, hh:mm, hh:mm:ss[.fff]).
+type Time struct{ temporal }
+
+func (d Date) String() string     { return d.raw }
+func (d DateTime) String() string { return d.raw }
+func (d Time) String() string     { return d.raw }
+
+// Quantity is a System.Quantity value.
+type Quantity struct {
+	Value float64
+	Unit  string
+}
+
+func (q Quantity) String() string {
+	return fmt.Sprintf("%s '%s'", formatDecimal(q.Value), q.Unit)
+}
+
+var (
+	dateRegex     = regexp.MustCompile(`^(\d{4})(-(\d{2})(-(\d{2}))?)?$`)
+	dateTimeRegex = regexp.MustCompile(`^(\d{4})(-(\d{2})(-(\d{2}))?)?(T((\d{2})(:(\d{2})(:(\d{2})(\.(\d+))?)?)?)?(Z|[+-]\d{2}:\d{2})?)?$`)
+	timeRegex     = regexp.MustCompile(`^(\d{2})(:(\d{2})(:(\d{2})(\.(\d+))?)?)?$`)
+)
+
+func atoi(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func parseFraction(s string) int {
+	if s == "" {
+		return 0
+	}
+	for len(s) < 9 {
+		s += "0"
+	}
+	return atoi(s[:9], 0)
+}
+
+// ParseDate parses a FHIR date string.
+func ParseDate(s string) (Date, bool) {
+	m := dateRegex.FindStringSubmatch(s)
+	if m == nil {
+		return Date{}, false
+	}
+	precision := PrecisionYear
+	if m[3] != "" {
+		precision = PrecisionMonth
+	}
+	if m[5] != "" {
+		precision = PrecisionDay
+	}
+	t := time.Date(atoi(m[1], 0), time.Month(atoi(m[3], 1)), atoi(m[5], 1), 0, 0, 0, 0, time.UTC)
+	return Date{temporal{t: t, precision: precision, raw: s}}, true
+}
+
+// ParseDateTime parses a FHIR dateTime or instant string. Partial dates are accepted.
+func ParseDateTime(s string) (DateTime, bool) {
+	m := dateTimeRegex.FindStringSubmatch(s)
+	if m == nil {
+		return DateTime{}, false
+	}
+	precision := PrecisionYear
+	switch {
+	case m[14] != "":
+		precision = PrecisionMillisecond
+	case m[12] != "":
+		precision = PrecisionSecond
+	case m[10] != "":
+		precision = PrecisionMinute
+	case m[8] != "":
+		precision = PrecisionHour
+	case m[5] != "":
+		precision = PrecisionDay
+	case m[3] != "":
+		precision = PrecisionMonth
+	}
+
+	loc := time.UTC
+	hasZone := false
+	if zone := m[15]; zone != "" {
+		hasZone = true
+		if zone != "Z" {
+			sign := 1
+			if zone[0] == '-' {
+				sign = -1
+			}
+			offset := sign * (atoi(zone[1:3], 0)*3600 + atoi(zone[4:6], 0)*60)
+			loc = time.FixedZone(zone, offset)
+		}
+	}
+
+	t := time.Date(atoi(m[1], 0), time.Month(atoi(m[3], 1)), atoi(m[5], 1),
+		atoi(m[8], 0), atoi(m[10], 0), atoi(m[12], 0), parseFraction(m[14]), loc)
+	return DateTime{temporal{t: t, precision: precision, hasZone: hasZone, raw: s}}, true
+}
+
+// ParseTime parses a FHIR time string.
+func ParseTime(s string) (Time, bool) {
+	m := timeRegex.FindStringSubmatch(s)
+	if m == nil {
+		return Time{}, false
+	}
+	precision := PrecisionHour
+	switch {
+	case m[7] != "":
+		precision = PrecisionMillisecond
+	case m[5] != "":
+		precision = PrecisionSecond
+	case m[3] != "":
+		precision = PrecisionMinute
+	}
+	t := time.Date(0, 1, 1, atoi(m[1], 0), atoi(m[3], 0), atoi(m[5], 0), parseFraction(m[7]), time.UTC)
+	return Time{temporal{t: t, precision: precision, raw: s}}, true
+}
+
+// components returns the value of each precision component in UTC (when a zone is present).
+func (t temporal) components() [7]int {
+	v := t.t
+	if t.hasZone {
+		v = v.UTC()
+	}
+	return [7]int{v.Year(), int(v.Month()), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond() / int(time.Millisecond)}
+}
+
+// compareTemporal compares two temporal values. The second result is false when the
+// values are equal on their shared components but differ in precision.
+func compareTemporal(a, b temporal) (int, bool) {
+	ca, cb := a.components(), b.components()
+	// Seconds and milliseconds are considered a single precision for comparison.
+	pa, pb := min(a.precision, PrecisionSecond), min(b.precision, PrecisionSecond)
+	common := min(pa, pb)
+	last := int(common)
+	if common == PrecisionSecond {
+		last = int(PrecisionMillisecond)
+	}
+	for i := 0; i <= last; i++ {
+		if ca[i] != cb[i] {
+			if ca[i] < cb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	if pa != pb {
+		return 0, false
+	}
+	return 0, true
+}
+
+func formatDecimal(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// calendarUnits maps calendar duration keywords and UCUM codes to a canonical unit.
+var calendarUnits = map[string]string{
+	"year": "year", "years": "year", "a": "year",
+	"month": "month", "months": "month", "mo": "month",
+	"week": "week", "weeks": "week", "wk": "week",
+	"day": "day", "days": "day", "d": "day",
+	"hour": "hour", "hours": "hour", "h": "hour",
+	"minute": "minute", "minutes": "minute", "min": "minute",
+	"second": "second", "seconds": "second", "s": "second",
+	"millisecond": "millisecond", "milliseconds": "millisecond", "ms": "millisecond",
+}
+
+// addDuration adds a calendar quantity to a temporal value.
+func addDuration(t temporal, q Quantity, sign int) (temporal, bool) {
+	unit, ok := calendarUnits[q.Unit]
+	if !ok {
+		return t, false
+	}
+	n := int(q.Value) * sign
+	switch unit {
+	case "year":
+		t.t = addMonths(t.t, 12*n)
+	case "month":
+		t.t = addMonths(t.t, n)
+	case "week":
+		t.t = t.t.AddDate(0, 0, 7*n)
+	case "day":
+		t.t = t.t.AddDate(0, 0, n)
+	case "hour":
+		t.t = t.t.Add(time.Duration(n) * time.Hour)
+	case "minute":
+		t.t = t.t.Add(time.Duration(n) * time.Minute)
+	case "second":
+		t.t = t.t.Add(time.Duration(q.Value*float64(sign)*1000) * time.Millisecond)
+	case "millisecond":
+		t.t = t.t.Add(time.Duration(n) * time.Millisecond)
+	}
+	t.raw = formatTemporal(t)
+	return t, true
+}
+
+// addMonths adds n months to t. A day that does not exist in the resulting month is
+// clamped to its last day, so @2020-01-31 + 1 month is @2020-02-29.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).AddDate(0, n, 0)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return time.Date(first.Year(), first.Month(), min(t.Day(), lastDay), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+func formatTemporal(t temporal) string {
+	layouts := []string{"2006", "2006-01", "2006-01-02", "2006-01-02T15", "2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02T15:04:05.000"}
+	s := t.t.Format(layouts[t.precision])
+	if t.hasZone && t.precision >= PrecisionHour {
+		s += t.t.Format("Z07:00")
+	}
+	return s
+}
+
+// systemTypeOf maps FHIR primitive type codes to their FHIRPath System type.
+var systemTypeOf = map[string]string{
+	"boolean":      "Boolean",
+	"string":       "String",
+	"code":         "String",
+	"id":           "String",
+	"markdown":     "String",
+	"uri":          "String",
+	"url":          "String",
+	"canonical":    "String",
+	"oid":          "String",
+	"uuid":         "String",
+	"base64Binary": "String",
+	"xhtml":        "String",
+	"integer":      "Integer",
+	"positiveInt":  "Integer",
+	"unsignedInt":  "Integer",
+	"integer64":    "Integer",
+	"decimal":      "Decimal",
+	"date":         "Date",
+	"dateTime":     "DateTime",
+	"instant":      "DateTime",
+	"time":         "Time",
+}
+
+// toSystem converts a node into its System representation: bool, string, int64, float64,
+// Date, DateTime, Time, Quantity, or the raw JSON value for complex types.
+func toSystem(n Node) interface{} {
+	switch v := n.Value.(type) {
+	case nil, bool, int64, Date, DateTime, Time, Quantity:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		system := systemTypeOf[n.Type]
+		if strings.HasPrefix(n.Type, "System.") {
+			system = strings.TrimPrefix(n.Type, "System.")
+		}
+		switch system {
+		case "Decimal":
+			return v
+		case "Integer":
+			return int64(v)
+		}
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case string:
+		switch n.Type {
+		case "date":
+			if d, ok := ParseDate(v); ok {
+				return d
+			}
+		case "dateTime", "instant":
+			if d, ok := ParseDateTime(v); ok {
+				return d
+			}
+		case "time":
+			if t, ok := ParseTime(v); ok {
+				return t
+			}
+		}
+		return v
+	case map[string]interface{}:
+		if n.Type == "Quantity" || n.Type == "Age" || n.Type == "Duration" || n.Type == "Distance" ||
+			n.Type == "Count" || n.Type == "SimpleQuantity" || n.Type == "MoneyQuantity" {
+			if q, ok := quantityFromMap(v); ok {
+				return q
+			}
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func quantityFromMap(m map[string]interface{}) (Quantity, bool) {
+	value, ok := m["value"].(float64)
+	if !ok {
+		return Quantity{}, false
+	}
+	unit, _ := m["code"].(string)
+	if unit == "" {
+		unit, _ = m["unit"].(string)
+	}
+	return Quantity{Value: value, Unit: unit}, true
+}
+
+// systemTypeName returns the System type name of a converted value.
+func systemTypeName(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "Boolean"
+	case string:
+		return "String"
+	case int64:
+		return "Integer"
+	case float64:
+		return "Decimal"
+	case Date:
+		return "Date"
+	case DateTime:
+		return "DateTime"
+	case Time:
+		return "Time"
+	case Quantity:
+		return "Quantity"
+	}
+	return ""
+}
+
+// toStringValue returns the FHIRPath string representation of a value.
+func toStringValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case bool:
+		return strconv.FormatBool(x), true
+	case int64:
+		return strconv.FormatInt(x, 10), true
+	case float64:
+		return formatDecimal(x), true
+	case Date:
+		return x.raw, true
+	case DateTime:
+		return x.raw, true
+	case Time:
+		return x.raw, true
+	case Quantity:
+		return x.String(), true
+	}
+	return "", false
+}
+
+// valuesEqual implements FHIRPath equality for two converted values. The second
+// result is false when the comparison yields an empty result.
+func valuesEqual(a, b interface{}) (bool, bool) {
+	a, b = coerceStrings(a, b)
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x == y, true
+		case float64:
+			return float64(x) == y, true
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x == float64(y), true
+		case float64:
+			return x == y, true
+		}
+	case Date:
+		switch y := b.(type) {
+		case Date:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c == 0, ok
+		case DateTime:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c == 0, ok
+		}
+		return false, true
+	case DateTime:
+		switch y := b.(type) {
+		case Date:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c == 0, ok
+		case DateTime:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c == 0, ok
+		}
+		return false, true
+	case Time:
+		if y, ok := b.(Time); ok {
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c == 0, ok
+		}
+		return false, true
+	case Quantity:
+		if y, ok := b.(Quantity); ok {
+			c, ok := compareQuantities(x, y)
+			return ok && c == 0, true
+		}
+		return false, true
+	case string:
+		if y, ok := b.(string); ok {
+			return x == y, true
+		}
+		return false, true
+	case bool:
+		if y, ok := b.(bool); ok {
+			return x == y, true
+		}
+		return false, true
+	}
+	return deepEqual(a, b), true
+}
+
+// valuesEquivalent implements FHIRPath equivalence (~) for two converted values.
+func valuesEquivalent(a, b interface{}) bool {
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return ok && normalizeWhitespace(x) == normalizeWhitespace(y)
+	case float64, int64:
+		fa, okA := toFloat(a)
+		fb, okB := toFloat(b)
+		if !okA || !okB {
+			return false
+		}
+		precision := math.Min(float64(decimalPlaces(fa)), float64(decimalPlaces(fb)))
+		factor := math.Pow(10, precision)
+		return math.Round(fa*factor) == math.Round(fb*factor)
+	case Date, DateTime, Time:
+		eq, ok := valuesEqual(a, b)
+		return ok && eq
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if !valuesEquivalent(toSystem(Node{Value: v}), toSystem(Node{Value: y[k]})) {
+				return false
+			}
+		}
+		return true
+	}
+	eq, ok := valuesEqual(a, b)
+	return ok && eq
+}
+
+func normalizeWhitespace(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+func decimalPlaces(f float64) int {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return 0
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// compareValues orders two converted values. The second result is false when the
+// values are not comparable or the comparison yields an empty result.
+func compareValues(a, b interface{}) (int, bool, error) {
+	a, b = coerceStrings(a, b)
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false, fmt.Errorf("cannot compare %s with %s", systemTypeName(a), systemTypeName(b))
+		}
+		return compareFloat(fa, fb), true, nil
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false, fmt.Errorf("cannot compare String with %s", systemTypeName(b))
+		}
+		return strings.Compare(x, y), true, nil
+	case Date:
+		switch y := b.(type) {
+		case Date:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c, ok, nil
+		case DateTime:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c, ok, nil
+		}
+	case DateTime:
+		switch y := b.(type) {
+		case Date:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c, ok, nil
+		case DateTime:
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c, ok, nil
+		}
+	case Time:
+		if y, ok := b.(Time); ok {
+			c, ok := compareTemporal(x.temporal, y.temporal)
+			return c, ok, nil
+		}
+	case Quantity:
+		if y, ok := b.(Quantity); ok {
+			c, ok := compareQuantities(x, y)
+			return c, ok, nil
+		}
+	}
+	return 0, false, fmt.Errorf("cannot compare %s with %s", systemTypeName(a), systemTypeName(b))
+}
+
+// coerceStrings converts an untyped string compared with a date, dateTime or time
+// into a value of the same kind.
+func coerceStrings(a, b interface{}) (interface{}, interface{}) {
+	convert := func(s string, other interface{}) interface{} {
+		switch other.(type) {
+		case Date, DateTime:
+			if d, ok := ParseDate(s); ok {
+				return d
+			}
+			if d, ok := ParseDateTime(s); ok {
+				return d
+			}
+		case Time:
+			if t, ok := ParseTime(s); ok {
+				return t
+			}
+		}
+		return s
+	}
+	if s, ok := a.(string); ok {
+		a = convert(s, b)
+	} else if s, ok := b.(string); ok {
+		b = convert(s, a)
+	}
+	return a, b
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func normalizeUnit(unit string) string {
+	if u, ok := calendarUnits[unit]; ok {
+		return u
+	}
+	return unit
+}
+
+// deepEqual compares two JSON values structurally.
+func deepEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !deepEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !deepEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,97 @@
+package fhirpath
+
+import (
+	"math"
+	"strings"
+)
+
+// ucumUnit is a UCUM unit as a multiple of the base unit of its dimension.
+type ucumUnit struct {
+	dimension string
+	factor    float64
+}
+
+// ucumUnits holds the units that are not a metric prefix on a base unit.
+var ucumUnits = map[string]ucumUnit{
+	"1":       {"1", 1},
+	"%":       {"1", 0.01},
+	"[lb_av]": {"g", 453.59237},
+	"[oz_av]": {"g", 28.349523125},
+	"[in_i]":  {"m", 0.0254},
+	"[ft_i]":  {"m", 0.3048},
+}
+
+// calendarSeconds gives the length of the calendar durations that have a fixed one.
+// Years and months do not, so they only compare with the same unit.
+var calendarSeconds = map[string]float64{
+	"week":        604800,
+	"day":         86400,
+	"hour":        3600,
+	"minute":      60,
+	"second":      1,
+	"millisecond": 0.001,
+}
+
+// metricUnits are the base units that take a metric prefix, e.g. mg or dL.
+var metricUnits = map[string]string{"g": "g", "m": "m", "L": "L", "l": "L", "mol": "mol", "eq": "eq", "U": "U", "s": "s"}
+
+var metricPrefixes = map[string]float64{
+	"G": 1e9, "M": 1e6, "k": 1e3, "h": 1e2, "da": 1e1, "d": 1e-1,
+	"c": 1e-2, "m": 1e-3, "u": 1e-6, "n": 1e-9, "p": 1e-12, "f": 1e-15,
+}
+
+// parseUnit resolves a calendar keyword or a UCUM code, including a ratio of two
+// units such as mg/dL. It reports false for units it does not know.
+func parseUnit(unit string) (ucumUnit, bool) {
+	if calendar, ok := calendarUnits[unit]; ok {
+		seconds, ok := calendarSeconds[calendar]
+		return ucumUnit{"s", seconds}, ok
+	}
+	if numerator, denominator, ok := strings.Cut(unit, "/"); ok {
+		n, okN := parseUnit(numerator)
+		d, okD := parseUnit(denominator)
+		return ucumUnit{n.dimension + "/" + d.dimension, n.factor / d.factor}, okN && okD
+	}
+	if u, ok := ucumUnits[unit]; ok {
+		return u, true
+	}
+	if base, ok := metricUnits[unit]; ok {
+		return ucumUnit{base, 1}, true
+	}
+	for prefix, factor := range metricPrefixes {
+		if rest, ok := strings.CutPrefix(unit, prefix); ok {
+			if base, ok := metricUnits[rest]; ok {
+				return ucumUnit{base, factor}, true
+			}
+		}
+	}
+	return ucumUnit{}, false
+}
+
+// convertQuantity expresses q in unit, e.g. 1 'kg' as 1000 'g'. It reports false when
+// the units measure different things or are not known.
+func convertQuantity(q Quantity, unit string) (Quantity, bool) {
+	if normalizeUnit(q.Unit) == normalizeUnit(unit) {
+		return Quantity{Value: q.Value, Unit: unit}, true
+	}
+	from, okFrom := parseUnit(q.Unit)
+	to, okTo := parseUnit(unit)
+	if !okFrom || !okTo || from.dimension != to.dimension {
+		return Quantity{}, false
+	}
+	return Quantity{Value: q.Value * from.factor / to.factor, Unit: unit}, true
+}
+
+// compareQuantities orders two quantities after converting b to the unit of a. The
+// second result is false when they cannot be compared.
+func compareQuantities(a, b Quantity) (int, bool) {
+	converted, ok := convertQuantity(b, a.Unit)
+	if !ok {
+		return 0, false
+	}
+	// Conversion factors such as 1e-3 are not exact in binary
+	if math.Abs(a.Value-converted.Value) <= 1e-12*math.Max(math.Abs(a.Value), math.Abs(converted.Value)) {
+		return 0, true
+	}
+	return compareFloat(a.Value, converted.Value), true
+}
@@ -0,0 +1,147 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+)
+
+// bindingSeverity is the severity of a code that is not in the ValueSet of a binding
+// of the given strength.
+var bindingSeverity = map[string]string{
+	"required":   "error",
+	"extensible": "warning",
+	"preferred":  "information",
+	"example":    "information",
+}
+
+// validateBinding checks a coded value (code, Coding, CodeableConcept, Quantity or a
+// bound string/uri) against the ValueSet of the element binding.
+func (c *validation) validateBinding(value interface{}, element Element, path string, outcome *OperationOutcome) {
+	binding := element.Binding
+	severity, ok := bindingSeverity[binding.Strength]
+	if !ok || binding.ValueSet == "" || len(element.Type) == 0 {
+		return
+	}
+
+	switch element.Type[0].Code {
+	case "code", "string", "uri":
+		if code, ok := value.(string); ok {
+			c.validateCoding(binding, severity, "", code, path, outcome)
+		}
+
+	case "Coding", "Quantity":
+		coding, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		system, _ := coding["system"].(string)
+		code, _ := coding["code"].(string)
+		if code != "" {
+			c.validateCoding(binding, severity, system, code, path, outcome)
+		}
+
+	case "CodeableConcept":
+		concept, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		c.validateCodeableConcept(binding, severity, concept, path, outcome)
+	}
+}
+
+// validateCoding reports system|code when it is not in the ValueSet of binding.
+func (c *validation) validateCoding(binding *Binding, severity, system, code, path string, outcome *OperationOutcome) {
+	found, err := c.codeInValueSet(binding.ValueSet, system, code)
+	if found {
+		return
+	}
+	if err != nil {
+		c.addBindingUnresolved(binding, err, path, outcome)
+		return
+	}
+
+	addOperationOutcome(outcome, "code-invalid", fmt.Sprintf("The code '%s' at '%s' is not in the value set '%s' (binding strength: %s)", formatCode(system, code), path, binding.ValueSet, binding.Strength), path, "Code not in value set", severity)
+}
+
+// validateCodeableConcept reports the codings of concept when none of them is in the
+// ValueSet of binding. A concept with only text has no code to check.
+func (c *validation) validateCodeableConcept(binding *Binding, severity string, concept map[string]interface{}, path string, outcome *OperationOutcome) {
+	codings, _ := concept["coding"].([]interface{})
+	if len(codings) == 0 {
+		if binding.Strength == "required" {
+			addOperationOutcome(outcome, "code-invalid", fmt.Sprintf("No code provided at '%s', and a code is required from the value set '%s'", path, binding.ValueSet), path, "Code required", "error")
+		}
+		return
+	}
+
+	var invalid []int
+	var unresolved error
+	for i, item := range codings {
+		coding, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		system, _ := coding["system"].(string)
+		code, _ := coding["code"].(string)
+		if code == "" {
+			continue
+		}
+
+		found, err := c.codeInValueSet(binding.ValueSet, system, code)
+		if found {
+			return // one coding from the value set is enough
+		}
+		if err != nil {
+			unresolved = err
+			continue
+		}
+		invalid = append(invalid, i)
+	}
+
+	if unresolved != nil {
+		c.addBindingUnresolved(binding, unresolved, path, outcome)
+		return
+	}
+
+	for _, i := range invalid {
+		coding := codings[i].(map[string]interface{})
+		system, _ := coding["system"].(string)
+		code, _ := coding["code"].(string)
+		codingPath := fmt.Sprintf("%s.coding[%d]", path, i)
+		addOperationOutcome(outcome, "code-invalid", fmt.Sprintf("The code '%s' at '%s' is not in the value set '%s' (binding strength: %s)", formatCode(system, code), codingPath, binding.ValueSet, binding.Strength), codingPath, "Code not in value set", severity)
+	}
+}
+
+// codeInValueSet asks the terminology service whether system|code is in the value set.
+func (c *validation) codeInValueSet(valueSetURL, system, code string) (bool, error) {
+	result, err := c.terminology.ValidateCode(c.ctx, valueSetURL, system, code, "")
+	if err != nil {
+		return false, err
+	}
+	return result.Result, nil
+}
+
+// addBindingUnresolved reports a code that could not be checked. Only required and
+// extensible bindings are worth an issue; an unknown code system or value set gets the
+// severity set with WithUnknownSystemSeverity.
+func (c *validation) addBindingUnresolved(binding *Binding, err error, path string, outcome *OperationOutcome) {
+	if binding.Strength != "required" && binding.Strength != "extensible" {
+		return
+	}
+	if c.done() {
+		return // Validator.Validate reports the partial outcome
+	}
+
+	if errors.Is(err, ErrUnknownSystem) {
+		addOperationOutcome(outcome, "not-found", fmt.Sprintf("The code at '%s' could not be checked against the value set '%s': %s", path, binding.ValueSet, err), path, "Unknown code system or value set", c.unknownSystem)
+		return
+	}
+	addOperationOutcome(outcome, "not-supported", fmt.Sprintf("The code at '%s' could not be checked against the value set '%s': %s", path, binding.ValueSet, err), path, "Value set not available", "warning")
+}
+
+func formatCode(system, code string) string {
+	if system == "" {
+		return code
+	}
+	return system + "#" + code
+}
@@ -0,0 +1,133 @@
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+const (
+	genderValueSet = "http://hl7.org/fhir/ValueSet/administrative-gender"
+	genderSystem   = "http://hl7.org/fhir/administrative-gender"
+)
+
+func TestValidateBinding(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coding := func(system, code string) map[string]interface{} {
+		return map[string]interface{}{"system": system, "code": code}
+	}
+	concept := func(codings ...map[string]interface{}) map[string]interface{} {
+		items := make([]interface{}, len(codings))
+		for i, c := range codings {
+			items[i] = c
+		}
+		return map[string]interface{}{"coding": items}
+	}
+
+	tests := []struct {
+		name     string
+		strength string
+		typeCode string
+		value    interface{}
+		want     string // "severity: diagnostics", or empty for no issue
+	}{
+		{"required code in the value set", "required", "code", "female", ""},
+		{"required code not in the value set", "required", "code", "woman", "error: The code 'woman' at 'Test.value' is not in the value set"},
+		{"extensible code not in the value set", "extensible", "code", "woman", "warning: The code 'woman' at 'Test.value'"},
+		{"preferred code not in the value set", "preferred", "code", "woman", "information: The code 'woman' at 'Test.value'"},
+
+		{"required Coding in the value set", "required", "Coding", coding(genderSystem, "male"), ""},
+		{"required Coding from another system", "required", "Coding", coding("http://example.org/gender", "male"), "error: The code 'http://example.org/gender#male' at 'Test.value' is not in the value set"},
+		{"extensible Coding not in the value set", "extensible", "Coding", coding(genderSystem, "woman"), "warning: The code '" + genderSystem + "#woman'"},
+		{"preferred Coding not in the value set", "preferred", "Coding", coding(genderSystem, "woman"), "information: The code '" + genderSystem + "#woman'"},
+		{"Coding without a code", "required", "Coding", map[string]interface{}{"system": genderSystem}, ""},
+
+		{"required CodeableConcept in the value set", "required", "CodeableConcept", concept(coding(genderSystem, "other")), ""},
+		{"required CodeableConcept with one coding in the value set", "required", "CodeableConcept", concept(coding(genderSystem, "woman"), coding(genderSystem, "female")), ""},
+		{"required CodeableConcept not in the value set", "required", "CodeableConcept", concept(coding(genderSystem, "nonexistent")), "error: The code '" + genderSystem + "#nonexistent' at 'Test.value.coding[0]'"},
+		{"extensible CodeableConcept not in the value set", "extensible", "CodeableConcept", concept(coding(genderSystem, "woman")), "warning: The code '" + genderSystem + "#woman' at 'Test.value.coding[0]'"},
+		{"preferred CodeableConcept not in the value set", "preferred", "CodeableConcept", concept(coding(genderSystem, "woman")), "information: The code '" + genderSystem + "#woman' at 'Test.value.coding[0]'"},
+		{"required CodeableConcept with only text", "required", "CodeableConcept", map[string]interface{}{"text": "female"}, "error: No code provided at 'Test.value'"},
+		{"extensible CodeableConcept with only text", "extensible", "CodeableConcept", map[string]interface{}{"text": "female"}, ""},
+
+		{"example binding is not checked", "example-strength", "code", "woman", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &validation{
+				ctx:           context.Background(),
+				spec:          library,
+				terminology:   LocalTerminologyService{Spec: library},
+				unknownSystem: "warning",
+			}
+			element := Element{
+				Type:    []Type{{Code: tt.typeCode}},
+				Binding: &Binding{Strength: tt.strength, ValueSet: genderValueSet},
+			}
+			outcome := &OperationOutcome{}
+			c.validateBinding(tt.value, element, "Test.value", outcome)
+
+			if tt.want == "" {
+				if len(outcome.Issue) != 0 {
+					t.Fatalf("unexpected issues: %+v", outcome.Issue)
+				}
+				return
+			}
+			if len(outcome.Issue) != 1 {
+				t.Fatalf("got %d issues, want 1: %+v", len(outcome.Issue), outcome.Issue)
+			}
+			if got := outcome.Issue[0].Severity + ": " + outcome.Issue[0].Diagnostics; !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBindingUnknownValueSet(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strength := range []string{"required", "extensible", "preferred"} {
+		c := &validation{
+			ctx:           context.Background(),
+			spec:          library,
+			terminology:   LocalTerminologyService{Spec: library},
+			unknownSystem: "information",
+		}
+		element := Element{
+			Type:    []Type{{Code: "code"}},
+			Binding: &Binding{Strength: strength, ValueSet: "http://example.org/ValueSet/unknown"},
+		}
+		outcome := &OperationOutcome{}
+		c.validateBinding("a", element, "Test.value", outcome)
+
+		// Only required and extensible bindings report a code that cannot be checked.
+		if strength == "preferred" {
+			if len(outcome.Issue) != 0 {
+				t.Errorf("%s: unexpected issues: %+v", strength, outcome.Issue)
+			}
+			continue
+		}
+		if len(outcome.Issue) != 1 || !strings.Contains(outcome.Issue[0].Diagnostics, "could not be checked") {
+			t.Errorf("%s: got %+v, want one unchecked code issue", strength, outcome.Issue)
+		}
+	}
+}
+
+func TestValidateBindingInResource(t *testing.T) {
+	v := newTestValidator(t)
+
+	assertIssues(t, validate(t, v, `{"resourceType": "Patient", "gender": "woman"}`),
+		"error: The code 'woman' at 'Patient.gender' is not in the value set 'http://hl7.org/fhir/ValueSet/administrative-gender|4.0.1' (binding strength: required)",
+	)
+	assertIssues(t, validate(t, v, `{"resourceType": "Patient", "gender": "female"}`))
+}
@@ -0,0 +1,97 @@
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingEngine is a FhirPathEngine that blocks until the context of the request is done.
+type blockingEngine struct {
+	started chan struct{}
+	err     chan error
+}
+
+func newBlockingEngine() *blockingEngine {
+	return &blockingEngine{started: make(chan struct{}), err: make(chan error, 1)}
+}
+
+func (e *blockingEngine) Evaluate(ctx context.Context, _ []*FhirPathPayload) (*FhirPathResponse, error) {
+	close(e.started)
+	<-ctx.Done()
+	e.err <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// validateWithBlockingEngine validates a Patient with an invalid gender while ctx is
+// ended by stop once the engine is evaluating its constraints.
+func validateWithBlockingEngine(t *testing.T, ctx context.Context, stop func()) (*OperationOutcome, error) {
+	t.Helper()
+	engine := newBlockingEngine()
+	v, err := New(WithSpec(newTestValidator(t).spec), WithFHIRPathEngine(engine))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		<-engine.started
+		stop()
+	}()
+
+	outcome, err := v.Validate(ctx, decodeResource(t, `{"resourceType": "Patient", "gender": "unknown-gender"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case engineErr := <-engine.err:
+		return outcome, engineErr
+	case <-time.After(5 * time.Second):
+		t.Fatal("the engine did not see the context end")
+		return nil, nil
+	}
+}
+
+// assertPartialOutcome checks that outcome keeps the issues found before the context
+// ended, and has a fatal issue with code saying why it ended.
+func assertPartialOutcome(t *testing.T, outcome *OperationOutcome, code string) {
+	t.Helper()
+	var partial, ended bool
+	for _, issue := range outcome.Issue {
+		if strings.Contains(issue.Diagnostics, "unknown-gender") {
+			partial = true
+		}
+		if issue.Code == code && issue.Severity == "fatal" {
+			ended = true
+		}
+	}
+	if !partial {
+		t.Errorf("the issues found before the context ended are missing: %+v", outcome.Issue)
+	}
+	if !ended {
+		t.Errorf("no fatal %s issue: %+v", code, outcome.Issue)
+	}
+}
+
+func TestValidateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outcome, engineErr := validateWithBlockingEngine(t, ctx, cancel)
+	if engineErr != context.Canceled {
+		t.Errorf("engine context error = %v, want %v", engineErr, context.Canceled)
+	}
+	assertPartialOutcome(t, outcome, "incomplete")
+}
+
+func TestValidateDeadlineExceeded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outcome, engineErr := validateWithBlockingEngine(t, ctx, func() {})
+	if engineErr != context.DeadlineExceeded {
+		t.Errorf("engine context error = %v, want %v", engineErr, context.DeadlineExceeded)
+	}
+	assertPartialOutcome(t, outcome, "timeout")
+}
@@ -0,0 +1,412 @@
+package v1
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ExpandValueSet expands the ValueSet with the given url, using the spec loaded by
+// LoadData. See (*LibraryData).ExpandValueSet.
+func ExpandValueSet(url, version string) (*ValueSetExpansion, error) {
+	spec, err := GetSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	return spec.ExpandValueSet(url, version)
+}
+
+// ExpandValueSet returns the expansion of the ValueSet with the given url and, when not
+// empty, version. The compose includes whole CodeSystems (with their nested concepts),
+// concept lists, filters (is-a, descendent-of, is-not-a, generalizes, =, in, not-in,
+// regex, exists) and imported ValueSets; excludes are removed afterwards. A ValueSet
+// without compose returns the expansion it was published with. Expansions are cached.
+func (l *LibraryData) ExpandValueSet(url, version string) (*ValueSetExpansion, error) {
+	return l.expandValueSet(url, version, make(map[string]bool))
+}
+
+func (l *LibraryData) expandValueSet(url, version string, visiting map[string]bool) (*ValueSetExpansion, error) {
+	if canonical, canonicalVersion, found := strings.Cut(url, "|"); found {
+		url = canonical
+		if version == "" {
+			version = canonicalVersion
+		}
+	}
+
+	key := url
+	if version != "" {
+		key += "|" + version
+	}
+
+	l.expansionMu.Lock()
+	cached, ok := l.expansions[key]
+	l.expansionMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	valueSet, ok := l.ValueSetByURL(url)
+	if !ok {
+		return nil, fmt.Errorf("%w: value set '%s' is not loaded", ErrUnknownSystem, url)
+	}
+	if version != "" && valueSet.Version != "" && valueSet.Version != version {
+		return nil, fmt.Errorf("value set '%s' version %s is not loaded (found %s)", url, version, valueSet.Version)
+	}
+
+	if len(valueSet.Compose.Include) == 0 && valueSet.Expansion != nil {
+		return valueSet.Expansion, nil
+	}
+
+	if visiting[url] {
+		return nil, fmt.Errorf("value set '%s' imports itself", url)
+	}
+	visiting[url] = true
+	defer delete(visiting, url)
+
+	codes := newCodeSet()
+	for _, include := range valueSet.Compose.Include {
+		included, err := l.includeCodes(include, visiting)
+		if err != nil {
+			return nil, fmt.Errorf("expanding value set '%s': %w", url, err)
+		}
+		codes.add(included...)
+	}
+
+	for _, exclude := range valueSet.Compose.Exclude {
+		excluded, err := l.includeCodes(exclude, visiting)
+		if err != nil {
+			return nil, fmt.Errorf("expanding value set '%s': %w", url, err)
+		}
+		codes.remove(excluded...)
+	}
+
+	expansion := &ValueSetExpansion{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Total:     len(codes.items),
+		Contains:  codes.items,
+	}
+
+	l.expansionMu.Lock()
+	if l.expansions == nil {
+		l.expansions = make(map[string]*ValueSetExpansion)
+	}
+	l.expansions[key] = expansion
+	l.expansionMu.Unlock()
+
+	return expansion, nil
+}
+
+// resetExpansions drops the cached expansions, e.g. after a package replaces a ValueSet
+// or CodeSystem they were computed from.
+func (l *LibraryData) resetExpansions() {
+	l.expansionMu.Lock()
+	l.expansions = nil
+	l.expansionMu.Unlock()
+}
+
+// includeCodes returns the codes selected by an include (or exclude) of a compose: the
+// codes of its system, restricted by its concept list or filters, and intersected with
+// the ValueSets it imports.
+func (l *LibraryData) includeCodes(include Include, visiting map[string]bool) ([]ExpansionContains, error) {
+	var codes []ExpansionContains
+
+	if include.System != "" {
+		var err error
+		codes, err = l.systemCodes(include)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, valueSetURL := range include.ValueSet {
+		imported, err := l.expandValueSet(valueSetURL, "", visiting)
+		if err != nil {
+			return nil, err
+		}
+
+		if include.System == "" && i == 0 {
+			codes = imported.Contains
+			continue
+		}
+		codes = intersectCodes(codes, imported.Contains)
+	}
+
+	return codes, nil
+}
+
+// systemCodes returns the codes of include.system selected by its concepts or filters.
+func (l *LibraryData) systemCodes(include Include) ([]ExpansionContains, error) {
+	codeSystem, loaded := l.CodeSystemByURL(include.System)
+	complete := loaded && (codeSystem.Content == "" || codeSystem.Content == "complete")
+
+	// An explicit concept list needs no CodeSystem; when it is loaded, unknown codes are dropped.
+	if len(include.Concept) > 0 {
+		codes := make([]ExpansionContains, 0, len(include.Concept))
+		for _, concept := range include.Concept {
+			display := concept.Display
+			if complete {
+				defined := lookupConcept(codeSystem, concept.Code)
+				if defined == nil {
+					continue
+				}
+				if display == "" {
+					display = defined.Display
+				}
+			}
+			codes = append(codes, ExpansionContains{System: include.System, Version: include.Version, Code: concept.Code, Display: display})
+		}
+		return codes, nil
+	}
+
+	if !complete {
+		return nil, fmt.Errorf("%w: code system '%s' is not available for expansion", ErrUnknownSystem, include.System)
+	}
+
+	hierarchy := newConceptHierarchy(codeSystem)
+	predicates := make([]func(*Concept) bool, 0, len(include.Filter))
+	for _, filter := range include.Filter {
+		predicate, err := hierarchy.filter(filter)
+		if err != nil {
+			return nil, fmt.Errorf("code system '%s': %w", include.System, err)
+		}
+		predicates = append(predicates, predicate)
+	}
+
+	version := include.Version
+	if version == "" {
+		version = codeSystem.Version
+	}
+
+	codes := make([]ExpansionContains, 0, len(hierarchy.order))
+	for _, code := range hierarchy.order {
+		concept := hierarchy.concepts[code]
+		if allMatch(predicates, concept) {
+			codes = append(codes, ExpansionContains{System: codeSystem.URL, Version: version, Code: concept.Code, Display: concept.Display})
+		}
+	}
+
+	return codes, nil
+}
+
+func allMatch(predicates []func(*Concept) bool, concept *Concept) bool {
+	for _, predicate := range predicates {
+		if !predicate(concept) {
+			return false
+		}
+	}
+	return true
+}
+
+// conceptHierarchy indexes the concepts of a CodeSystem and their subsumption, given by
+// nesting or by the parent and child properties.
+type conceptHierarchy struct {
+	concepts map[string]*Concept
+	children map[string][]string
+	order    []string
+}
+
+func newConceptHierarchy(codeSystem CodeSystem) *conceptHierarchy {
+	h := &conceptHierarchy{
+		concepts: make(map[string]*Concept),
+		children: make(map[string][]string),
+	}
+	h.addConcepts(codeSystem.Concept, "")
+
+	for _, code := range h.order {
+		for _, property := range h.concepts[code].Property {
+			switch property.Code {
+			case "parent":
+				h.children[property.ValueCode] = append(h.children[property.ValueCode], code)
+			case "child":
+				h.children[code] = append(h.children[code], property.ValueCode)
+			}
+		}
+	}
+
+	return h
+}
+
+func (h *conceptHierarchy) addConcepts(concepts []Concept, parent string) {
+	for i := range concepts {
+		concept := &concepts[i]
+		if _, exists := h.concepts[concept.Code]; !exists {
+			h.concepts[concept.Code] = concept
+			h.order = append(h.order, concept.Code)
+		}
+		if parent != "" {
+			h.children[parent] = append(h.children[parent], concept.Code)
+		}
+		h.addConcepts(concept.Concept, concept.Code)
+	}
+}
+
+// descendants returns the codes subsumed by code, without code itself.
+func (h *conceptHierarchy) descendants(code string) map[string]bool {
+	result := make(map[string]bool)
+	pending := append([]string{}, h.children[code]...)
+	for len(pending) > 0 {
+		next := pending[0]
+		pending = pending[1:]
+		if result[next] || next == code {
+			continue
+		}
+		result[next] = true
+		pending = append(pending, h.children[next]...)
+	}
+	return result
+}
+
+// filter returns the predicate of a ValueSet compose filter.
+func (h *conceptHierarchy) filter(filter ConceptFilter) (func(*Concept) bool, error) {
+	if filter.Property == "concept" || filter.Property == "code" {
+		switch filter.Op {
+		case "is-a":
+			descendants := h.descendants(filter.Value)
+			return func(c *Concept) bool { return c.Code == filter.Value || descendants[c.Code] }, nil
+		case "descendent-of":
+			descendants := h.descendants(filter.Value)
+			return func(c *Concept) bool { return descendants[c.Code] }, nil
+		case "is-not-a":
+			descendants := h.descendants(filter.Value)
+			return func(c *Concept) bool { return c.Code != filter.Value && !descendants[c.Code] }, nil
+		case "generalizes":
+			return func(c *Concept) bool { return c.Code == filter.Value || h.descendants(c.Code)[filter.Value] }, nil
+		case "in", "not-in":
+			codes := make(map[string]bool)
+			for _, code := range strings.Split(filter.Value, ",") {
+				codes[strings.TrimSpace(code)] = true
+			}
+			in := filter.Op == "in"
+			return func(c *Concept) bool { return codes[c.Code] == in }, nil
+		}
+	}
+
+	switch filter.Op {
+	case "=":
+		return func(c *Concept) bool {
+			value, ok := conceptPropertyValue(c, filter.Property)
+			return ok && value == filter.Value
+		}, nil
+	case "regex":
+		re, err := regexp.Compile("^(?:" + filter.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex filter '%s': %w", filter.Value, err)
+		}
+		return func(c *Concept) bool {
+			value, ok := conceptPropertyValue(c, filter.Property)
+			return ok && re.MatchString(value)
+		}, nil
+	case "exists":
+		exists := filter.Value == "true"
+		return func(c *Concept) bool {
+			_, ok := conceptPropertyValue(c, filter.Property)
+			return ok == exists
+		}, nil
+	case "in", "not-in":
+		values := make(map[string]bool)
+		for _, value := range strings.Split(filter.Value, ",") {
+			values[strings.TrimSpace(value)] = true
+		}
+		in := filter.Op == "in"
+		return func(c *Concept) bool {
+			value, ok := conceptPropertyValue(c, filter.Property)
+			return ok && values[value] == in
+		}, nil
+	}
+
+	return nil, fmt.Errorf("filter '%s %s %s' is not supported", filter.Property, filter.Op, filter.Value)
+}
+
+// conceptPropertyValue returns the value of the property of c as a string; code and
+// display are properties too.
+func conceptPropertyValue(c *Concept, property string) (string, bool) {
+	switch property {
+	case "code", "concept":
+		return c.Code, true
+	case "display":
+		return c.Display, c.Display != ""
+	}
+
+	for _, p := range c.Property {
+		if p.Code == property {
+			return propertyValue(p)
+		}
+	}
+
+	return "", false
+}
+
+// propertyValue returns the value of a concept property as a string.
+func propertyValue(p ConceptProperty) (string, bool) {
+	switch {
+	case p.ValueCode != "":
+		return p.ValueCode, true
+	case p.ValueString != "":
+		return p.ValueString, true
+	case p.ValueCoding != nil:
+		return p.ValueCoding.Code, true
+	case p.ValueInteger != nil:
+		return fmt.Sprint(*p.ValueInteger), true
+	case p.ValueBoolean != nil:
+		return fmt.Sprint(*p.ValueBoolean), true
+	case p.ValueDateTime != "":
+		return p.ValueDateTime, true
+	}
+	return "", false
+}
+
+// codeSet is an ordered set of expansion codes keyed by system and code.
+type codeSet struct {
+	items []ExpansionContains
+	index map[string]bool
+}
+
+func newCodeSet() *codeSet {
+	return &codeSet{index: make(map[string]bool)}
+}
+
+func (s *codeSet) add(codes ...ExpansionContains) {
+	for _, code := range codes {
+		key := code.System + "|" + code.Code
+		if s.index[key] {
+			continue
+		}
+		s.index[key] = true
+		s.items = append(s.items, code)
+	}
+}
+
+func (s *codeSet) remove(codes ...ExpansionContains) {
+	removed := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		removed[code.System+"|"+code.Code] = true
+	}
+
+	items := s.items[:0:0]
+	for _, code := range s.items {
+		key := code.System + "|" + code.Code
+		if removed[key] {
+			delete(s.index, key)
+			continue
+		}
+		items = append(items, code)
+	}
+	s.items = items
+}
+
+func intersectCodes(codes, other []ExpansionContains) []ExpansionContains {
+	keep := make(map[string]bool, len(other))
+	for _, code := range other {
+		keep[code.System+"|"+code.Code] = true
+	}
+
+	result := make([]ExpansionContains, 0, len(codes))
+	for _, code := range codes {
+		if keep[code.System+"|"+code.Code] {
+			result = append(result, code)
+		}
+	}
+	return result
+}
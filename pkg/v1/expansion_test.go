@@ -0,0 +1,167 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testLibrary returns a library with the given StructureDefinition, ValueSet and
+// CodeSystem resources.
+func testLibrary(t *testing.T, resources ...string) *LibraryData {
+	t.Helper()
+	library := &LibraryData{Config: make(map[string]interface{})}
+	for _, source := range resources {
+		var rawData map[string]interface{}
+		if err := json.Unmarshal([]byte(source), &rawData); err != nil {
+			t.Fatal(err)
+		}
+		if err := library.loadResource(rawData["resourceType"].(string), rawData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return library
+}
+
+// testCodeSystem has the hierarchy animal > mammal > (dog, cat) and animal > bird, the
+// last through the parent property, and a status property.
+const testCodeSystem = `{
+	"resourceType": "CodeSystem",
+	"url": "http://example.org/animals",
+	"version": "1.0.0",
+	"content": "complete",
+	"caseSensitive": true,
+	"concept": [
+		{"code": "animal", "display": "Animal", "concept": [
+			{"code": "mammal", "display": "Mammal", "concept": [
+				{"code": "dog", "display": "Dog", "property": [{"code": "status", "valueCode": "active"}]},
+				{"code": "cat", "display": "Cat", "property": [{"code": "status", "valueCode": "retired"}]}
+			]}
+		]},
+		{"code": "bird", "display": "Bird", "property": [{"code": "parent", "valueCode": "animal"}]}
+	]
+}`
+
+func testValueSet(url, compose string) string {
+	return `{"resourceType": "ValueSet", "url": "` + url + `", "compose": ` + compose + `}`
+}
+
+func expansionCodes(expansion *ValueSetExpansion) []string {
+	codes := make([]string, 0, len(expansion.Contains))
+	for _, contains := range expansion.Contains {
+		codes = append(codes, contains.Code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func TestExpandValueSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		compose string
+		want    []string
+	}{
+		{"whole code system", `{"include": [{"system": "http://example.org/animals"}]}`, []string{"animal", "bird", "cat", "dog", "mammal"}},
+		{"concept list", `{"include": [{"system": "http://example.org/animals", "concept": [{"code": "dog"}, {"code": "unicorn"}]}]}`, []string{"dog"}},
+		{"exclude", `{"include": [{"system": "http://example.org/animals"}], "exclude": [{"system": "http://example.org/animals", "concept": [{"code": "cat"}, {"code": "animal"}]}]}`, []string{"bird", "dog", "mammal"}},
+		{"is-a", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "is-a", "value": "mammal"}]}]}`, []string{"cat", "dog", "mammal"}},
+		{"descendent-of, bird through the parent property", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "descendent-of", "value": "animal"}]}]}`, []string{"bird", "cat", "dog", "mammal"}},
+		{"is-not-a", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "is-not-a", "value": "mammal"}]}]}`, []string{"animal", "bird"}},
+		{"generalizes", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "generalizes", "value": "dog"}]}]}`, []string{"animal", "dog", "mammal"}},
+		{"property equals", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "status", "op": "=", "value": "active"}]}]}`, []string{"dog"}},
+		{"concept in", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "in", "value": "dog, bird"}]}]}`, []string{"bird", "dog"}},
+		{"regex", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "code", "op": "regex", "value": "[cd].*"}]}]}`, []string{"cat", "dog"}},
+		{"exists", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "status", "op": "exists", "value": "true"}]}]}`, []string{"cat", "dog"}},
+		{"filters combined", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "is-a", "value": "mammal"}, {"property": "status", "op": "=", "value": "retired"}]}]}`, []string{"cat"}},
+		{"imported value set", `{"include": [{"valueSet": ["http://example.org/ValueSet/mammals"]}]}`, []string{"cat", "dog", "mammal"}},
+		{"system intersected with an import", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "code", "op": "regex", "value": "[cm].*"}], "valueSet": ["http://example.org/ValueSet/mammals"]}]}`, []string{"cat", "mammal"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			library := testLibrary(t, testCodeSystem,
+				testValueSet("http://example.org/ValueSet/mammals", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "is-a", "value": "mammal"}]}]}`),
+				testValueSet("http://example.org/ValueSet/test", tt.compose),
+			)
+
+			expansion, err := library.ExpandValueSet("http://example.org/ValueSet/test", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := expansionCodes(expansion); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if expansion.Total != len(tt.want) {
+				t.Errorf("total = %d, want %d", expansion.Total, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestExpandValueSetDisplayAndVersion(t *testing.T) {
+	library := testLibrary(t, testCodeSystem, testValueSet("http://example.org/ValueSet/test", `{"include": [{"system": "http://example.org/animals", "concept": [{"code": "dog"}, {"code": "cat", "display": "Kitty"}]}]}`))
+
+	expansion, err := library.ExpandValueSet("http://example.org/ValueSet/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ExpansionContains{
+		{System: "http://example.org/animals", Code: "dog", Display: "Dog"},
+		{System: "http://example.org/animals", Code: "cat", Display: "Kitty"},
+	}
+	if !reflect.DeepEqual(expansion.Contains, want) {
+		t.Errorf("got %+v, want %+v", expansion.Contains, want)
+	}
+
+	whole := testLibrary(t, testCodeSystem, testValueSet("http://example.org/ValueSet/test", `{"include": [{"system": "http://example.org/animals"}]}`))
+	expansion, err = whole.ExpandValueSet("http://example.org/ValueSet/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expansion.Contains[0].Version != "1.0.0" {
+		t.Errorf("version = %q, want the code system version 1.0.0", expansion.Contains[0].Version)
+	}
+}
+
+func TestExpandValueSetErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		compose string
+		unknown bool
+		want    string
+	}{
+		{"unknown code system", `{"include": [{"system": "http://example.org/unknown"}]}`, true, "code system 'http://example.org/unknown' is not available"},
+		{"unknown import", `{"include": [{"valueSet": ["http://example.org/ValueSet/unknown"]}]}`, true, "value set 'http://example.org/ValueSet/unknown' is not loaded"},
+		{"import of itself", `{"include": [{"valueSet": ["http://example.org/ValueSet/test"]}]}`, false, "imports itself"},
+		{"unsupported filter", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "child-of", "value": "animal"}]}]}`, false, "is not supported"},
+		{"invalid regex", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "code", "op": "regex", "value": "("}]}]}`, false, "invalid regex filter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			library := testLibrary(t, testCodeSystem, testValueSet("http://example.org/ValueSet/test", tt.compose))
+
+			_, err := library.ExpandValueSet("http://example.org/ValueSet/test", "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+			if errors.Is(err, ErrUnknownSystem) != tt.unknown {
+				t.Errorf("errors.Is(err, ErrUnknownSystem) = %v, want %v", !tt.unknown, tt.unknown)
+			}
+		})
+	}
+}
+
+func TestExpandValueSetVersion(t *testing.T) {
+	library := testLibrary(t, testCodeSystem, `{"resourceType": "ValueSet", "url": "http://example.org/ValueSet/test", "version": "2.0.0", "compose": {"include": [{"system": "http://example.org/animals"}]}}`)
+
+	if _, err := library.ExpandValueSet("http://example.org/ValueSet/test|2.0.0", ""); err != nil {
+		t.Errorf("versioned canonical: %v", err)
+	}
+	if _, err := library.ExpandValueSet("http://example.org/ValueSet/test", "1.0.0"); err == nil {
+		t.Error("no error expanding a version that is not loaded")
+	}
+}
@@ -0,0 +1,184 @@
+package v1
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
+
+// arrayIndex matches the indexes of an instance path, e.g. [0] in Patient.name[0].
+var arrayIndex = regexp.MustCompile(`\[\d+\]`)
+
+// validateExtension validates an extension against the StructureDefinition named by the
+// profile of its element or by its url. The definition restricts value[x], the nested
+// extensions of a complex extension and the places (context) where it may be used.
+// Extensions whose definition is not loaded are reported with the severity set by
+// WithUnknownExtensionSeverity, or as errors for a modifierExtension, and only checked
+// against the Extension type.
+func (c *validation) validateExtension(rootData map[string]interface{}, extension map[string]interface{}, element Element, fullPath string, rootSpec, spec StructureDefinition, outcome *OperationOutcome) {
+	url, _ := extension["url"].(string)
+
+	definitionURL := url
+	if profile := typeProfile(element); profile != "" {
+		definitionURL = profile
+	}
+
+	definition, found := c.spec.StructureDefinitionByURL(definitionURL)
+	if !found || definition.Type != "Extension" {
+		// Relative urls name the nested extensions of a complex extension
+		if isAbsoluteURL(definitionURL) {
+			severity := c.unknownExtension
+			if isModifierExtension(element) {
+				severity = "error" // the meaning of the resource depends on it
+			}
+			addOperationOutcome(outcome, "extension", fmt.Sprintf("Unknown extension '%s' at '%s'", definitionURL, fullPath), fullPath, "Unknown extension", severity)
+		}
+		c.ValidateComplexType(rootData, extension, "Extension", fullPath, rootSpec, spec, outcome)
+		return
+	}
+
+	definition, err := c.spec.withSnapshot(definition)
+	if err != nil {
+		addOperationOutcome(outcome, "not-supported", fmt.Sprintf("No snapshot for extension '%s': %s", definitionURL, err), fullPath, "No snapshot", "warning")
+		c.ValidateComplexType(rootData, extension, "Extension", fullPath, rootSpec, spec, outcome)
+		return
+	}
+
+	if !extensionContextAllowed(definition, element, fullPath) {
+		addOperationOutcome(outcome, "business-rule", fmt.Sprintf("The extension '%s' is not allowed at '%s'; it may be used at %s", definitionURL, fullPath, formatContexts(definition.Context)), fullPath, "Extension not allowed here", "error")
+	}
+
+	c.Validate(rootData, extension, rootSpec, definition, fullPath, outcome)
+}
+
+// extensionContextAllowed checks the context of an extension definition against the
+// element that holds the extension, e.g. Patient for Patient.extension. The element is
+// known by its definition path (HumanName), its instance path (Patient.name) and the
+// base types of its type (Element). FHIRPath contexts are not evaluated.
+func extensionContextAllowed(definition StructureDefinition, element Element, fullPath string) bool {
+	if len(definition.Context) == 0 {
+		return true
+	}
+
+	hostPath := strings.TrimSuffix(strings.TrimSuffix(element.Path, ".modifierExtension"), ".extension")
+	instancePath := fullPath
+	if i := strings.LastIndex(instancePath, "."); i >= 0 {
+		instancePath = instancePath[:i]
+	}
+	instancePath = strings.ReplaceAll(arrayIndex.ReplaceAllString(instancePath, ""), "._", ".")
+
+	hosts := map[string]bool{hostPath: true, instancePath: true}
+	hostType := hostPath
+	if strings.Contains(hostPath, ".") {
+		hostType = "BackboneElement"
+	}
+	hosts[hostType] = true
+	for t := fhirpath.BaseType(hostType); t != "" && !hosts[t]; t = fhirpath.BaseType(t) {
+		hosts[t] = true
+	}
+
+	for _, context := range definition.Context {
+		switch context.Type {
+		case "element":
+			if hosts[context.Expression] {
+				return true
+			}
+		case "extension":
+			if hostPath == "Extension" {
+				return true
+			}
+		default:
+			return true // fhirpath contexts
+		}
+	}
+	return false
+}
+
+func isModifierExtension(element Element) bool {
+	return strings.HasSuffix(element.Path, ".modifierExtension")
+}
+
+func isAbsoluteURL(url string) bool {
+	return strings.Contains(url, "://") || strings.HasPrefix(url, "urn:")
+}
+
+func formatContexts(contexts []UsageContext) string {
+	expressions := make([]string, 0, len(contexts))
+	for _, context := range contexts {
+		expressions = append(expressions, fmt.Sprintf("'%s'", context.Expression))
+	}
+	return strings.Join(expressions, ", ")
+}
+
+// validatePrimitiveExtension validates the _name property that holds the id and extensions
+// of the primitive element name. For a repeating element both arrays must align, using
+// null where an item has no value or no extensions, but never both. The extensions are
+// validated like any other, with the path of the value they belong to.
+func (c *validation) validatePrimitiveExtension(rootData map[string]interface{}, value, extension interface{}, element Element, parentPath, name string, rootSpec, spec StructureDefinition, outcome *OperationOutcome) {
+	if len(element.Type) == 0 {
+		return
+	}
+	path := joinPath(parentPath, name)
+	extensionPath := joinPath(parentPath, "_"+name)
+
+	if expectedJSONType(element.Type[0].Code) == "object" {
+		if extension != nil {
+			addOperationOutcome(outcome, "structure", fmt.Sprintf("Field '%s' is not allowed: '%s' is a %s, not a primitive", extensionPath, path, element.Type[0].Code), extensionPath, "Primitive extension on a complex type", "error")
+		}
+		return
+	}
+
+	if !IsArrayElement(element) {
+		c.validatePrimitiveElement(rootData, extension, path, extensionPath, rootSpec, spec, outcome)
+		return
+	}
+
+	values, _ := value.([]interface{})
+	extensions, isArray := extension.([]interface{})
+	if extension != nil && !isArray {
+		addOperationOutcome(outcome, "structure", fmt.Sprintf("Field '%s' must be an array aligned with '%s'", extensionPath, path), extensionPath, "Field must be an array", "error")
+		return
+	}
+	if value != nil && extension != nil && len(values) != len(extensions) {
+		addOperationOutcome(outcome, "structure", fmt.Sprintf("Field '%s' has %d items and '%s' has %d; they must align, with null for the missing ones", extensionPath, len(extensions), path, len(values)), extensionPath, "Arrays do not align", "error")
+	}
+
+	for i := 0; i < max(len(values), len(extensions)); i++ {
+		var item, itemExtension interface{}
+		if i < len(values) {
+			item = values[i]
+		}
+		if i < len(extensions) {
+			itemExtension = extensions[i]
+		}
+
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if item == nil && itemExtension == nil {
+			addOperationOutcome(outcome, "invalid", fmt.Sprintf("Item '%s' has neither a value nor an id or extensions in '%s'", itemPath, extensionPath), itemPath, "Item is empty", "error")
+			continue
+		}
+		if itemExtension != nil {
+			c.validatePrimitiveElement(rootData, itemExtension, itemPath, fmt.Sprintf("%s[%d]", extensionPath, i), rootSpec, spec, outcome)
+		}
+	}
+}
+
+// validatePrimitiveElement validates the object with the id and extensions of a primitive
+// value as an Element, which must have one or the other (ele-1).
+func (c *validation) validatePrimitiveElement(rootData map[string]interface{}, extension interface{}, path, extensionPath string, rootSpec, spec StructureDefinition, outcome *OperationOutcome) {
+	object, ok := extension.(map[string]interface{})
+	if !ok {
+		addOperationOutcome(outcome, "structure", fmt.Sprintf("Field '%s' must be a JSON object with the id and extensions of '%s'", extensionPath, path), extensionPath, "Wrong JSON type", "error")
+		return
+	}
+
+	extensions, _ := object["extension"].([]interface{})
+	if object["id"] == nil && len(extensions) == 0 {
+		addOperationOutcome(outcome, "invariant", fmt.Sprintf("Field '%s' must have an id or extensions (ele-1)", extensionPath), extensionPath, "ele-1: All FHIR elements must have a @value or children", "error")
+		return
+	}
+
+	c.ValidateComplexType(rootData, object, "Element", path, rootSpec, spec, outcome)
+}
@@ -0,0 +1,193 @@
+package v1
+
+import "testing"
+
+const birthTimeURL = "http://hl7.org/fhir/StructureDefinition/patient-birthTime"
+
+func TestValidateExtensions(t *testing.T) {
+	v := newTestValidator(t)
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "extension in its context",
+			resource: `{"resourceType": "Patient", "birthDate": "1990-01-01", "_birthDate": {"extension": [{"url": "` + birthTimeURL + `", "valueDateTime": "1990-01-01T10:00:00Z"}]}}`,
+		},
+		{
+			name:     "extension out of its context",
+			resource: `{"resourceType": "Patient", "extension": [{"url": "` + birthTimeURL + `", "valueDateTime": "1990-01-01T10:00:00Z"}]}`,
+			want:     []string{"error: The extension '" + birthTimeURL + "' is not allowed at 'Patient.extension[0]'; it may be used at 'Patient.birthDate'"},
+		},
+		{
+			name:     "value type not allowed",
+			resource: `{"resourceType": "Patient", "birthDate": "1990-01-01", "_birthDate": {"extension": [{"url": "` + birthTimeURL + `", "valueString": "ten"}]}}`,
+			want:     []string{"error: Type 'string' is not allowed for 'Patient.birthDate.extension[0].value[x]': expected one of 'valueDateTime'"},
+		},
+		{
+			name:     "unknown extension",
+			resource: `{"resourceType": "Patient", "extension": [{"url": "http://example.org/unknown", "valueString": "x"}]}`,
+			want:     []string{"warning: Unknown extension 'http://example.org/unknown' at 'Patient.extension[0]'"},
+		},
+		{
+			name:     "unknown modifier extension",
+			resource: `{"resourceType": "Patient", "modifierExtension": [{"url": "http://example.org/unknown", "valueString": "x"}]}`,
+			want:     []string{"error: Unknown extension 'http://example.org/unknown' at 'Patient.modifierExtension[0]'"},
+		},
+		{
+			name:     "extension without url",
+			resource: `{"resourceType": "Patient", "extension": [{"valueString": "x"}]}`,
+			want:     []string{"error: Field 'Patient.extension[0].url' is required"},
+		},
+		{
+			name:     "extension without value or extensions",
+			resource: `{"resourceType": "Patient", "extension": [{"url": "http://example.org/unknown"}]}`,
+			want: []string{
+				"warning: Unknown extension 'http://example.org/unknown' at 'Patient.extension[0]'",
+				"error: Failed constraint 'ext-1'",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validate(t, v, tt.resource), tt.want...)
+		})
+	}
+}
+
+func TestValidateUnknownExtensionSeverity(t *testing.T) {
+	v, err := New(WithUnknownExtensionSeverity("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIssues(t, validate(t, v, `{"resourceType": "Patient", "extension": [{"url": "http://example.org/unknown", "valueString": "x"}]}`),
+		"error: Unknown extension 'http://example.org/unknown' at 'Patient.extension[0]'",
+	)
+
+	if _, err := New(WithUnknownExtensionSeverity("fatal")); err == nil {
+		t.Error("no error for an invalid severity")
+	}
+}
+
+func TestValidateComplexExtension(t *testing.T) {
+	extension := map[string]interface{}{
+		"resourceType":   "StructureDefinition",
+		"id":             "complex",
+		"url":            "http://example.org/StructureDefinition/complex",
+		"name":           "Complex",
+		"kind":           "complex-type",
+		"type":           "Extension",
+		"baseDefinition": "http://hl7.org/fhir/StructureDefinition/Extension",
+		"derivation":     "constraint",
+		"context":        []interface{}{map[string]interface{}{"type": "element", "expression": "Patient"}},
+		"differential": map[string]interface{}{"element": []interface{}{
+			map[string]interface{}{"id": "Extension.extension", "path": "Extension.extension", "slicing": map[string]interface{}{"discriminator": []interface{}{map[string]interface{}{"type": "value", "path": "url"}}, "rules": "closed"}},
+			map[string]interface{}{"id": "Extension.extension:code", "path": "Extension.extension", "sliceName": "code", "min": 1, "max": "1"},
+			map[string]interface{}{"id": "Extension.extension:code.url", "path": "Extension.extension.url", "fixedUri": "code"},
+			map[string]interface{}{"id": "Extension.extension:code.value[x]", "path": "Extension.extension.value[x]", "type": []interface{}{map[string]interface{}{"code": "string"}}},
+			map[string]interface{}{"id": "Extension.url", "path": "Extension.url", "fixedUri": "http://example.org/StructureDefinition/complex"},
+			map[string]interface{}{"id": "Extension.value[x]", "path": "Extension.value[x]", "max": "0"},
+		}},
+	}
+	v := newProfileValidator(t, extension)
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "valid nested extension",
+			resource: `{"resourceType": "Patient", "extension": [{"url": "http://example.org/StructureDefinition/complex", "extension": [{"url": "code", "valueString": "a"}]}]}`,
+		},
+		{
+			name:     "missing nested extension",
+			resource: `{"resourceType": "Patient", "extension": [{"url": "http://example.org/StructureDefinition/complex", "extension": [{"url": "other", "valueString": "a"}]}]}`,
+			want: []string{
+				"error: Item 'Patient.extension[0].extension[0]' does not match any slice of 'Patient.extension[0].extension' (rules: closed)",
+				"error: Slice 'code' of 'Patient.extension[0].extension' has too few items: minimum is 1. Found 0 elements",
+			},
+		},
+		{
+			name:     "value on a complex extension",
+			resource: `{"resourceType": "Patient", "extension": [{"url": "http://example.org/StructureDefinition/complex", "valueString": "a", "extension": [{"url": "code", "valueString": "a"}]}]}`,
+			want: []string{
+				"error: Field 'Patient.extension[0].valueString' is not allowed: maximum is 0",
+				"error: Failed constraint 'ext-1'",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validate(t, v, tt.resource), tt.want...)
+		})
+	}
+}
+
+func TestValidatePrimitiveExtensions(t *testing.T) {
+	v := newTestValidator(t)
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "id of a primitive",
+			resource: `{"resourceType": "Patient", "gender": "female", "_gender": {"id": "g1"}}`,
+		},
+		{
+			name:     "primitive extension without its value",
+			resource: `{"resourceType": "Patient", "_gender": {"extension": [{"url": "http://example.org/unknown", "valueString": "x"}]}}`,
+			want:     []string{"warning: Unknown extension 'http://example.org/unknown' at 'Patient.gender.extension[0]'"},
+		},
+		{
+			name:     "empty primitive extension",
+			resource: `{"resourceType": "Patient", "_gender": {}}`,
+			want:     []string{"error: Field 'Patient._gender' must have an id or extensions (ele-1)"},
+		},
+		{
+			name:     "primitive extension that is not an object",
+			resource: `{"resourceType": "Patient", "_gender": "x"}`,
+			want:     []string{"error: Field 'Patient._gender' must be a JSON object with the id and extensions of 'Patient.gender'"},
+		},
+		{
+			name:     "underscore property of a complex type",
+			resource: `{"resourceType": "Patient", "name": [{"family": "Doe"}], "_name": {"id": "x"}}`,
+			want:     []string{"error: Field 'Patient._name' is not allowed: 'Patient.name' is a HumanName, not a primitive"},
+		},
+		{
+			name:     "aligned arrays with null placeholders",
+			resource: `{"resourceType": "Patient", "name": [{"given": ["A", "B"], "_given": [null, {"id": "b"}]}]}`,
+		},
+		{
+			name:     "extension in place of a missing value",
+			resource: `{"resourceType": "Patient", "name": [{"given": [null, "B"], "_given": [{"id": "a"}, null]}]}`,
+		},
+		{
+			name:     "arrays that do not align",
+			resource: `{"resourceType": "Patient", "name": [{"given": ["A", "B"], "_given": [{"id": "a"}]}]}`,
+			want:     []string{"error: Field 'Patient.name[0]._given' has 1 items and 'Patient.name[0].given' has 2; they must align, with null for the missing ones"},
+		},
+		{
+			name:     "object for an array",
+			resource: `{"resourceType": "Patient", "name": [{"given": ["A"], "_given": {"id": "a"}}]}`,
+			want:     []string{"error: Field 'Patient.name[0]._given' must be an array aligned with 'Patient.name[0].given'"},
+		},
+		{
+			name:     "item with neither a value nor an extension",
+			resource: `{"resourceType": "Patient", "name": [{"given": ["A", null], "_given": [null, null]}]}`,
+			want:     []string{"error: Item 'Patient.name[0].given[1]' has neither a value nor an id or extensions in 'Patient.name[0]._given'"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validate(t, v, tt.resource), tt.want...)
+		})
+	}
+}
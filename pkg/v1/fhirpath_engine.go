@@ -0,0 +1,44 @@
+package v1
+
+import (
+	"context"
+	"sync"
+)
+
+// FhirPathEngine evaluates a batch of constraint payloads. Constraints that cannot be
+// evaluated are reported in the response; the error is for failures of the whole batch,
+// including ctx being done before the evaluation finished.
+type FhirPathEngine interface {
+	Evaluate(ctx context.Context, array []*FhirPathPayload) (*FhirPathResponse, error)
+}
+
+// FhirPathEngineFunc adapts a function such as FhirPathValidatorNative or
+// FhirPathValidatorMultiple to the FhirPathEngine interface.
+type FhirPathEngineFunc func(array []*FhirPathPayload) (*FhirPathResponse, error)
+
+// Evaluate calls f(array), unless ctx is already done.
+func (f FhirPathEngineFunc) Evaluate(ctx context.Context, array []*FhirPathPayload) (*FhirPathResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f(array)
+}
+
+var (
+	engineMu       sync.RWMutex
+	fhirPathEngine FhirPathEngine = FhirPathEngineFunc(FhirPathValidatorNative)
+)
+
+// SetFhirPathEngine replaces the engine used by ValidateResource, e.g. with a
+// FhirPathWorkerPool. The default is the built-in Go engine.
+func SetFhirPathEngine(engine FhirPathEngine) {
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	fhirPathEngine = engine
+}
+
+func getFhirPathEngine() FhirPathEngine {
+	engineMu.RLock()
+	defer engineMu.RUnlock()
+	return fhirPathEngine
+}
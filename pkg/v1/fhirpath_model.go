@@ -0,0 +1,83 @@
+package v1
+
+import (
+	"strings"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
+
+// ElementInfo implements fhirpath.Model using the snapshots of the loaded base
+// StructureDefinitions, so FHIRPath navigation knows the type of every element.
+func (l *LibraryData) ElementInfo(path string) (fhirpath.ElementInfo, bool) {
+	if l == nil {
+		return fhirpath.ElementInfo{}, false
+	}
+
+	l.modelMu.RLock()
+	index := l.elementIndex
+	l.modelMu.RUnlock()
+
+	if index == nil {
+		l.modelMu.Lock()
+		if l.elementIndex == nil {
+			l.elementIndex = l.buildElementIndex()
+		}
+		index = l.elementIndex
+		l.modelMu.Unlock()
+	}
+
+	info, ok := index[path]
+	return info, ok
+}
+
+// resetElementIndex drops the element index, so the next ElementInfo call indexes the
+// definitions added since it was built.
+func (l *LibraryData) resetElementIndex() {
+	l.modelMu.Lock()
+	l.elementIndex = nil
+	l.modelMu.Unlock()
+}
+
+// buildElementIndex indexes the snapshot elements of every base type definition by path.
+func (l *LibraryData) buildElementIndex() map[string]fhirpath.ElementInfo {
+	elementIndex := make(map[string]fhirpath.ElementInfo)
+
+	for _, value := range l.Config {
+		structureDef, ok := value.(StructureDefinition)
+		if !ok || structureDef.Snapshot == nil {
+			continue
+		}
+
+		// Only core type definitions describe the model; profiles constrain it.
+		if structureDef.URL != "http://hl7.org/fhir/StructureDefinition/"+structureDef.Type {
+			continue
+		}
+
+		for i := 0; i < len(structureDef.Snapshot.Element); i++ {
+			element := structureDef.Snapshot.Element[i]
+
+			info := fhirpath.ElementInfo{
+				ContentReference: strings.TrimPrefix(element.ContentReference, "#"),
+			}
+
+			path := element.Path
+			if strings.HasSuffix(path, "[x]") {
+				path = strings.TrimSuffix(path, "[x]")
+				info.Choice = true
+			}
+
+			for j := 0; j < len(element.Type); j++ {
+				code := element.Type[j].Code
+				// System types such as Resource.id carry their FHIR type in an extension.
+				if fhirType := getFhirTypeFromExtensions(element.Type[j : j+1]); fhirType != "" {
+					code = fhirType
+				}
+				info.Types = append(info.Types, code)
+			}
+
+			elementIndex[path] = info
+		}
+	}
+
+	return elementIndex
+}
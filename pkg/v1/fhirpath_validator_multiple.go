@@ -2,13 +2,12 @@ package v1
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"reflect"
 )
 
 type ResponseFhirPathValidatorMultiple struct {
@@ -33,115 +32,190 @@ type TraceData struct {
 	Unmatched []string `json:"unmatched"`
 }
 
-// cleanValues limpia comillas dobles y escapadas en los valores extraídos
-func cleanValues(raw []string) []string {
-	if len(raw) < 2 {
-		return nil
+// ConstraintError reports a constraint whose expression could not be evaluated.
+type ConstraintError struct {
+	Key      string `json:"key"`
+	Path     string `json:"path"`
+	Source   string `json:"source"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// TraceEntry holds the values traced under one label while evaluating one constraint.
+type TraceEntry struct {
+	Label  string        `json:"label"`
+	Key    string        `json:"key"`
+	Path   string        `json:"path"`
+	Values []interface{} `json:"values"`
+}
+
+// FhirPathResponse is the result of evaluating a FhirPathRequest. Results holds one
+// entry per evaluated constraint, Errors the constraints that could not be evaluated.
+type FhirPathResponse struct {
+	Results []ValidationResult `json:"results"`
+	Errors  []ConstraintError  `json:"errors"`
+	Trace   []TraceEntry       `json:"trace"`
+}
+
+// Failed returns the results of the constraints that did not hold.
+func (r *FhirPathResponse) Failed() []ValidationResult {
+	failedResults := make([]ValidationResult, 0)
+	for _, res := range r.Results {
+		if !res.Result {
+			failedResults = append(failedResults, res)
+		}
+	}
+	return failedResults
+}
+
+// TraceData collects the values traced with the "url", "ids" and "unmatched" labels.
+func (r *FhirPathResponse) TraceData() TraceData {
+	trace := TraceData{}
+	for _, entry := range r.Trace {
+		switch entry.Label {
+		case "url":
+			trace.URL = append(trace.URL, traceStrings(entry.Values)...)
+		case "ids":
+			trace.IDs = append(trace.IDs, traceStrings(entry.Values)...)
+		case "unmatched":
+			trace.Unmatched = append(trace.Unmatched, traceStrings(entry.Values)...)
+		}
 	}
+	return trace
+}
 
-	// Remove unnecessary newlines and split by commas
-	rawValues := strings.Split(strings.ReplaceAll(raw[1], "\n", ""), ",")
-	var result []string
-	for _, v := range rawValues {
-		cleaned := strings.TrimSpace(v)
-		cleaned = strings.Trim(cleaned, `"\`)
-		result = append(result, cleaned)
+func traceStrings(values []interface{}) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		} else {
+			result = append(result, fmt.Sprint(v))
+		}
 	}
 	return result
 }
 
-func FhirPathValidatorMultiple(array []*FhirPathPayload) (*[]ValidationResult, *TraceData, error) {
+// FhirPathRequest is the JSON document sent to the Node.js evaluator on stdin. Root
+// resources are sent once and each constraint refers to its root by index; a constraint
+// evaluated on the root itself sends no data.
+type FhirPathRequest struct {
+	Resources   []map[string]interface{} `json:"resources"`
+	Constraints []FhirPathConstraint     `json:"constraints"`
+}
+
+// FhirPathConstraint is a single constraint of a FhirPathRequest. Data is nil when the
+// constraint is evaluated on its root resource, which the evaluator then uses instead.
+type FhirPathConstraint struct {
+	RootIndex            int         `json:"rootIndex"`
+	Data                 interface{} `json:"data,omitempty"`
+	ConstraintExpression string      `json:"constraintExpression"`
+	ConstraintKey        string      `json:"constraintKey"`
+	ConstraintHuman      string      `json:"constraintHuman"`
+	ConstraintSeverity   string      `json:"constraintSeverity"`
+	ConstraintSource     string      `json:"constraintSource"`
+	ParentPath           string      `json:"parentPath"`
+	DataType             string      `json:"dataType,omitempty"`
+}
 
-	// Convert the FHIR resource to JSON
-	resourceJSON, err := json.Marshal(array)
-	if err != nil {
-		log.Fatalf("Error converting resource to JSON: %v", err)
-		return nil, nil, err
+// NewFhirPathRequest builds the request for a payload, sending each distinct root resource once.
+func NewFhirPathRequest(array []*FhirPathPayload) *FhirPathRequest {
+	request := &FhirPathRequest{
+		Resources:   make([]map[string]interface{}, 0, 1),
+		Constraints: make([]FhirPathConstraint, 0, len(array)),
 	}
 
-	path := filepath.Join("node/dist", "fhirpath-evaluate.js")
+	// Root resources are shared maps, so identify them by address.
+	rootIndexes := make(map[uintptr]int)
 
-	// Step 3: Execute the Node.js script
-	cmd := exec.Command("node", path, string(resourceJSON))
+	for _, item := range array {
+		key := reflect.ValueOf(item.RootData).Pointer()
+		index, ok := rootIndexes[key]
+		if !ok {
+			index = len(request.Resources)
+			rootIndexes[key] = index
+			request.Resources = append(request.Resources, item.RootData)
+		}
 
-	// Capture output
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+		// An interface holding an empty map is still sent, so only the root is left out
+		var data interface{} = item.Data
+		if reflect.ValueOf(item.Data).Pointer() == key {
+			data = nil
+		}
 
-	err = cmd.Run()
-	if err != nil {
-		fmt.Printf("Node.js error: %s\n", stderr.String())
-		return nil, nil, fmt.Errorf("execution error: %w", err)
+		request.Constraints = append(request.Constraints, FhirPathConstraint{
+			RootIndex:            index,
+			Data:                 data,
+			ConstraintExpression: item.ConstraintExpression,
+			ConstraintKey:        item.ConstraintKey,
+			ConstraintHuman:      item.ConstraintHuman,
+			ConstraintSeverity:   item.ConstraintSeverity,
+			ConstraintSource:     item.ConstraintSource,
+			ParentPath:           item.ParentPath,
+			DataType:             item.DataType,
+		})
 	}
 
-	// Debug: Print raw output
-	rawOutput := out.String()
-
-	fmt.Printf("Raw Output: %s\n", rawOutput)
+	return request
+}
 
-	// Regex to extract the JSON array inside "Result:"
-	re := regexp.MustCompile(`Result:\s*(\[[\s\S]*\])`)
-	matches := re.FindStringSubmatch(rawOutput)
+// NodeFhirPathEngine evaluates constraints by running the Node.js fhirpath-evaluate.js
+// script once per batch.
+type NodeFhirPathEngine struct {
+	// NodePath is the Node.js executable. Defaults to "node".
+	NodePath string
+	// ScriptPath is the compiled evaluation script. Defaults to node/dist/fhirpath-evaluate.js.
+	ScriptPath string
+}
 
-	if len(matches) < 2 {
-		fmt.Println("No 'Result' array found in input.")
-		return nil, nil, fmt.Errorf("no 'Result' array found in input")
-	}
+// FhirPathValidatorMultiple evaluates the payload with a NodeFhirPathEngine using the default paths.
+func FhirPathValidatorMultiple(array []*FhirPathPayload) (*FhirPathResponse, error) {
+	return NodeFhirPathEngine{}.Evaluate(context.Background(), array)
+}
 
-	resultJSON := matches[1]
+// Evaluate implements FhirPathEngine. The Node.js process is killed when ctx is done.
+func (e NodeFhirPathEngine) Evaluate(ctx context.Context, array []*FhirPathPayload) (*FhirPathResponse, error) {
 
-	// Parse JSON into a slice of ValidationResult
-	var results []ValidationResult
-	err = json.Unmarshal([]byte(resultJSON), &results)
+	// Convert the FHIR resource to JSON
+	requestJSON, err := json.Marshal(NewFhirPathRequest(array))
 	if err != nil {
-		fmt.Println("Error parsing JSON:", err)
-		return nil, nil, fmt.Errorf("error parsing JSON: %w", err)
+		return nil, fmt.Errorf("error encoding fhirpath request: %w", err)
 	}
 
-	// Filter only results where "result" is false
-	var failedResults []ValidationResult
-	for _, res := range results {
-		if !res.Result {
-			failedResults = append(failedResults, res)
-		}
+	nodePath := e.NodePath
+	if nodePath == "" {
+		nodePath = "node"
 	}
 
-	// Print filtered results
-	fmt.Println("Extracted Failed Results:")
-	for _, res := range failedResults {
-		fmt.Printf("- Key: %s, Path: %s, Human: %s\n", res.Key, res.Path, res.Human)
+	path := e.ScriptPath
+	if path == "" {
+		path = filepath.Join("node/dist", "fhirpath-evaluate.js")
 	}
 
-	trace := TraceData{}
-	// Regex mejorada para capturar listas de valores correctamente
-	tracePatterns := map[string]*regexp.Regexp{
-		"url":       regexp.MustCompile(`(?m)TRACE:\[url\]\s*\[\s*([\s\S]*?)\s*\]`),
-		"ids":       regexp.MustCompile(`(?m)TRACE:\[ids\]\s*\[\s*([\s\S]*?)\s*\]`),
-		"unmatched": regexp.MustCompile(`(?m)TRACE:\[unmatched\]\s*\[\s*([\s\S]*?)\s*\]`),
+	// Step 3: Execute the Node.js script, streaming the request over stdin so large
+	// resources do not hit the command-line length limit.
+	cmd := exec.CommandContext(ctx, nodePath, path)
+	cmd.Stdin = bytes.NewReader(requestJSON)
+
+	// Capture output
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execution error: %w: %s", err, stderr.String())
 	}
 
-	// Extraer datos usando las expresiones regulares
-	for key, pattern := range tracePatterns {
-		traceMatches := pattern.FindStringSubmatch(rawOutput)
-		if len(traceMatches) > 1 {
-			// Intentar parsear como JSON array (corrige comillas escapadas)
-			var values []string
-			values = cleanValues(traceMatches)
-			if err == nil {
-				// Asignar valores al struct solo si se parsea bien
-				switch key {
-				case "url":
-					trace.URL = values
-				case "ids":
-					trace.IDs = values
-				case "unmatched":
-					trace.Unmatched = values
-				}
-			}
-		}
+	// stdout carries only the JSON envelope; any logging of the script goes to stderr.
+	var response FhirPathResponse
+	if err := json.Unmarshal(out.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("error parsing fhirpath response: %w", err)
 	}
 
-	return &failedResults, &trace, nil
+	return &response, nil
 }
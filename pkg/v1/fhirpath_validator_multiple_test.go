@@ -0,0 +1,66 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewFhirPathRequest(t *testing.T) {
+	patient := map[string]interface{}{"resourceType": "Patient", "id": "p1", "name": []interface{}{map[string]interface{}{"family": "Chalmers"}}}
+	name := patient["name"].([]interface{})[0].(map[string]interface{})
+	empty := map[string]interface{}{}
+	other := map[string]interface{}{"resourceType": "Patient", "id": "p2"}
+
+	request := NewFhirPathRequest([]*FhirPathPayload{
+		{RootData: patient, Data: patient, ConstraintKey: "dom-2"},
+		{RootData: patient, Data: patient, ConstraintKey: "dom-6"},
+		{RootData: patient, Data: name, ConstraintKey: "ele-1", ParentPath: "Patient.name[0]", DataType: "HumanName"},
+		{RootData: patient, Data: empty, ConstraintKey: "ele-1", ParentPath: "Patient.contact[0]"},
+		{RootData: other, Data: other, ConstraintKey: "dom-2"},
+	})
+
+	if len(request.Resources) != 2 {
+		t.Fatalf("sent %d resources, want 2", len(request.Resources))
+	}
+	wantRoots := []int{0, 0, 0, 0, 1}
+	for i, constraint := range request.Constraints {
+		if constraint.RootIndex != wantRoots[i] {
+			t.Errorf("constraint %d has root %d, want %d", i, constraint.RootIndex, wantRoots[i])
+		}
+	}
+
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Resources   []map[string]interface{} `json:"resources"`
+		Constraints []map[string]interface{} `json:"constraints"`
+	}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// The root resource is sent once, not again as the data of its constraints
+	if got := strings.Count(string(encoded), `"id":"p1"`); got != 1 {
+		t.Errorf("the root resource is encoded %d times, want once", got)
+	}
+	for i, wantData := range []bool{false, false, true, true, false} {
+		if _, hasData := decoded.Constraints[i]["data"]; hasData != wantData {
+			t.Errorf("constraint %d sends data: %v, want %v", i, hasData, wantData)
+		}
+	}
+	if got := decoded.Constraints[2]["dataType"]; got != "HumanName" {
+		t.Errorf("dataType = %v, want HumanName", got)
+	}
+}
+
+func TestNodeFhirPathEngineEncodingError(t *testing.T) {
+	root := map[string]interface{}{"resourceType": "Patient", "bad": func() {}}
+	_, err := NodeFhirPathEngine{NodePath: "false"}.Evaluate(context.Background(), []*FhirPathPayload{{RootData: root, Data: root}})
+	if err == nil || !strings.Contains(err.Error(), "encoding") {
+		t.Fatalf("Evaluate = %v, want an encoding error", err)
+	}
+}
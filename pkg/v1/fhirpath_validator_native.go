@@ -0,0 +1,106 @@
+package v1
+
+import (
+	"context"
+	"sync"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
+
+// compiledExpressions caches parsed constraint expressions by their source.
+var compiledExpressions sync.Map
+
+func compileFhirPath(expression string) (*fhirpath.Expression, error) {
+	if cached, ok := compiledExpressions.Load(expression); ok {
+		return cached.(*fhirpath.Expression), nil
+	}
+
+	compiled, err := fhirpath.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledExpressions.Store(expression, compiled)
+	return compiled, nil
+}
+
+// NativeFhirPathEngine evaluates constraints with the built-in Go FHIRPath engine,
+// using the snapshots of Spec to resolve element types.
+type NativeFhirPathEngine struct {
+	Spec *LibraryData
+}
+
+// FhirPathValidatorNative evaluates every constraint of the payload with the built-in
+// Go FHIRPath engine and the spec loaded by LoadData. It returns the same response
+// as FhirPathValidatorMultiple.
+func FhirPathValidatorNative(array []*FhirPathPayload) (*FhirPathResponse, error) {
+	return NativeFhirPathEngine{Spec: specLibraryData}.Evaluate(context.Background(), array)
+}
+
+// Evaluate implements FhirPathEngine.
+func (e NativeFhirPathEngine) Evaluate(ctx context.Context, array []*FhirPathPayload) (*FhirPathResponse, error) {
+	response := &FhirPathResponse{
+		Results: make([]ValidationResult, 0, len(array)),
+		Errors:  make([]ConstraintError, 0),
+		Trace:   make([]TraceEntry, 0),
+	}
+
+	for _, item := range array {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		constraintError := func(err error) ConstraintError {
+			return ConstraintError{
+				Key:      item.ConstraintKey,
+				Path:     item.ParentPath,
+				Source:   item.ConstraintSource,
+				Severity: item.ConstraintSeverity,
+				Message:  err.Error(),
+			}
+		}
+
+		expression, err := compileFhirPath(item.ConstraintExpression)
+		if err != nil {
+			response.Errors = append(response.Errors, constraintError(err))
+			continue
+		}
+
+		env := &fhirpath.Environment{
+			Resource:     item.RootData,
+			RootResource: item.RootData,
+			Type:         item.DataType,
+			Model:        e.Spec,
+			Context:      ctx,
+			Trace: func(label string, values fhirpath.Collection) {
+				response.Trace = append(response.Trace, TraceEntry{
+					Label:  label,
+					Key:    item.ConstraintKey,
+					Path:   item.ParentPath,
+					Values: values.Values(),
+				})
+			},
+		}
+
+		result, err := expression.Evaluate(item.Data, env)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			response.Errors = append(response.Errors, constraintError(err))
+			continue
+		}
+
+		valid, ok := result.Boolean()
+		response.Results = append(response.Results, ValidationResult{
+			Result:   ok && valid,
+			Key:      item.ConstraintKey,
+			Path:     item.ParentPath,
+			Human:    item.ConstraintHuman,
+			Source:   item.ConstraintSource,
+			Severity: item.ConstraintSeverity,
+		})
+	}
+
+	return response, nil
+}
@@ -0,0 +1,290 @@
+package v1
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrWorkerPoolClosed is returned when evaluating with a closed FhirPathWorkerPool.
+var ErrWorkerPoolClosed = errors.New("fhirpath worker pool is closed")
+
+// FhirPathWorkerPoolConfig configures a FhirPathWorkerPool.
+type FhirPathWorkerPoolConfig struct {
+	// Size is the number of Node.js workers kept alive. Defaults to runtime.NumCPU().
+	Size int
+	// Timeout bounds each evaluation request. Defaults to 30 seconds.
+	Timeout time.Duration
+	// NodePath is the Node.js executable. Defaults to "node".
+	NodePath string
+	// ScriptPath is the compiled worker script. Defaults to node/dist/fhirpath-worker.js.
+	ScriptPath string
+}
+
+// FhirPathWorkerPool keeps a fixed number of Node.js FHIRPath workers alive and
+// dispatches evaluation requests to them over a newline-delimited JSON protocol.
+// It is safe for concurrent use and implements FhirPathEngine.
+type FhirPathWorkerPool struct {
+	config FhirPathWorkerPoolConfig
+	idle   chan *fhirPathWorker
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// workerRequest is a single line written to a worker's stdin.
+type workerRequest struct {
+	ID uint64 `json:"id"`
+	*FhirPathRequest
+}
+
+// workerResponse is a single line read from a worker's stdout.
+type workerResponse struct {
+	ID uint64 `json:"id"`
+	FhirPathResponse
+	Error string `json:"error"`
+}
+
+type fhirPathWorker struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan workerResponse
+	done      chan struct{} // closed when the process has exited
+	nextID    uint64
+}
+
+// NewFhirPathWorkerPool starts config.Size Node.js workers.
+func NewFhirPathWorkerPool(config FhirPathWorkerPoolConfig) (*FhirPathWorkerPool, error) {
+	if config.Size <= 0 {
+		config.Size = runtime.NumCPU()
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	if config.NodePath == "" {
+		config.NodePath = "node"
+	}
+	if config.ScriptPath == "" {
+		config.ScriptPath = filepath.Join("node/dist", "fhirpath-worker.js")
+	}
+
+	pool := &FhirPathWorkerPool{
+		config: config,
+		idle:   make(chan *fhirPathWorker, config.Size),
+	}
+
+	for i := 0; i < config.Size; i++ {
+		worker, err := pool.startWorker()
+		if err != nil {
+			_ = pool.Close()
+			return nil, err
+		}
+		pool.idle <- worker
+	}
+
+	return pool, nil
+}
+
+func (p *FhirPathWorkerPool) startWorker() (*fhirPathWorker, error) {
+	cmd := exec.Command(p.config.NodePath, p.config.ScriptPath)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating worker stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating worker stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting fhirpath worker: %w", err)
+	}
+
+	worker := &fhirPathWorker{
+		cmd:       cmd,
+		stdin:     stdin,
+		responses: make(chan workerResponse, 1),
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		defer close(worker.done)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+		for scanner.Scan() {
+			var response workerResponse
+			if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+				response = workerResponse{Error: fmt.Sprintf("invalid worker response: %v", err)}
+			}
+			// Responses nobody waits for (after a timeout) are dropped.
+			select {
+			case worker.responses <- response:
+			default:
+			}
+		}
+		_ = cmd.Wait()
+	}()
+
+	return worker, nil
+}
+
+func (w *fhirPathWorker) alive() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (w *fhirPathWorker) kill() {
+	_ = w.stdin.Close()
+	if w.cmd.Process != nil {
+		_ = w.cmd.Process.Kill()
+	}
+}
+
+// acquire takes an idle worker, replacing it if its process has exited.
+func (p *FhirPathWorkerPool) acquire(ctx context.Context) (*fhirPathWorker, error) {
+	var worker *fhirPathWorker
+	select {
+	case w, ok := <-p.idle:
+		if !ok {
+			return nil, ErrWorkerPoolClosed
+		}
+		worker = w
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// Close drains the idle workers while it holds none of them, so a worker received
+	// once the pool is closed has to be stopped here instead of used.
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		if worker != nil {
+			worker.kill()
+		}
+		return nil, ErrWorkerPoolClosed
+	}
+
+	if worker != nil && worker.alive() {
+		return worker, nil
+	}
+
+	replacement, err := p.startWorker()
+	if err != nil {
+		// Keep the slot so a later call can retry the restart.
+		p.release(nil)
+		return nil, err
+	}
+	return replacement, nil
+}
+
+// release returns a worker to the pool, or stops it when the pool is closed.
+func (p *FhirPathWorkerPool) release(worker *fhirPathWorker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		if worker != nil {
+			worker.kill()
+		}
+		return
+	}
+	p.idle <- worker
+}
+
+// Evaluate sends the payload to an idle worker and waits for its response, at most
+// until the configured Timeout or until ctx is done.
+func (p *FhirPathWorkerPool) Evaluate(ctx context.Context, array []*FhirPathPayload) (*FhirPathResponse, error) {
+	worker, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := worker.roundTrip(ctx, array, p.config.Timeout)
+	if err != nil {
+		// The worker is in an unknown state, so restart it on next use.
+		worker.kill()
+		p.release(nil)
+		return nil, err
+	}
+	p.release(worker)
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("fhirpath worker error: %s", response.Error)
+	}
+
+	return &response.FhirPathResponse, nil
+}
+
+func (w *fhirPathWorker) roundTrip(ctx context.Context, array []*FhirPathPayload, timeout time.Duration) (workerResponse, error) {
+	w.nextID++
+	request := workerRequest{ID: w.nextID, FhirPathRequest: NewFhirPathRequest(array)}
+
+	line, err := json.Marshal(request)
+	if err != nil {
+		return workerResponse{}, fmt.Errorf("error encoding worker request: %w", err)
+	}
+	if _, err := w.stdin.Write(append(line, '\n')); err != nil {
+		return workerResponse{}, fmt.Errorf("error writing to fhirpath worker: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case response := <-w.responses:
+			if response.ID != request.ID && response.Error == "" {
+				continue // stale response from an earlier request
+			}
+			return response, nil
+		case <-w.done:
+			return workerResponse{}, fmt.Errorf("fhirpath worker exited unexpectedly")
+		case <-timer.C:
+			return workerResponse{}, fmt.Errorf("fhirpath worker timed out after %s", timeout)
+		case <-ctx.Done():
+			return workerResponse{}, ctx.Err()
+		}
+	}
+}
+
+// Close stops all workers. Requests in flight complete before their worker is stopped.
+func (p *FhirPathWorkerPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.idle)
+	p.mu.Unlock()
+
+	for worker := range p.idle {
+		if worker == nil {
+			continue
+		}
+		// Closing stdin lets the worker exit on its own; kill it if it does not.
+		_ = worker.stdin.Close()
+		select {
+		case <-worker.done:
+		case <-time.After(5 * time.Second):
+			worker.kill()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newEchoPool starts a pool whose workers are `cat -`: each request line comes back as
+// a response with the same id and no results.
+func newEchoPool(t *testing.T, size int) *FhirPathWorkerPool {
+	t.Helper()
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat is not available")
+	}
+	pool, err := NewFhirPathWorkerPool(FhirPathWorkerPoolConfig{Size: size, Timeout: 5 * time.Second, NodePath: "cat", ScriptPath: "-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func echoPayload() []*FhirPathPayload {
+	root := map[string]interface{}{"resourceType": "Patient", "id": "p1"}
+	return []*FhirPathPayload{{RootData: root, Data: root, ConstraintExpression: "id.exists()", ConstraintKey: "k-1"}}
+}
+
+func TestWorkerPoolEvaluate(t *testing.T) {
+	pool := newEchoPool(t, 2)
+	defer pool.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := pool.Evaluate(context.Background(), echoPayload()); err != nil {
+			t.Fatalf("Evaluate: %v", err)
+		}
+	}
+}
+
+func TestWorkerPoolClosed(t *testing.T) {
+	pool := newEchoPool(t, 2)
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if _, err := pool.Evaluate(context.Background(), echoPayload()); !errors.Is(err, ErrWorkerPoolClosed) {
+		t.Fatalf("Evaluate after Close = %v, want ErrWorkerPoolClosed", err)
+	}
+}
+
+// TestWorkerPoolCloseWhileEvaluating runs evaluations across Close; with -race it
+// catches a worker used after Close took it over.
+func TestWorkerPoolCloseWhileEvaluating(t *testing.T) {
+	pool := newEchoPool(t, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := pool.Evaluate(context.Background(), echoPayload())
+				if errors.Is(err, ErrWorkerPoolClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Evaluate: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+// TestWorkerPoolReplacesCrashedWorker uses a worker that exits while handling its first
+// request; the workers started after it are echo workers.
+func TestWorkerPoolReplacesCrashedWorker(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "worker.sh")
+	crashed := filepath.Join(dir, "crashed")
+	if err := os.WriteFile(script, []byte(`[ -e "`+crashed+`" ] && exec cat
+touch "`+crashed+`"
+read -r request
+exit 1
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := NewFhirPathWorkerPool(FhirPathWorkerPoolConfig{Size: 1, Timeout: 5 * time.Second, NodePath: "sh", ScriptPath: script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	if _, err := pool.Evaluate(context.Background(), echoPayload()); err == nil {
+		t.Fatal("Evaluate succeeded on a worker that exited")
+	}
+	if _, err := os.Stat(crashed); err != nil {
+		t.Fatalf("the first worker did not handle the request: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := pool.Evaluate(context.Background(), echoPayload()); err != nil {
+			t.Fatalf("Evaluate after the worker exited: %v", err)
+		}
+	}
+}
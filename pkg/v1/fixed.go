@@ -0,0 +1,143 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
+
+// validateFixedAndPattern checks a value against the fixed[x] and pattern[x] of its
+// element. A fixed value must be equal, with no other properties; a pattern only has to
+// be contained in the value. The issue is reported at the first path that differs.
+func validateFixedAndPattern(value interface{}, element Element, path string, outcome *OperationOutcome) {
+	if element.Fixed != nil {
+		if differentPath, expected, found, different := fixedDifference(value, element.Fixed.Value, path); different {
+			addOperationOutcome(outcome, "value", fmt.Sprintf("Value of '%s' must be %s (fixed%s), found %s", differentPath, formatJSON(expected), fhirpath.UpperFirst(element.Fixed.Type), formatJSON(found)), differentPath, "Value is not the fixed value", "error")
+		}
+	}
+
+	if element.Pattern != nil {
+		if differentPath, expected, found, different := patternDifference(value, element.Pattern.Value, path); different {
+			addOperationOutcome(outcome, "value", fmt.Sprintf("Value of '%s' does not match the pattern of '%s': expected %s (pattern%s), found %s", differentPath, path, formatJSON(expected), fhirpath.UpperFirst(element.Pattern.Type), formatJSON(found)), differentPath, "Value does not match the pattern", "error")
+		}
+	}
+}
+
+// fixedDifference compares value with a fixed value. It returns the first path where they
+// differ, with the expected and the found value there.
+func fixedDifference(value, fixed interface{}, path string) (string, interface{}, interface{}, bool) {
+	switch f := fixed.(type) {
+	case map[string]interface{}:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return path, fixed, value, true
+		}
+		for _, key := range fhirpath.SortedKeys(f) {
+			if differentPath, expected, found, different := fixedDifference(object[key], f[key], joinPath(path, key)); different {
+				return differentPath, expected, found, true
+			}
+		}
+		for _, key := range fhirpath.SortedKeys(object) {
+			if _, ok := f[key]; !ok {
+				return joinPath(path, key), nil, object[key], true
+			}
+		}
+		return "", nil, nil, false
+
+	case []interface{}:
+		array, ok := value.([]interface{})
+		if !ok || len(array) != len(f) {
+			return path, fixed, value, true
+		}
+		for i := range f {
+			if differentPath, expected, found, different := fixedDifference(array[i], f[i], fmt.Sprintf("%s[%d]", path, i)); different {
+				return differentPath, expected, found, true
+			}
+		}
+		return "", nil, nil, false
+	}
+
+	if !sameValue(value, fixed) {
+		return path, fixed, value, true
+	}
+	return "", nil, nil, false
+}
+
+// patternDifference checks that value contains a pattern: the same primitives, the
+// properties of an object and, for an array, an item matching each item of the pattern.
+// It returns the first path where the pattern is not found, with what was expected there.
+func patternDifference(value, pattern interface{}, path string) (string, interface{}, interface{}, bool) {
+	switch p := pattern.(type) {
+	case map[string]interface{}:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return path, pattern, value, true
+		}
+		for _, key := range fhirpath.SortedKeys(p) {
+			if differentPath, expected, found, different := patternDifference(object[key], p[key], joinPath(path, key)); different {
+				return differentPath, expected, found, true
+			}
+		}
+		return "", nil, nil, false
+
+	case []interface{}:
+		array, ok := value.([]interface{})
+		if !ok {
+			return path, pattern, value, true
+		}
+		for _, expected := range p {
+			matched := false
+			for _, item := range array {
+				if _, _, _, different := patternDifference(item, expected, path); !different {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return path, expected, value, true
+			}
+		}
+		return "", nil, nil, false
+	}
+
+	if !sameValue(value, pattern) {
+		return path, pattern, value, true
+	}
+	return "", nil, nil, false
+}
+
+// sameValue compares two primitives of JSON. Numbers are compared by value, as those of
+// a resource are decoded as json.Number and those of the definitions as float64.
+func sameValue(value, expected interface{}) bool {
+	if number, ok := toFloat(value); ok {
+		expectedNumber, ok := toFloat(expected)
+		return ok && number == expectedNumber
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+// matchesFixed reports whether value is equal to fixed (see fixedDifference).
+func matchesFixed(value, fixed interface{}) bool {
+	_, _, _, different := fixedDifference(value, fixed, "")
+	return !different
+}
+
+// matchesPattern reports whether value contains pattern (see patternDifference).
+func matchesPattern(value, pattern interface{}) bool {
+	_, _, _, different := patternDifference(value, pattern, "")
+	return !different
+}
+
+// formatJSON formats a value of a resource for a diagnostic; nil is an absent value.
+func formatJSON(value interface{}) string {
+	if value == nil {
+		return "nothing"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
@@ -0,0 +1,83 @@
+package v1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFixedAndPattern(t *testing.T) {
+	v := newProfileValidator(t, testDifferentialProfile(t, "fixed-pattern", `[
+		{"id": "Patient.gender", "path": "Patient.gender", "fixedCode": "female"},
+		{"id": "Patient.maritalStatus", "path": "Patient.maritalStatus", "patternCodeableConcept": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/v3-MaritalStatus", "code": "M"}]}},
+		{"id": "Patient.contact.name", "path": "Patient.contact.name", "patternHumanName": {"use": "official"}},
+		{"id": "Patient.multipleBirth[x]:multipleBirthInteger", "path": "Patient.multipleBirthInteger", "fixedInteger": 1},
+		{"id": "Patient.photo", "path": "Patient.photo", "patternAttachment": {"contentType": "image/png", "size": 10}}
+	]`))
+	const profile = "http://example.org/StructureDefinition/fixed-pattern"
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "fixed value",
+			resource: `{"resourceType": "Patient", "gender": "female"}`,
+		},
+		{
+			name:     "other value than the fixed one",
+			resource: `{"resourceType": "Patient", "gender": "male"}`,
+			want:     []string{`error: Value of 'Patient.gender' must be "female" (fixedCode), found "male"`},
+		},
+		{
+			name:     "pattern with extra content",
+			resource: `{"resourceType": "Patient", "maritalStatus": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/v3-MaritalStatus", "code": "M", "display": "Married"}], "text": "married"}}`,
+		},
+		{
+			name:     "pattern not matched",
+			resource: `{"resourceType": "Patient", "maritalStatus": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/v3-MaritalStatus", "code": "S"}]}}`,
+			want:     []string{"error: Value of 'Patient.maritalStatus.coding' does not match the pattern of 'Patient.maritalStatus'"},
+		},
+		{
+			name:     "pattern of a backbone child",
+			resource: `{"resourceType": "Patient", "contact": [{"name": {"use": "nickname", "family": "Doe"}}]}`,
+			want:     []string{`error: Value of 'Patient.contact[0].name.use' does not match the pattern of 'Patient.contact[0].name': expected "official" (patternHumanName), found "nickname"`},
+		},
+		{
+			name:     "fixed number",
+			resource: `{"resourceType": "Patient", "multipleBirthInteger": 1}`,
+		},
+		{
+			name:     "other number than the fixed one",
+			resource: `{"resourceType": "Patient", "multipleBirthInteger": 2}`,
+			want:     []string{"error: Value of 'Patient.multipleBirthInteger' must be 1 (fixedInteger), found 2"},
+		},
+		{
+			name:     "pattern with a number",
+			resource: `{"resourceType": "Patient", "photo": [{"contentType": "image/png", "size": 10, "title": "front"}]}`,
+		},
+		{
+			name:     "pattern with another number",
+			resource: `{"resourceType": "Patient", "photo": [{"contentType": "image/png", "size": 12}]}`,
+			want:     []string{"error: Value of 'Patient.photo[0].size' does not match the pattern of 'Patient.photo[0]': expected 10 (patternAttachment), found 12"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withoutBindingWarnings(validateAgainst(t, v, profile, tt.resource))
+			assertIssues(t, got, tt.want...)
+		})
+	}
+}
+
+// withoutBindingWarnings leaves out the codes that the embedded spec cannot check.
+func withoutBindingWarnings(issues []string) []string {
+	var result []string
+	for _, issue := range issues {
+		if !strings.Contains(issue, "could not be checked against the value set") {
+			result = append(result, issue)
+		}
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
+
+// validateLimits checks a value against the maxLength, minValue[x] and maxValue[x] of its
+// element. Numbers, dates, times and Quantities are compared by their type; a date with
+// a partial precision is out of range only when all of it is.
+func validateLimits(value interface{}, element Element, typeCode, path string, outcome *OperationOutcome) {
+	if text, ok := value.(string); ok && element.MaxLength > 0 {
+		if length := utf8.RuneCountInString(text); length > element.MaxLength {
+			addOperationOutcome(outcome, "too-long", fmt.Sprintf("Field '%s' is too long: maximum length is %d characters. Found %d characters", path, element.MaxLength, length), path, "Value is too long", "error")
+		}
+	}
+
+	if element.MinValue != nil {
+		if below, ok := compareLimit(value, element.MinValue.Value, typeCode); ok && below < 0 {
+			addOperationOutcome(outcome, "value", fmt.Sprintf("Field '%s' is below the minimum value: %s is less than %s (minValue%s)", path, formatJSON(value), formatJSON(element.MinValue.Value), fhirpath.UpperFirst(element.MinValue.Type)), path, "Value below the minimum", "error")
+		}
+	}
+
+	if element.MaxValue != nil {
+		if above, ok := compareLimit(value, element.MaxValue.Value, typeCode); ok && above > 0 {
+			addOperationOutcome(outcome, "value", fmt.Sprintf("Field '%s' is above the maximum value: %s is greater than %s (maxValue%s)", path, formatJSON(value), formatJSON(element.MaxValue.Value), fhirpath.UpperFirst(element.MaxValue.Type)), path, "Value above the maximum", "error")
+		}
+	}
+}
+
+// compareLimit compares value with a limit of the same type: -1 when value is entirely
+// below it, 1 when entirely above and 0 otherwise. It reports false when they cannot be
+// compared, e.g. Quantities in different units or a malformed value.
+func compareLimit(value, limit interface{}, typeCode string) (int, bool) {
+	switch typeCode {
+	case "integer", "positiveInt", "unsignedInt", "decimal":
+		return compareNumbers(value, limit)
+
+	case "date", "dateTime", "instant":
+		text, ok := value.(string)
+		limitText, limitOK := limit.(string)
+		if !ok || !limitOK {
+			return 0, false
+		}
+		start, end, err := dateTimeRange(text)
+		if err != nil {
+			return 0, false
+		}
+		limitStart, limitEnd, err := dateTimeRange(limitText)
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case !end.After(limitStart):
+			return -1, true
+		case !start.Before(limitEnd):
+			return 1, true
+		}
+		return 0, true
+
+	case "time":
+		text, ok := value.(string)
+		limitText, limitOK := limit.(string)
+		if !ok || !limitOK {
+			return 0, false
+		}
+		return strings.Compare(text, limitText), true // hh:mm:ss sorts as text
+
+	case "Quantity", "Age", "Duration", "Distance", "Count", "SimpleQuantity":
+		quantity, ok := value.(map[string]interface{})
+		limitQuantity, limitOK := limit.(map[string]interface{})
+		if !ok || !limitOK {
+			return 0, false
+		}
+		if !sameUnit(quantity, limitQuantity) {
+			return 0, false
+		}
+		return compareNumbers(quantity["value"], limitQuantity["value"])
+	}
+
+	return 0, false
+}
+
+func compareNumbers(value, limit interface{}) (int, bool) {
+	number, ok := toFloat(value)
+	limitNumber, limitOK := toFloat(limit)
+	if !ok || !limitOK {
+		return 0, false
+	}
+	switch {
+	case number < limitNumber:
+		return -1, true
+	case number > limitNumber:
+		return 1, true
+	}
+	return 0, true
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// sameUnit reports whether two Quantities can be compared: same system and code, or the
+// same unit when they have no code.
+func sameUnit(a, b map[string]interface{}) bool {
+	if code, ok := b["code"].(string); ok {
+		system, _ := b["system"].(string)
+		otherSystem, _ := a["system"].(string)
+		return a["code"] == code && (system == "" || otherSystem == "" || system == otherSystem)
+	}
+	if unit, ok := b["unit"].(string); ok {
+		return a["unit"] == unit
+	}
+	return true
+}
+
+// dateTimeLayouts are the FHIR date, dateTime and instant formats, from the most precise.
+var dateTimeLayouts = []struct {
+	layout string
+	next   func(time.Time) time.Time
+}{
+	{time.RFC3339Nano, func(t time.Time) time.Time { return t.Add(time.Nanosecond) }},
+	{"2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// dateTimeRange returns the period covered by a date, dateTime or instant of any precision,
+// e.g. all of 2020 for "2020".
+func dateTimeRange(text string) (time.Time, time.Time, error) {
+	for _, format := range dateTimeLayouts {
+		if t, err := time.Parse(format.layout, text); err == nil {
+			end := format.next(t)
+			if format.layout == time.RFC3339Nano && !strings.Contains(text, ".") {
+				end = t.Add(time.Second) // no fractional seconds
+			}
+			return t, end, nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date '%s'", text)
+}
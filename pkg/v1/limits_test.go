@@ -0,0 +1,58 @@
+package v1
+
+import "testing"
+
+func TestValidateLimits(t *testing.T) {
+	v := newProfileValidator(t, testDifferentialProfile(t, "limits", `[
+		{"id": "Patient.name.family", "path": "Patient.name.family", "maxLength": 5},
+		{"id": "Patient.multipleBirth[x]", "path": "Patient.multipleBirth[x]", "type": [{"code": "integer"}], "minValueInteger": 1, "maxValueInteger": 4},
+		{"id": "Patient.birthDate", "path": "Patient.birthDate", "minValueDate": "1900-01-01", "maxValueDate": "2020-12-31"}
+	]`))
+	const profile = "http://example.org/StructureDefinition/limits"
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "within the limits",
+			resource: `{"resourceType": "Patient", "name": [{"family": "Doe"}], "multipleBirthInteger": 4, "birthDate": "1900-01-01"}`,
+		},
+		{
+			name:     "too long",
+			resource: `{"resourceType": "Patient", "name": [{"family": "Johnson"}]}`,
+			want:     []string{"error: Field 'Patient.name[0].family' is too long: maximum length is 5 characters. Found 7 characters"},
+		},
+		{
+			name:     "length in characters, not bytes",
+			resource: `{"resourceType": "Patient", "name": [{"family": "Núñez"}]}`,
+		},
+		{
+			name:     "below minValue",
+			resource: `{"resourceType": "Patient", "multipleBirthInteger": 0}`,
+			want:     []string{"error: Field 'Patient.multipleBirthInteger' is below the minimum value: 0 is less than 1 (minValueInteger)"},
+		},
+		{
+			name:     "above maxValue",
+			resource: `{"resourceType": "Patient", "multipleBirthInteger": 5}`,
+			want:     []string{"error: Field 'Patient.multipleBirthInteger' is above the maximum value: 5 is greater than 4 (maxValueInteger)"},
+		},
+		{
+			name:     "date below minValue",
+			resource: `{"resourceType": "Patient", "birthDate": "1899-12-31"}`,
+			want:     []string{`error: Field 'Patient.birthDate' is below the minimum value: "1899-12-31" is less than "1900-01-01" (minValueDate)`},
+		},
+		{
+			name:     "date above maxValue",
+			resource: `{"resourceType": "Patient", "birthDate": "2021"}`,
+			want:     []string{`error: Field 'Patient.birthDate' is above the maximum value`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validateAgainst(t, v, profile, tt.resource), tt.want...)
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package v1
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// corePackages are provided by the embedded spec, so they need not be in the package cache.
+var corePackages = []string{"hl7.fhir.r4.core"}
+
+// packageManifest is the package/package.json of a FHIR NPM package.
+type packageManifest struct {
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// packageIndex is the package/.index.json of a FHIR NPM package.
+type packageIndex struct {
+	Files []struct {
+		Filename     string `json:"filename"`
+		ResourceType string `json:"resourceType"`
+	} `json:"files"`
+}
+
+// fhirPackage holds the manifest and the top-level JSON files of a package.
+type fhirPackage struct {
+	manifest packageManifest
+	files    map[string][]byte
+}
+
+// DefaultPackageCacheDir returns the FHIR package cache used by the HL7 tools, ~/.fhir/packages.
+func DefaultPackageCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".fhir", "packages")
+	}
+	return filepath.Join(home, ".fhir", "packages")
+}
+
+// LoadPackage loads the FHIR NPM package at path and its dependencies into a new
+// LibraryData. See (*LibraryData).LoadPackage.
+func LoadPackage(path string, cacheDirs ...string) (*LibraryData, error) {
+	library := &LibraryData{
+		Config: make(map[string]interface{}),
+	}
+
+	if err := library.LoadPackage(path, cacheDirs...); err != nil {
+		return library, err
+	}
+
+	return library, nil
+}
+
+// LoadPackage adds the StructureDefinitions, ValueSets and CodeSystems of the FHIR NPM
+// package at path to the library. path is a package .tgz file or an unpacked package
+// directory. Dependencies are loaded first, from cacheDirs (default DefaultPackageCacheDir)
+// laid out like the FHIR package cache: <name>#<version>/package or <name>#<version>.tgz.
+// A missing hl7.fhir.r4.core dependency is skipped, since the core spec is embedded.
+// It must not run while the library is used to validate.
+func (l *LibraryData) LoadPackage(path string, cacheDirs ...string) error {
+	if len(cacheDirs) == 0 {
+		cacheDirs = []string{DefaultPackageCacheDir()}
+	}
+
+	// The package may add or replace definitions that indexes and caches were built from,
+	// even when it fails half way.
+	defer func() {
+		l.resetURLIndex()
+		l.resetElementIndex()
+		l.resetSnapshots()
+		l.resetExpansions()
+	}()
+
+	return l.loadPackage(path, cacheDirs, make(map[string]bool))
+}
+
+func (l *LibraryData) loadPackage(packagePath string, cacheDirs []string, loaded map[string]bool) error {
+	pkg, err := readPackage(packagePath)
+	if err != nil {
+		return err
+	}
+
+	id := pkg.manifest.Name + "#" + pkg.manifest.Version
+	if loaded[id] {
+		return nil
+	}
+	loaded[id] = true
+
+	// Load dependencies in a stable order so the result does not depend on map iteration.
+	names := make([]string, 0, len(pkg.manifest.Dependencies))
+	for name := range pkg.manifest.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := pkg.manifest.Dependencies[name]
+		if loaded[name+"#"+version] {
+			continue
+		}
+
+		dependencyPath, found := findCachedPackage(cacheDirs, name, version)
+		if !found {
+			if contains(corePackages, name) {
+				continue // provided by the embedded spec
+			}
+			return fmt.Errorf("dependency %s#%s of package %s not found in %s", name, version, id, strings.Join(cacheDirs, ", "))
+		}
+
+		if err := l.loadPackage(dependencyPath, cacheDirs, loaded); err != nil {
+			return err
+		}
+	}
+
+	return l.loadPackageFiles(pkg)
+}
+
+// loadPackageFiles adds the definitions of the package, using .index.json when present
+// to avoid parsing the other resources.
+func (l *LibraryData) loadPackageFiles(pkg *fhirPackage) error {
+	fileNames := make([]string, 0, len(pkg.files))
+
+	if indexJSON, ok := pkg.files[".index.json"]; ok {
+		var index packageIndex
+		if err := json.Unmarshal(indexJSON, &index); err != nil {
+			return fmt.Errorf("failed to parse .index.json of package %s: %w", pkg.manifest.Name, err)
+		}
+		for _, file := range index.Files {
+			switch file.ResourceType {
+			case "StructureDefinition", "ValueSet", "CodeSystem", "Bundle":
+				fileNames = append(fileNames, file.Filename)
+			}
+		}
+	} else {
+		for name := range pkg.files {
+			if name != "package.json" {
+				fileNames = append(fileNames, name)
+			}
+		}
+	}
+	sort.Strings(fileNames)
+
+	for _, name := range fileNames {
+		content, ok := pkg.files[name]
+		if !ok {
+			continue
+		}
+
+		var rawData map[string]interface{}
+		if err := json.Unmarshal(content, &rawData); err != nil {
+			return fmt.Errorf("failed to decode %s of package %s: %w", name, pkg.manifest.Name, err)
+		}
+
+		resourceType, _ := rawData["resourceType"].(string)
+		switch resourceType {
+		case "Bundle":
+			if err := l.loadBundle(rawData); err != nil {
+				return fmt.Errorf("failed to load bundle %s of package %s: %w", name, pkg.manifest.Name, err)
+			}
+		case "StructureDefinition", "ValueSet", "CodeSystem":
+			if err := l.loadResource(resourceType, rawData); err != nil {
+				return fmt.Errorf("failed to load %s of package %s: %w", name, pkg.manifest.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// findCachedPackage looks for name#version in the package cache directories.
+func findCachedPackage(cacheDirs []string, name, version string) (string, bool) {
+	candidates := []string{
+		name + "#" + version,
+		name + "#" + version + ".tgz",
+		name + "-" + version + ".tgz",
+	}
+
+	for _, dir := range cacheDirs {
+		for _, candidate := range candidates {
+			candidatePath := filepath.Join(dir, candidate)
+			if _, err := os.Stat(candidatePath); err == nil {
+				return candidatePath, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// readPackage reads the manifest and the top-level JSON files of a package .tgz or directory.
+// Files in sub-directories such as package/example are not definitions and are skipped.
+func readPackage(packagePath string) (*fhirPackage, error) {
+	info, err := os.Stat(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package %s: %w", packagePath, err)
+	}
+
+	var files map[string][]byte
+	if info.IsDir() {
+		files, err = readPackageDir(packagePath)
+	} else {
+		files, err = readPackageTgz(packagePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifestJSON, ok := files["package.json"]
+	if !ok {
+		return nil, fmt.Errorf("package %s has no package/package.json", packagePath)
+	}
+
+	pkg := &fhirPackage{files: files}
+	if err := json.Unmarshal(manifestJSON, &pkg.manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse package.json of %s: %w", packagePath, err)
+	}
+
+	return pkg, nil
+}
+
+func readPackageDir(dir string) (map[string][]byte, error) {
+	// Accept both the cache entry (<name>#<version>) and its package sub-directory.
+	if _, err := os.Stat(filepath.Join(dir, "package", "package.json")); err == nil {
+		dir = filepath.Join(dir, "package")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package %s: %w", dir, err)
+	}
+
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+		}
+		files[entry.Name()] = content
+	}
+
+	return files, nil
+}
+
+func readPackageTgz(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package %s: %w", file, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package %s: %w", file, err)
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read package %s: %w", file, err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Only package/<name>.json; examples and other files live in sub-directories.
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		dir, base := path.Split(name)
+		if dir != "package/" || !strings.HasSuffix(base, ".json") {
+			continue
+		}
+
+		content, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s of package %s: %w", name, file, err)
+		}
+		files[base] = content
+	}
+
+	return files, nil
+}
@@ -0,0 +1,289 @@
+package v1
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+// testPackageFiles returns the package.json of name#version with the given
+// dependencies, together with files.
+func testPackageFiles(t *testing.T, name, version string, dependencies map[string]string, files map[string]interface{}) map[string][]byte {
+	t.Helper()
+	contents := map[string][]byte{
+		"package.json": mustJSON(t, packageManifest{Name: name, Version: version, Dependencies: dependencies}),
+	}
+	for fileName, resource := range files {
+		contents[fileName] = mustJSON(t, resource)
+	}
+	return contents
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// writePackageDir writes files to dir/package, like an entry of the package cache.
+func writePackageDir(t *testing.T, dir string, files map[string][]byte) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, "package"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, "package", name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// writePackageTgz writes files under package/ in a .tgz, with an example that has to be skipped.
+func writePackageTgz(t *testing.T, file string, files map[string][]byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+
+	files["example/Patient-example.json"] = []byte(`{"resourceType": "StructureDefinition", "id": "Example", "url": "http://example.org/example"}`)
+	for name, content := range files {
+		header := &tar.Header{Name: "package/" + name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// testProfile is a minimal StructureDefinition with the given url.
+func testProfile(id, url string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType":   "StructureDefinition",
+		"id":             id,
+		"url":            url,
+		"name":           id,
+		"kind":           "resource",
+		"type":           "Patient",
+		"baseDefinition": "http://hl7.org/fhir/StructureDefinition/Patient",
+		"derivation":     "constraint",
+	}
+}
+
+// sampleDefinition is a core-like definition of a Sample type, which no spec has.
+func sampleDefinition() map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": "StructureDefinition",
+		"id":           "Sample",
+		"url":          "http://hl7.org/fhir/StructureDefinition/Sample",
+		"name":         "Sample",
+		"type":         "Sample",
+		"kind":         "resource",
+		"snapshot": map[string]interface{}{
+			"element": []interface{}{
+				map[string]interface{}{"id": "Sample", "path": "Sample", "min": 0, "max": "*"},
+				map[string]interface{}{"id": "Sample.status", "path": "Sample.status", "min": 1, "max": "1", "type": []interface{}{map[string]interface{}{"code": "code"}}},
+				map[string]interface{}{"id": "Sample.value[x]", "path": "Sample.value[x]", "min": 0, "max": "1", "type": []interface{}{map[string]interface{}{"code": "Quantity"}, map[string]interface{}{"code": "string"}}},
+			},
+		},
+	}
+}
+
+func TestLoadPackageDirectory(t *testing.T) {
+	dir := writePackageDir(t, t.TempDir(), testPackageFiles(t, "example.fhir", "1.0.0", nil, map[string]interface{}{
+		"StructureDefinition-example-patient.json": testProfile("example-patient", "http://example.org/StructureDefinition/example-patient"),
+	}))
+
+	// Both the cache entry and its package sub-directory are accepted.
+	for _, path := range []string{dir, filepath.Join(dir, "package")} {
+		library, err := LoadPackage(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if _, ok := library.StructureDefinitionByURL("http://example.org/StructureDefinition/example-patient"); !ok {
+			t.Errorf("%s: profile not loaded", path)
+		}
+	}
+}
+
+func TestLoadPackageTgzSkipsExamples(t *testing.T) {
+	file := writePackageTgz(t, filepath.Join(t.TempDir(), "example.fhir-1.0.0.tgz"), testPackageFiles(t, "example.fhir", "1.0.0", nil, map[string]interface{}{
+		"StructureDefinition-example-patient.json": testProfile("example-patient", "http://example.org/StructureDefinition/example-patient"),
+	}))
+
+	library, err := LoadPackage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := library.StructureDefinitionByURL("http://example.org/StructureDefinition/example-patient"); !ok {
+		t.Error("profile not loaded")
+	}
+	if _, ok := library.StructureDefinitionByURL("http://example.org/example"); ok {
+		t.Error("example under package/example loaded as a definition")
+	}
+}
+
+func TestLoadPackageUsesIndex(t *testing.T) {
+	files := testPackageFiles(t, "example.fhir", "1.0.0", nil, map[string]interface{}{
+		"StructureDefinition-listed.json":   testProfile("listed", "http://example.org/StructureDefinition/listed"),
+		"StructureDefinition-unlisted.json": testProfile("unlisted", "http://example.org/StructureDefinition/unlisted"),
+	})
+	files[".index.json"] = []byte(`{"files": [{"filename": "StructureDefinition-listed.json", "resourceType": "StructureDefinition"}]}`)
+
+	library, err := LoadPackage(writePackageDir(t, t.TempDir(), files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := library.StructureDefinitionByURL("http://example.org/StructureDefinition/listed"); !ok {
+		t.Error("file listed in .index.json not loaded")
+	}
+	if _, ok := library.StructureDefinitionByURL("http://example.org/StructureDefinition/unlisted"); ok {
+		t.Error("file missing from .index.json loaded")
+	}
+}
+
+func TestLoadPackageDependencies(t *testing.T) {
+	cache := t.TempDir()
+	writePackageDir(t, filepath.Join(cache, "example.base#2.0.0"), testPackageFiles(t, "example.base", "2.0.0", nil, map[string]interface{}{
+		"StructureDefinition-base-patient.json": testProfile("base-patient", "http://example.org/StructureDefinition/base-patient"),
+	}))
+
+	dependencies := map[string]string{"example.base": "2.0.0", "hl7.fhir.r4.core": "4.0.1"}
+	dir := writePackageDir(t, t.TempDir(), testPackageFiles(t, "example.fhir", "1.0.0", dependencies, map[string]interface{}{
+		"StructureDefinition-example-patient.json": testProfile("example-patient", "http://example.org/StructureDefinition/example-patient"),
+	}))
+
+	// The core package is not in the cache and is skipped silently.
+	var library *LibraryData
+	var err error
+	if printed := captureStdout(t, func() { library, err = LoadPackage(dir, cache) }); printed != "" {
+		t.Errorf("LoadPackage printed to stdout:\n%s", printed)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"http://example.org/StructureDefinition/base-patient", "http://example.org/StructureDefinition/example-patient"} {
+		if _, ok := library.StructureDefinitionByURL(url); !ok {
+			t.Errorf("%s not loaded", url)
+		}
+	}
+}
+
+func TestLoadPackageMissingDependency(t *testing.T) {
+	dir := writePackageDir(t, t.TempDir(), testPackageFiles(t, "example.fhir", "1.0.0", map[string]string{"example.missing": "1.0.0"}, nil))
+
+	_, err := LoadPackage(dir, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "example.missing#1.0.0") {
+		t.Fatalf("got error %v, want the missing dependency", err)
+	}
+}
+
+func TestLoadPackageUpdatesElementIndex(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the index before the package is loaded.
+	if _, ok := library.ElementInfo("Patient.name"); !ok {
+		t.Fatal("Patient.name not indexed")
+	}
+	if _, ok := library.ElementInfo("Sample.status"); ok {
+		t.Fatal("Sample.status indexed before loading its definition")
+	}
+
+	dir := writePackageDir(t, t.TempDir(), testPackageFiles(t, "example.sample", "1.0.0", nil, map[string]interface{}{
+		"StructureDefinition-Sample.json": sampleDefinition(),
+	}))
+	if err := library.LoadPackage(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	info, ok := library.ElementInfo("Sample.value")
+	if !ok || !info.Choice || len(info.Types) != 2 {
+		t.Errorf("got %+v, %v for Sample.value after loading the package", info, ok)
+	}
+	if _, ok := library.ElementInfo("Patient.name"); !ok {
+		t.Error("Patient.name no longer indexed")
+	}
+}
+
+func TestLoadPackageResetsCaches(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(WithSpec(library))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		profileURL  = "http://example.org/StructureDefinition/cached-patient"
+		valueSetURL = "http://example.org/ValueSet/colors"
+	)
+	release := func(version, element, code string) string {
+		profile := testProfile("cached-patient", profileURL)
+		profile["differential"] = map[string]interface{}{"element": []interface{}{
+			map[string]interface{}{"id": "Patient." + element, "path": "Patient." + element, "min": 1},
+		}}
+		valueSet := map[string]interface{}{
+			"resourceType": "ValueSet",
+			"url":          valueSetURL,
+			"compose": map[string]interface{}{"include": []interface{}{map[string]interface{}{
+				"system":  "http://example.org/colors",
+				"concept": []interface{}{map[string]interface{}{"code": code}},
+			}}},
+		}
+		return writePackageDir(t, filepath.Join(t.TempDir(), "example.fhir#"+version), testPackageFiles(t, "example.fhir", version, nil, map[string]interface{}{
+			"StructureDefinition-cached-patient.json": profile,
+			"ValueSet-colors.json":                    valueSet,
+		}))
+	}
+
+	check := func(wantIssue, wantCode string) {
+		t.Helper()
+		assertIssues(t, validateAgainst(t, v, profileURL, `{"resourceType": "Patient"}`), wantIssue)
+		expansion, err := library.ExpandValueSet(valueSetURL, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codes := expansionCodes(expansion); len(codes) != 1 || codes[0] != wantCode {
+			t.Errorf("got codes %v, want [%s]", codes, wantCode)
+		}
+	}
+
+	// The first validation caches the generated snapshot and the expansion.
+	if err := library.LoadPackage(release("1.0.0", "birthDate", "red")); err != nil {
+		t.Fatal(err)
+	}
+	check("error: Field 'Patient.birthDate' is required", "red")
+
+	if err := library.LoadPackage(release("2.0.0", "gender", "blue")); err != nil {
+		t.Fatal(err)
+	}
+	check("error: Field 'Patient.gender' is required", "blue")
+}
@@ -7,14 +7,34 @@ import (
 	"io/fs"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
 )
 
 // LibraryData holds the JSON content in memory
 type LibraryData struct {
 	Config map[string]interface{} `json:"config"`
+
+	// elementIndex maps element paths to their FHIRPath type information; nil until
+	// first used and after definitions are added
+	modelMu      sync.RWMutex
+	elementIndex map[string]fhirpath.ElementInfo
+
+	// urlIndex maps canonical URLs (and url|version) to StructureDefinitions; nil until
+	// first used and after definitions are added
+	urlMu    sync.RWMutex
+	urlIndex map[string]StructureDefinition
+
+	// snapshots caches the snapshots generated for definitions without one
+	snapshotMu sync.Mutex
+	snapshots  map[string]*Snapshot
+
+	// expansions caches the ValueSet expansions by url|version
+	expansionMu sync.Mutex
+	expansions  map[string]*ValueSetExpansion
 }
 
 var (
@@ -22,12 +42,12 @@ var (
 	specLibraryData *LibraryData
 )
 
-func loadJSON(filePath string) (interface{}, error) {
-	file, err := os.Open(filePath)
+func loadJSON(fsys fs.FS, filePath string) (interface{}, error) {
+	file, err := fsys.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
-	defer func(file *os.File) {
+	defer func(file fs.File) {
 		err := file.Close()
 		if err != nil {
 			log.Printf("failed to close file %s: %v\n", filePath, err)
@@ -43,88 +63,153 @@ func loadJSON(filePath string) (interface{}, error) {
 	return content, nil
 }
 
-// LoadData loads JSON files into memory (singleton)
-func LoadData() (*LibraryData, error) {
+// LoadData loads JSON files into memory (singleton). Without arguments it loads the
+// definitions embedded in the spec package; otherwise it loads fsys like LoadSpecFS,
+// e.g. LoadData(spec.FS, os.DirFS("profiles")). Only the first call loads anything.
+func LoadData(fsys ...fs.FS) (*LibraryData, error) {
 	var err error
 	once.Do(func() {
-		specLibraryData = &LibraryData{
-			Config: make(map[string]interface{}),
+		if len(fsys) == 0 {
+			fsys = []fs.FS{fhirspec.FS}
 		}
+		specLibraryData, err = LoadSpecFS(fsys...)
+	})
+	return specLibraryData, err
+}
 
-		err = filepath.WalkDir("spec", func(path string, d fs.DirEntry, walErr error) error {
-			if walErr != nil {
-				return walErr
-			}
+// LoadSpecFS loads every StructureDefinition, ValueSet and CodeSystem JSON file found
+// in the file systems into a new LibraryData. They are loaded in order, so a definition
+// in a later file system, such as an on-disk directory of custom profiles, replaces one
+// with the same key in an earlier one. Unlike LoadData it does not touch the shared library.
+func LoadSpecFS(fsys ...fs.FS) (*LibraryData, error) {
+	library := &LibraryData{
+		Config: make(map[string]interface{}),
+	}
 
-			if !d.IsDir() && strings.HasSuffix(d.Name(), ".json") {
-				fileName := filepath.Base(path)
+	for _, f := range fsys {
+		if err := library.loadFS(f); err != nil {
+			return library, err
+		}
+	}
 
-				// Load JSON file
-				jsonData, loadErr := loadJSON(path)
-				if loadErr != nil {
-					return loadErr
-				}
+	return library, nil
+}
 
-				// access the JSON specLibraryData resourceType attribute
-				switch jsonData.(type) {
-				case map[string]interface{}:
+// loadFS adds the JSON definitions found in fsys to the library.
+func (l *LibraryData) loadFS(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, walErr error) error {
+		if walErr != nil {
+			return walErr
+		}
 
-					rawData := jsonData.(map[string]interface{})
-					resourceType, ok := rawData["resourceType"].(string)
-					if !ok {
-						return fmt.Errorf("missing or invalid 'resourceType' in JSON")
-					}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".json") {
+			fileName := d.Name()
+
+			// Load JSON file
+			jsonData, loadErr := loadJSON(fsys, path)
+			if loadErr != nil {
+				return loadErr
+			}
 
-					fmt.Printf("ResourceType '%s\n'", resourceType)
-
-					switch resourceType {
-					case "StructureDefinition":
-						var structureDef StructureDefinition
-						jsonBytes, _ := json.Marshal(rawData) // Convert map to JSON
-						if err := json.Unmarshal(jsonBytes, &structureDef); err != nil {
-							return fmt.Errorf("failed to parse StructureDefinition: %v", err)
-						}
-
-						var key string
-						if structureDef.Type == "Extension" && structureDef.ID != "Extension" {
-							key = structureDef.URL
-						} else {
-							key = structureDef.ID
-						}
-						specLibraryData.Config[key] = structureDef
-
-					case "ValueSet":
-
-						var valueSet ValueSet
-						jsonBytes, _ := json.Marshal(rawData) // Convert map to JSON
-						if err := json.Unmarshal(jsonBytes, &valueSet); err != nil {
-							return fmt.Errorf("failed to parse StructureDefinition: %v", err)
-						}
-
-						specLibraryData.Config[valueSet.URL] = valueSet
-
-					case "CodeSystem":
-						var codeSystem CodeSystem
-						jsonBytes, _ := json.Marshal(rawData) // Convert map to JSON
-						if err := json.Unmarshal(jsonBytes, &codeSystem); err != nil {
-							return fmt.Errorf("failed to parse StructureDefinition: %v", err)
-						}
-
-						specLibraryData.Config[codeSystem.URL] = codeSystem
-					default:
-						return fmt.Errorf("unknown resourceType: %s", resourceType)
+			// access the JSON specLibraryData resourceType attribute
+			switch jsonData.(type) {
+			case map[string]interface{}:
+
+				rawData := jsonData.(map[string]interface{})
+				resourceType, ok := rawData["resourceType"].(string)
+				if !ok {
+					return fmt.Errorf("missing or invalid 'resourceType' in JSON")
+				}
+
+				if resourceType == "Bundle" {
+					if err := l.loadBundle(rawData); err != nil {
+						return fmt.Errorf("failed to load bundle %s: %w", fileName, err)
 					}
+					return nil
+				}
 
-				default:
-					return fmt.Errorf("invalid JSON specLibraryData in file %s", fileName)
+				if err := l.loadResource(resourceType, rawData); err != nil {
+					return err
 				}
-			}
 
-			return nil
-		})
+			default:
+				return fmt.Errorf("invalid JSON specLibraryData in file %s", fileName)
+			}
+		}
 
+		return nil
 	})
-	return specLibraryData, err
+}
+
+// loadBundle adds the definitions of a Bundle such as the R4 core profiles-resources.json,
+// profiles-types.json or valuesets.json. Entries of other types are skipped.
+func (l *LibraryData) loadBundle(bundle map[string]interface{}) error {
+	entries, _ := bundle["entry"].([]interface{})
+
+	for _, entry := range entries {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		resource, ok := entryMap["resource"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		resourceType, _ := resource["resourceType"].(string)
+		switch resourceType {
+		case "StructureDefinition", "ValueSet", "CodeSystem":
+			if err := l.loadResource(resourceType, resource); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadResource adds a StructureDefinition, ValueSet or CodeSystem to the library.
+func (l *LibraryData) loadResource(resourceType string, rawData map[string]interface{}) error {
+	switch resourceType {
+	case "StructureDefinition":
+		var structureDef StructureDefinition
+		jsonBytes, _ := json.Marshal(rawData) // Convert map to JSON
+		if err := json.Unmarshal(jsonBytes, &structureDef); err != nil {
+			return fmt.Errorf("failed to parse StructureDefinition: %v", err)
+		}
+
+		var key string
+		if structureDef.Type == "Extension" && structureDef.ID != "Extension" {
+			key = structureDef.URL
+		} else {
+			key = structureDef.ID
+		}
+		l.Config[key] = structureDef
+
+	case "ValueSet":
+
+		var valueSet ValueSet
+		jsonBytes, _ := json.Marshal(rawData) // Convert map to JSON
+		if err := json.Unmarshal(jsonBytes, &valueSet); err != nil {
+			return fmt.Errorf("failed to parse ValueSet: %v", err)
+		}
+
+		l.Config[valueSet.URL] = valueSet
+
+	case "CodeSystem":
+		var codeSystem CodeSystem
+		jsonBytes, _ := json.Marshal(rawData) // Convert map to JSON
+		if err := json.Unmarshal(jsonBytes, &codeSystem); err != nil {
+			return fmt.Errorf("failed to parse CodeSystem: %v", err)
+		}
+
+		l.Config[codeSystem.URL] = codeSystem
+	default:
+		return fmt.Errorf("unknown resourceType: %s", resourceType)
+	}
+
+	return nil
 }
 
 func GetSpec() (*LibraryData, error) {
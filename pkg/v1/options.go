@@ -0,0 +1,110 @@
+package v1
+
+import (
+	"io"
+	"io/fs"
+)
+
+// DefaultSkippedConstraints are the constraint keys that are not evaluated unless
+// WithSkippedConstraints says otherwise. txt-1 and txt-2 check the narrative XHTML,
+// and ele-1 holds for every element that passed the structural checks.
+var DefaultSkippedConstraints = []string{"txt-1", "txt-2", "ele-1"}
+
+// Option configures a Validator created with New.
+type Option func(*validatorOptions)
+
+type validatorOptions struct {
+	spec               *LibraryData
+	specFS             []fs.FS
+	packages           []packageSource
+	engine             FhirPathEngine
+	terminology        TerminologyService
+	unknownSystem      string
+	unknownExtension   string
+	skippedConstraints []string
+	debugDump          io.Writer
+}
+
+// WithSpec uses an already loaded spec library, e.g. one shared by several validators.
+func WithSpec(spec *LibraryData) Option {
+	return func(o *validatorOptions) {
+		o.spec = spec
+		o.specFS = nil
+	}
+}
+
+// WithSpecFS loads the StructureDefinitions, ValueSets and CodeSystems from fsys
+// instead of the embedded spec, in order, as LoadSpecFS does. To add custom profiles
+// to the core definitions use WithSpecFS(spec.FS, os.DirFS("/etc/fhir/profiles")).
+func WithSpecFS(fsys ...fs.FS) Option {
+	return func(o *validatorOptions) {
+		o.specFS = fsys
+		o.spec = nil
+	}
+}
+
+// packageSource is a package requested with WithPackage.
+type packageSource struct {
+	path      string
+	cacheDirs []string
+}
+
+// WithPackage loads the FHIR NPM package at path (a .tgz file or a directory) and its
+// dependencies on top of the spec, as (*LibraryData).LoadPackage does. It may be given
+// several times; it cannot be combined with WithSpec, whose library is shared.
+func WithPackage(path string, cacheDirs ...string) Option {
+	return func(o *validatorOptions) {
+		o.packages = append(o.packages, packageSource{path: path, cacheDirs: cacheDirs})
+	}
+}
+
+// WithFHIRPathEngine sets the engine that evaluates the constraints, e.g. a
+// NodeFhirPathEngine or a FhirPathWorkerPool. The default is the built-in Go engine.
+func WithFHIRPathEngine(engine FhirPathEngine) Option {
+	return func(o *validatorOptions) {
+		o.engine = engine
+	}
+}
+
+// WithTerminologyService sets the service the binding checks ask, e.g. an
+// HTTPTerminologyService for SNOMED CT or LOINC, or a ChainTerminologyService that tries
+// the loaded definitions first. The default is a LocalTerminologyService over the spec.
+func WithTerminologyService(service TerminologyService) Option {
+	return func(o *validatorOptions) {
+		o.terminology = service
+	}
+}
+
+// WithUnknownSystemSeverity sets the severity ("error", "warning" or "information") of
+// the issue reported when a required or extensible binding cannot be checked because the
+// terminology service does not know its code system or value set. The default is "warning".
+func WithUnknownSystemSeverity(severity string) Option {
+	return func(o *validatorOptions) {
+		o.unknownSystem = severity
+	}
+}
+
+// WithUnknownExtensionSeverity sets the severity ("error", "warning" or "information") of
+// the issue reported for an extension whose definition is not loaded. The default is
+// "warning"; an unknown modifierExtension is always an error.
+func WithUnknownExtensionSeverity(severity string) Option {
+	return func(o *validatorOptions) {
+		o.unknownExtension = severity
+	}
+}
+
+// WithSkippedConstraints replaces DefaultSkippedConstraints with keys. Call it with
+// no keys to evaluate every constraint.
+func WithSkippedConstraints(keys ...string) Option {
+	return func(o *validatorOptions) {
+		o.skippedConstraints = append([]string{}, keys...)
+	}
+}
+
+// WithDebugDump writes the constraint payload of every validation to w as indented
+// JSON before it is evaluated. Writes from concurrent validations are serialized.
+func WithDebugDump(w io.Writer) Option {
+	return func(o *validatorOptions) {
+		o.debugDump = w
+	}
+}
@@ -0,0 +1,147 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+// recordingEngine is a FhirPathEngine that records the constraint keys it is asked to
+// evaluate and reports the constraints in failed as not holding.
+type recordingEngine struct {
+	keys   []string
+	failed []string
+}
+
+func (e *recordingEngine) Evaluate(_ context.Context, payload []*FhirPathPayload) (*FhirPathResponse, error) {
+	response := &FhirPathResponse{}
+	for _, p := range payload {
+		e.keys = append(e.keys, p.ConstraintKey)
+		response.Results = append(response.Results, ValidationResult{
+			Result:   !contains(e.failed, p.ConstraintKey),
+			Key:      p.ConstraintKey,
+			Path:     p.Path,
+			Severity: p.ConstraintSeverity,
+		})
+	}
+	return response, nil
+}
+
+const contactPatient = `{"resourceType": "Patient", "contact": [{"name": {"family": "Doe"}}]}`
+
+func TestWithSkippedConstraints(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		evaluated []string
+		skipped   []string
+	}{
+		{"default", nil, []string{"pat-1", "dom-2"}, DefaultSkippedConstraints},
+		{"replaced", []Option{WithSkippedConstraints("pat-1")}, []string{"ele-1", "dom-2"}, []string{"pat-1"}},
+		{"none", []Option{WithSkippedConstraints()}, []string{"pat-1", "ele-1", "dom-2"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &recordingEngine{}
+			v, err := New(append([]Option{WithSpec(newTestValidator(t).spec), WithFHIRPathEngine(engine)}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := v.Validate(context.Background(), decodeResource(t, contactPatient)); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range tt.evaluated {
+				if !contains(engine.keys, key) {
+					t.Errorf("constraint %s was not evaluated: %v", key, engine.keys)
+				}
+			}
+			for _, key := range tt.skipped {
+				if contains(engine.keys, key) {
+					t.Errorf("constraint %s was evaluated: %v", key, engine.keys)
+				}
+			}
+		})
+	}
+}
+
+func TestWithDebugDump(t *testing.T) {
+	var dump bytes.Buffer
+	v, err := New(WithSpec(newTestValidator(t).spec), WithFHIRPathEngine(&recordingEngine{}), WithDebugDump(&dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Validate(context.Background(), decodeResource(t, contactPatient)); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload []*FhirPathPayload
+	if err := json.Unmarshal(dump.Bytes(), &payload); err != nil {
+		t.Fatalf("the dump is not the JSON payload: %v\n%s", err, dump.String())
+	}
+	for _, p := range payload {
+		if p.ConstraintKey == "pat-1" && p.ParentPath == "Patient.contact[0]" {
+			return
+		}
+	}
+	t.Errorf("pat-1 of Patient.contact[0] is not in the dump:\n%s", dump.String())
+}
+
+func TestWithFHIRPathEngine(t *testing.T) {
+	engine := &recordingEngine{failed: []string{"pat-1"}}
+	v, err := New(WithSpec(newTestValidator(t).spec), WithFHIRPathEngine(engine))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The contact has a name, so only the engine makes pat-1 fail.
+	assertIssues(t, validate(t, v, contactPatient), "Failed constraint 'pat-1'")
+	if len(engine.keys) == 0 {
+		t.Error("the engine was not used")
+	}
+}
+
+func TestWithSpecFS(t *testing.T) {
+	profile := mustJSON(t, testProfile("spec-fs-patient", "http://example.org/StructureDefinition/spec-fs-patient"))
+	v, err := New(WithSpecFS(fhirspec.FS, fstest.MapFS{"profile.json": {Data: profile}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := v.spec.StructureDefinitionByURL("http://example.org/StructureDefinition/spec-fs-patient"); !ok {
+		t.Error("the definition of the file system was not loaded")
+	}
+	if v.spec == newTestValidator(t).spec {
+		t.Error("the shared spec was used")
+	}
+	if _, ok := newTestValidator(t).spec.StructureDefinitionByURL("http://example.org/StructureDefinition/spec-fs-patient"); ok {
+		t.Error("the definition was added to the shared spec")
+	}
+}
+
+func TestNewInvalidSeverity(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+		want string
+	}{
+		{"unknown system", WithUnknownSystemSeverity("fatal"), "invalid unknown system severity 'fatal'"},
+		{"unknown extension", WithUnknownExtensionSeverity("Warning"), "invalid unknown extension severity 'Warning'"},
+		{"empty", WithUnknownSystemSeverity(""), "invalid unknown system severity ''"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(WithSpec(newTestValidator(t).spec), tt.opt)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
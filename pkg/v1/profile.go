@@ -0,0 +1,152 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// StructureDefinitionByURL returns the StructureDefinition with the given canonical URL,
+// optionally followed by "|version".
+func (l *LibraryData) StructureDefinitionByURL(canonical string) (StructureDefinition, bool) {
+	l.urlMu.RLock()
+	index := l.urlIndex
+	l.urlMu.RUnlock()
+
+	if index == nil {
+		l.urlMu.Lock()
+		if l.urlIndex == nil {
+			l.urlIndex = l.buildURLIndex()
+		}
+		index = l.urlIndex
+		l.urlMu.Unlock()
+	}
+
+	if structureDef, ok := index[canonical]; ok {
+		return structureDef, true
+	}
+
+	// A versioned canonical matches a definition that does not declare a version.
+	if url, _, found := strings.Cut(canonical, "|"); found {
+		if structureDef, ok := index[url]; ok && structureDef.Version == "" {
+			return structureDef, true
+		}
+	}
+
+	return StructureDefinition{}, false
+}
+
+// resetURLIndex drops the URL index, so the next StructureDefinitionByURL call indexes
+// the definitions added since it was built.
+func (l *LibraryData) resetURLIndex() {
+	l.urlMu.Lock()
+	l.urlIndex = nil
+	l.urlMu.Unlock()
+}
+
+// buildURLIndex indexes the StructureDefinitions by url and by url|version.
+func (l *LibraryData) buildURLIndex() map[string]StructureDefinition {
+	urlIndex := make(map[string]StructureDefinition)
+
+	for _, value := range l.Config {
+		structureDef, ok := value.(StructureDefinition)
+		if !ok || structureDef.URL == "" {
+			continue
+		}
+
+		urlIndex[structureDef.URL] = structureDef
+		if structureDef.Version != "" {
+			urlIndex[structureDef.URL+"|"+structureDef.Version] = structureDef
+		}
+	}
+
+	return urlIndex
+}
+
+// ValidateAgainstProfile validates resource against the profile with the given canonical
+// URL, using the spec loaded by LoadData and the engine set with SetFhirPathEngine.
+func ValidateAgainstProfile(resource map[string]interface{}, canonicalURL string) (*OperationOutcome, error) {
+	spec, err := GetSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := New(WithSpec(spec), WithFHIRPathEngine(getFhirPathEngine()))
+	if err != nil {
+		return nil, err
+	}
+
+	return validator.ValidateAgainstProfile(context.Background(), resource, canonicalURL)
+}
+
+// ValidateAgainstProfile validates resource against the profile with the given canonical
+// URL only, ignoring meta.profile. Unlike a profile declared in meta.profile, an unknown
+// profile is an error.
+func (v *Validator) ValidateAgainstProfile(ctx context.Context, resource map[string]interface{}, canonicalURL string) (*OperationOutcome, error) {
+	if canonicalURL == "" {
+		return nil, fmt.Errorf("profile canonical URL is empty")
+	}
+
+	return v.validate(ctx, resource, canonicalURL)
+}
+
+// declaredProfiles returns the known profiles of meta.profile that have to be validated
+// besides the base definition, reporting the ones that cannot be used.
+func (c *validation) declaredProfiles(data map[string]interface{}, resourceType string, outcome *OperationOutcome) []StructureDefinition {
+	meta, _ := data["meta"].(map[string]interface{})
+	profiles, _ := meta["profile"].([]interface{})
+
+	baseURL := "http://hl7.org/fhir/StructureDefinition/" + resourceType
+	structures := make([]StructureDefinition, 0, len(profiles))
+
+	for i, item := range profiles {
+		canonical, ok := item.(string)
+		if !ok {
+			continue // reported by the structural validation of meta
+		}
+
+		location := fmt.Sprintf("%s.meta.profile[%d]", resourceType, i)
+		if url, _, _ := strings.Cut(canonical, "|"); url == baseURL {
+			continue // always validated
+		}
+
+		profile, ok := c.spec.StructureDefinitionByURL(canonical)
+		if !ok {
+			addOperationOutcome(outcome, "not-found", fmt.Sprintf("Profile '%s' is not known; the resource was not validated against it", canonical), location, "Unknown profile", "warning")
+			continue
+		}
+
+		if profile.Type != resourceType {
+			addOperationOutcome(outcome, "invalid", fmt.Sprintf("Profile '%s' constrains %s, not %s", canonical, profile.Type, resourceType), location, "Profile does not apply to the resource type", "error")
+			continue
+		}
+
+		structures = append(structures, profile)
+	}
+
+	return structures
+}
+
+// mergeProfileOutcome adds the issues found validating against a profile, skipping the
+// ones already reported, e.g. by the base definition the profile inherits from.
+func mergeProfileOutcome(outcome *OperationOutcome, profileOutcome *OperationOutcome, profileURL string) {
+	seen := make(map[string]bool, len(outcome.Issue))
+	for _, issue := range outcome.Issue {
+		seen[issueKey(issue)] = true
+	}
+
+	for _, issue := range profileOutcome.Issue {
+		key := issueKey(issue)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		issue.Diagnostics = fmt.Sprintf("%s (profile: %s)", issue.Diagnostics, profileURL)
+		outcome.Issue = append(outcome.Issue, issue)
+	}
+}
+
+func issueKey(issue IssueEntry) string {
+	return strings.Join([]string{issue.Severity, issue.Code, issue.Diagnostics, strings.Join(issue.Expression, ",")}, "|")
+}
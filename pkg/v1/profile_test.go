@@ -0,0 +1,190 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+// birthDateProfile is a differential-only Patient profile that requires birthDate.
+func birthDateProfile() map[string]interface{} {
+	profile := testProfile("birthdate-patient", "http://example.org/StructureDefinition/birthdate-patient")
+	profile["differential"] = map[string]interface{}{
+		"element": []interface{}{
+			map[string]interface{}{"id": "Patient.birthDate", "path": "Patient.birthDate", "min": 1},
+		},
+	}
+	return profile
+}
+
+func TestStructureDefinitionByURL(t *testing.T) {
+	library := &LibraryData{Config: map[string]interface{}{
+		"versioned":   StructureDefinition{ID: "versioned", URL: "http://example.org/versioned", Version: "1.0.0"},
+		"unversioned": StructureDefinition{ID: "unversioned", URL: "http://example.org/unversioned"},
+	}}
+
+	tests := []struct {
+		canonical string
+		wantID    string
+	}{
+		{"http://example.org/versioned", "versioned"},
+		{"http://example.org/versioned|1.0.0", "versioned"},
+		{"http://example.org/versioned|2.0.0", ""},
+		{"http://example.org/unversioned", "unversioned"},
+		{"http://example.org/unversioned|3.1", "unversioned"},
+		{"http://example.org/missing", ""},
+	}
+	for _, tt := range tests {
+		structureDef, ok := library.StructureDefinitionByURL(tt.canonical)
+		if ok != (tt.wantID != "") || structureDef.ID != tt.wantID {
+			t.Errorf("StructureDefinitionByURL(%q) = %q, %v, want %q", tt.canonical, structureDef.ID, ok, tt.wantID)
+		}
+	}
+}
+
+func TestDeclaredProfiles(t *testing.T) {
+	dir := writePackageDir(t, t.TempDir(), testPackageFiles(t, "example.fhir", "1.0.0", nil, map[string]interface{}{
+		"StructureDefinition-birthdate-patient.json": birthDateProfile(),
+	}))
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := library.LoadPackage(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &validation{spec: library}
+	outcome := &OperationOutcome{}
+	structures := c.declaredProfiles(decodeResource(t, `{
+		"resourceType": "Patient",
+		"meta": {"profile": [
+			"http://hl7.org/fhir/StructureDefinition/Patient",
+			"http://example.org/StructureDefinition/birthdate-patient",
+			"http://example.org/StructureDefinition/unknown",
+			"http://hl7.org/fhir/StructureDefinition/Practitioner"
+		]}
+	}`), "Patient", outcome)
+
+	if len(structures) != 1 || structures[0].URL != "http://example.org/StructureDefinition/birthdate-patient" {
+		t.Errorf("got profiles %+v, want only birthdate-patient", structures)
+	}
+
+	var got []string
+	for _, issue := range outcome.Issue {
+		got = append(got, issue.Severity+": "+issue.Diagnostics)
+	}
+	assertIssues(t, got,
+		"warning: Profile 'http://example.org/StructureDefinition/unknown' is not known",
+		"error: Profile 'http://hl7.org/fhir/StructureDefinition/Practitioner' constrains Practitioner, not Patient",
+	)
+}
+
+func TestLoadPackageAfterValidation(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(WithSpec(library))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Looking the profile up builds the URL index without it.
+	const url = "http://example.org/StructureDefinition/birthdate-patient"
+	if _, err := v.ValidateAgainstProfile(context.Background(), decodeResource(t, `{"resourceType": "Patient"}`), url); err == nil {
+		t.Fatal("profile found before loading its package")
+	}
+
+	dir := writePackageDir(t, filepath.Join(t.TempDir(), "example.fhir#1.0.0"), testPackageFiles(t, "example.fhir", "1.0.0", nil, map[string]interface{}{
+		"StructureDefinition-birthdate-patient.json": birthDateProfile(),
+	}))
+	if err := library.LoadPackage(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.ValidateAgainstProfile(context.Background(), decodeResource(t, `{"resourceType": "Patient"}`), url); err != nil {
+		t.Errorf("profile not found after loading its package: %v", err)
+	}
+}
+
+func TestValidateAgainstProfile(t *testing.T) {
+	dir := writePackageDir(t, t.TempDir(), testPackageFiles(t, "example.fhir", "1.0.0", nil, map[string]interface{}{
+		"StructureDefinition-birthdate-patient.json": birthDateProfile(),
+	}))
+	v, err := New(WithPackage(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := v.ValidateAgainstProfile(context.Background(), decodeResource(t, `{"resourceType": "Patient"}`), "http://example.org/StructureDefinition/birthdate-patient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, issue := range outcome.Issue {
+		if issue.Diagnostics == "Field 'Patient.birthDate' is required" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("missing birthDate not reported: %+v", outcome.Issue)
+	}
+
+	if _, err := v.ValidateAgainstProfile(context.Background(), decodeResource(t, `{"resourceType": "Patient"}`), "http://example.org/StructureDefinition/unknown"); err == nil {
+		t.Error("no error for an unknown profile")
+	}
+	if _, err := v.ValidateAgainstProfile(context.Background(), decodeResource(t, `{"resourceType": "Practitioner"}`), "http://example.org/StructureDefinition/birthdate-patient"); err == nil {
+		t.Error("no error for a profile of another resource type")
+	}
+}
+
+// testDifferentialProfile is a Patient profile with the given differential elements, as JSON.
+func testDifferentialProfile(t *testing.T, id, elements string) map[string]interface{} {
+	t.Helper()
+	profile := testProfile(id, "http://example.org/StructureDefinition/"+id)
+	var differential []interface{}
+	if err := json.Unmarshal([]byte(elements), &differential); err != nil {
+		t.Fatal(err)
+	}
+	profile["differential"] = map[string]interface{}{"element": differential}
+	return profile
+}
+
+// newProfileValidator returns a Validator with the embedded spec and the given profiles.
+func newProfileValidator(t *testing.T, profiles ...map[string]interface{}) *Validator {
+	t.Helper()
+	files := make(map[string]interface{}, len(profiles))
+	for _, profile := range profiles {
+		files["StructureDefinition-"+profile["id"].(string)+".json"] = profile
+	}
+	dir := writePackageDir(t, t.TempDir(), testPackageFiles(t, "example.fhir", "1.0.0", nil, files))
+
+	v, err := New(WithPackage(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// validateAgainst validates a resource against a profile only, and returns its issues
+// like validate.
+func validateAgainst(t *testing.T, v *Validator, profileURL, source string) []string {
+	t.Helper()
+	outcome, err := v.ValidateAgainstProfile(context.Background(), decodeResource(t, source), profileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var diagnostics []string
+	for _, issue := range outcome.Issue {
+		if strings.Contains(issue.Diagnostics, "'dom-6'") || issue.Code == "information" {
+			continue
+		}
+		diagnostics = append(diagnostics, issue.Severity+": "+issue.Diagnostics)
+	}
+	return diagnostics
+}
@@ -0,0 +1,544 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
+
+// slicesOf returns the slices that spec defines on element, e.g. Patient.identifier:mrn.
+// Reslices (identifier:mrn/old) are not included.
+func slicesOf(element Element, spec StructureDefinition) []Element {
+	if element.Slicing == nil {
+		return nil
+	}
+
+	var slices []Element
+	for _, candidate := range spec.Snapshot.Element {
+		if candidate.SliceName != "" && candidate.Path == element.Path && candidate.ID == element.ID+":"+candidate.SliceName {
+			slices = append(slices, candidate)
+		}
+	}
+	return slices
+}
+
+// assignSlices matches the items of a sliced array to the slices of element with the
+// discriminators of its slicing. Items that match no slice are reported according to the
+// slicing rules, and so are items out of order in an ordered slicing and slices with too
+// few or too many items. It returns, for each item, the slice it belongs to or nil.
+func (c *validation) assignSlices(rootData map[string]interface{}, array []interface{}, element Element, fullPath string, rootSpec, spec StructureDefinition, outcome *OperationOutcome) []*Element {
+	slices := slicesOf(element, spec)
+	if len(slices) == 0 {
+		return nil
+	}
+
+	slicing := element.Slicing
+	for _, discriminator := range slicing.Discriminator {
+		if _, err := discriminatorPath(discriminator.Path); err != nil {
+			addOperationOutcome(outcome, "not-supported", fmt.Sprintf("Discriminator '%s' of '%s' is not supported (%s); its items were not checked against the slices", discriminator.Path, fullPath, err), fullPath, "Unsupported discriminator", "warning")
+			return nil
+		}
+	}
+
+	assigned := make([]*Element, len(array))
+	counts := make([]int, len(slices))
+	lastSlice := -1
+	unmatched := false
+
+	for i, item := range array {
+		itemPath := fmt.Sprintf("%s[%d]", fullPath, i)
+
+		index := -1
+		for s := range slices {
+			if c.matchesSlice(rootData, item, slices[s], slicing.Discriminator, itemPath, rootSpec, spec) {
+				index = s
+				break
+			}
+		}
+
+		if index < 0 {
+			unmatched = true
+			severity := "information"
+			if slicing.Rules == "closed" {
+				severity = "error"
+			}
+			addOperationOutcome(outcome, "structure", fmt.Sprintf("Item '%s' does not match any slice of '%s' (rules: %s). Slices tried: %s", itemPath, fullPath, slicingRules(slicing), sliceNames(slices)), itemPath, "Item matches no slice", severity)
+			continue
+		}
+
+		if slicing.Rules == "openAtEnd" && unmatched {
+			addOperationOutcome(outcome, "structure", fmt.Sprintf("Item '%s' matches slice '%s' after items that match no slice; the slicing of '%s' is openAtEnd", itemPath, slices[index].SliceName, fullPath), itemPath, "Slice after open items", "error")
+		}
+		if slicing.Ordered && index < lastSlice {
+			addOperationOutcome(outcome, "structure", fmt.Sprintf("Item '%s' of slice '%s' is out of order: the slices of '%s' are ordered (%s)", itemPath, slices[index].SliceName, fullPath, sliceNames(slices)), itemPath, "Slice out of order", "error")
+		}
+		lastSlice = max(lastSlice, index)
+
+		counts[index]++
+		assigned[i] = &slices[index]
+	}
+
+	validateSliceCardinality(slices, counts, fullPath, outcome)
+	return assigned
+}
+
+// validateSliceCardinality checks the number of items of each slice against its min and max.
+func validateSliceCardinality(slices []Element, counts []int, fullPath string, outcome *OperationOutcome) {
+	for s, slice := range slices {
+		if counts[s] < slice.Min {
+			addOperationOutcome(outcome, "required", fmt.Sprintf("Slice '%s' of '%s' has too few items: minimum is %d. Found %d elements", slice.SliceName, fullPath, slice.Min, counts[s]), fullPath, "Slice has too few items", "error")
+		}
+
+		maxItems, isUnlimited := ParseMaxItems(slice.Max)
+		if !isUnlimited && counts[s] > maxItems {
+			addOperationOutcome(outcome, "invalid", fmt.Sprintf("Slice '%s' of '%s' has too many items: maximum is %d. Found %d elements", slice.SliceName, fullPath, maxItems, counts[s]), fullPath, "Slice has too many items", "error")
+		}
+	}
+}
+
+// matchesSlice reports whether item belongs to slice. Every discriminator has to match;
+// without discriminators the item has to be valid against the slice.
+func (c *validation) matchesSlice(rootData map[string]interface{}, item interface{}, slice Element, discriminators []Discriminator, itemPath string, rootSpec, spec StructureDefinition) bool {
+	if len(discriminators) == 0 {
+		return c.conforms(func(probe *validation, outcome *OperationOutcome) {
+			probe.ValidateValue(rootData, item, slice, itemPath, rootSpec, spec, outcome)
+		})
+	}
+
+	for _, discriminator := range discriminators {
+		path, _ := discriminatorPath(discriminator.Path) // checked by assignSlices
+		values := valuesAt(rootData, item, path)
+		sub := sliceChild(slice, path, spec)
+
+		var matched bool
+		switch discriminator.Type {
+		case "value", "pattern":
+			matched = matchesValue(values, slice, sub, path, discriminator.Type)
+		case "exists":
+			matched = matchesExists(values, sub)
+		case "type":
+			matched = c.matchesType(rootData, item, path, sub)
+		case "profile":
+			matched = c.matchesProfile(rootData, values, sub, path, itemPath)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesValue compares the values at the discriminator path with the fixed[x] or
+// pattern[x] of the slice. An extension slice is discriminated by url even when only its
+// type names the extension definition.
+func matchesValue(values []interface{}, slice Element, sub *Element, path []string, discriminatorType string) bool {
+	var fixed, pattern *TypedValue
+	if sub != nil {
+		fixed, pattern = sub.Fixed, sub.Pattern
+	}
+	if fixed == nil && pattern == nil && len(path) == 1 && path[0] == "url" {
+		if profile := typeProfile(slice); profile != "" {
+			fixed = &TypedValue{Type: "uri", Value: profile}
+		}
+	}
+
+	for _, value := range values {
+		if fixed != nil && (discriminatorType == "value" || pattern == nil) && matchesFixed(value, fixed.Value) {
+			return true
+		}
+		if pattern != nil && matchesPattern(value, pattern.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesExists checks the presence of the values at the discriminator path against the
+// cardinality the slice gives to that path.
+func matchesExists(values []interface{}, sub *Element) bool {
+	if sub == nil {
+		return false
+	}
+	if sub.Max == "0" {
+		return len(values) == 0
+	}
+	if sub.Min > 0 {
+		return len(values) > 0
+	}
+	return true
+}
+
+// matchesType checks the type of the value at the discriminator path: the resourceType of
+// a resource, of a resolved reference, or the type in the property name of a choice element.
+func (c *validation) matchesType(rootData map[string]interface{}, item interface{}, path []string, sub *Element) bool {
+	if sub == nil {
+		return false
+	}
+
+	types := sub.Type
+	if resolvesReference(path) {
+		types = c.targetTypes(*sub)
+	}
+	for _, value := range valuesAt(rootData, item, path) {
+		if resource, ok := value.(map[string]interface{}); ok {
+			if resourceType, ok := resource["resourceType"].(string); ok && hasType(types, resourceType) {
+				return true
+			}
+		}
+	}
+	if resolvesReference(path) {
+		return false
+	}
+
+	// value[x]: the property name gives the type
+	if len(path) == 0 {
+		return false
+	}
+	name := path[len(path)-1]
+	for _, parent := range valuesAt(rootData, item, path[:len(path)-1]) {
+		object, ok := parent.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key := range object {
+			if typeCode, ok := fhirpath.ChoiceTypeSuffix(name, key); ok && hasType(sub.Type, typeCode) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesProfile reports whether a value at the discriminator path conforms to one of the
+// profiles of the slice types, or to one of their target profiles for a resolved reference.
+// Only the structure is checked; constraints are not evaluated.
+func (c *validation) matchesProfile(rootData map[string]interface{}, values []interface{}, sub *Element, path []string, itemPath string) bool {
+	if sub == nil {
+		return false
+	}
+
+	for _, t := range sub.Type {
+		profiles := t.Profile
+		if resolvesReference(path) {
+			profiles = t.TargetProfile
+		}
+		for _, url := range profiles {
+			profile, ok := c.spec.StructureDefinitionByURL(url)
+			if !ok {
+				continue
+			}
+			profile, err := c.spec.withSnapshot(profile)
+			if err != nil {
+				continue
+			}
+
+			for _, value := range values {
+				object, ok := value.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if c.conforms(func(probe *validation, outcome *OperationOutcome) {
+					probe.Validate(rootData, object, profile, profile, itemPath, outcome)
+				}) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// conforms runs check with a copy of the validation that keeps its own constraints and
+// reports whether it found no error.
+func (c *validation) conforms(check func(probe *validation, outcome *OperationOutcome)) bool {
+	probe := *c
+	probe.payload = nil
+	probe.payloadSet = make(map[string]bool)
+
+	outcome := &OperationOutcome{ResourceType: "OperationOutcome"}
+	check(&probe, outcome)
+
+	for _, issue := range outcome.Issue {
+		if issue.Severity == "error" || issue.Severity == "fatal" {
+			return false
+		}
+	}
+	return true
+}
+
+// discriminatorPath splits a discriminator path into its steps; $this is the item itself.
+// Besides element names it supports extension('url'), ofType(X) and as(X) after a choice
+// element, and a final resolve() of a reference.
+func discriminatorPath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$this"), ".")
+	if path == "" {
+		return nil, nil
+	}
+
+	var steps []string
+	start, quoted := 0, false
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) && path[i] == '\'' {
+			quoted = !quoted
+		}
+		if i < len(path) && (path[i] != '.' || quoted) {
+			continue
+		}
+
+		step := path[start:i]
+		start = i + 1
+		if typeCode, ok := strings.CutPrefix(step, "as("); ok {
+			step = "ofType(" + typeCode // the same for a discriminator
+		}
+
+		switch {
+		case len(steps) > 0 && steps[len(steps)-1] == "resolve()":
+			return nil, fmt.Errorf("only a final resolve() is supported")
+		case step == "resolve()":
+		case strings.HasPrefix(step, "ofType(") && strings.HasSuffix(step, ")"):
+		case isExtensionStep(step):
+		case step == "" || strings.ContainsAny(step, "()' "):
+			return nil, fmt.Errorf("'%s' is not an element name or a supported function", step)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// extensionStep returns the element and url of a step such as extension('url').
+func extensionStep(step string) (string, string, bool) {
+	for _, name := range []string{"extension", "modifierExtension"} {
+		if url, ok := strings.CutPrefix(step, name+"('"); ok {
+			if url, ok := strings.CutSuffix(url, "')"); ok {
+				return name, url, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func isExtensionStep(step string) bool {
+	_, _, ok := extensionStep(step)
+	return ok
+}
+
+// ofTypeStep returns the type of a step such as ofType(Quantity).
+func ofTypeStep(step string) (string, bool) {
+	if typeCode, ok := strings.CutPrefix(step, "ofType("); ok {
+		return strings.TrimSuffix(typeCode, ")"), true
+	}
+	return "", false
+}
+
+// resolvesReference reports whether path ends with resolve().
+func resolvesReference(path []string) bool {
+	return len(path) > 0 && path[len(path)-1] == "resolve()"
+}
+
+// valuesAt returns the values found at path in value, going through arrays. References are
+// resolved to the resources contained in rootData or, for a Bundle, to its entries.
+func valuesAt(rootData map[string]interface{}, value interface{}, path []string) []interface{} {
+	values := []interface{}{value}
+	for i := 0; i < len(path); i++ {
+		segment := path[i]
+
+		// value.ofType(Quantity) is valueQuantity
+		choiceType := ""
+		if i+1 < len(path) {
+			if typeCode, ok := ofTypeStep(path[i+1]); ok {
+				choiceType = typeCode
+				i++
+			}
+		}
+
+		var next []interface{}
+		for _, v := range values {
+			object, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if segment == "resolve()" {
+				if reference, ok := object["reference"].(string); ok {
+					if resource := resolveReference(rootData, reference); resource != nil {
+						next = append(next, resource)
+					}
+				}
+				continue
+			}
+
+			if typeCode, ok := ofTypeStep(segment); ok {
+				// only resources carry their type
+				if resourceType, ok := object["resourceType"].(string); !ok || resourceType == typeCode {
+					next = append(next, object)
+				}
+				continue
+			}
+
+			if name, url, ok := extensionStep(segment); ok {
+				extensions, _ := object[name].([]interface{})
+				for _, extension := range extensions {
+					if extension, ok := extension.(map[string]interface{}); ok && extension["url"] == url {
+						next = append(next, extension)
+					}
+				}
+				continue
+			}
+
+			child, found := object[segment]
+			if choiceType != "" {
+				child, found = object[segment+fhirpath.UpperFirst(choiceType)]
+			} else if !found {
+				// value for valueQuantity, valueString...
+				for key, candidate := range object {
+					if _, ok := fhirpath.ChoiceTypeSuffix(segment, key); ok {
+						child, found = candidate, true
+						break
+					}
+				}
+			}
+			if !found {
+				continue
+			}
+
+			if array, ok := child.([]interface{}); ok {
+				next = append(next, array...)
+			} else {
+				next = append(next, child)
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+// resolveReference returns the resource of rootData that reference points to: a contained
+// resource (#id) or the resource of a Bundle entry, by fullUrl or by type and id.
+func resolveReference(rootData map[string]interface{}, reference string) map[string]interface{} {
+	if id, ok := strings.CutPrefix(reference, "#"); ok {
+		contained, _ := rootData["contained"].([]interface{})
+		for _, resource := range contained {
+			if resource, ok := resource.(map[string]interface{}); ok && resource["id"] == id {
+				return resource
+			}
+		}
+		return nil
+	}
+
+	entries, _ := rootData["entry"].([]interface{})
+	for _, entry := range entries {
+		entry, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		resource, ok := entry["resource"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fullURL, _ := entry["fullUrl"].(string)
+		resourceType, _ := resource["resourceType"].(string)
+		id, _ := resource["id"].(string)
+		if fullURL == reference || reference == resourceType+"/"+id || strings.HasSuffix(fullURL, "/"+reference) {
+			return resource
+		}
+	}
+	return nil
+}
+
+// targetTypes returns the resource types that the target profiles of a reference element
+// allow.
+func (c *validation) targetTypes(element Element) []Type {
+	var types []Type
+	for _, t := range element.Type {
+		for _, url := range t.TargetProfile {
+			if profile, ok := c.spec.StructureDefinitionByURL(url); ok {
+				types = append(types, Type{Code: profile.Type})
+			} else if typeCode, ok := strings.CutPrefix(url, "http://hl7.org/fhir/StructureDefinition/"); ok {
+				types = append(types, Type{Code: typeCode})
+			}
+		}
+	}
+	return types
+}
+
+// sliceChild returns the element of slice at path, e.g. Patient.identifier:mrn.system for
+// system, or the slice itself for an empty path. A final resolve() or ofType(X) gives the
+// element they apply to.
+func sliceChild(slice Element, path []string, spec StructureDefinition) *Element {
+	element := &slice
+	for i := 0; i < len(path); i++ {
+		segment := path[i]
+		if _, ok := ofTypeStep(segment); ok || segment == "resolve()" {
+			continue
+		}
+
+		var ids []string
+		if name, url, ok := extensionStep(segment); ok {
+			// the extension slice whose type is the extension definition
+			for j := range spec.Snapshot.Element {
+				candidate := spec.Snapshot.Element[j]
+				if sliceName, ok := strings.CutPrefix(candidate.ID, element.ID+"."+name+":"); ok && !strings.Contains(sliceName, ".") && typeProfile(candidate) == url {
+					ids = append(ids, candidate.ID)
+				}
+			}
+		} else if i+1 < len(path) && strings.HasPrefix(path[i+1], "ofType(") {
+			typeCode, _ := ofTypeStep(path[i+1])
+			choiceID := element.ID + "." + segment + "[x]"
+			ids = append(ids, choiceID+":"+segment+fhirpath.UpperFirst(typeCode), choiceID)
+			i++
+		} else {
+			ids = append(ids, element.ID+"."+segment, element.ID+"."+segment+"[x]")
+		}
+
+		element = findElementIn(spec, ids)
+		if element == nil {
+			return nil
+		}
+	}
+	return element
+}
+
+// findElementIn returns the first element of spec with one of ids.
+func findElementIn(spec StructureDefinition, ids []string) *Element {
+	for _, id := range ids {
+		if index := findElementByID(spec.Snapshot.Element, id); index >= 0 {
+			return &spec.Snapshot.Element[index]
+		}
+	}
+	return nil
+}
+
+// typeProfile returns the first profile of the types of element.
+func typeProfile(element Element) string {
+	for _, t := range element.Type {
+		if len(t.Profile) > 0 {
+			return t.Profile[0]
+		}
+	}
+	return ""
+}
+
+func hasType(types []Type, code string) bool {
+	for _, t := range types {
+		if t.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func slicingRules(slicing *Slicing) string {
+	if slicing.Rules == "" {
+		return "open"
+	}
+	return slicing.Rules
+}
+
+func sliceNames(slices []Element) string {
+	names := make([]string, 0, len(slices))
+	for _, slice := range slices {
+		names = append(names, slice.SliceName)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,199 @@
+package v1
+
+import "testing"
+
+const identifierSlicingProfile = "http://example.org/StructureDefinition/identifier-slicing"
+
+// identifierSlicing slices Patient.identifier by system into mrn (1..1) and ssn (0..1).
+func identifierSlicing(t *testing.T, rules string, ordered bool) map[string]interface{} {
+	orderedJSON := "false"
+	if ordered {
+		orderedJSON = "true"
+	}
+	return testDifferentialProfile(t, "identifier-slicing", `[
+		{"id": "Patient.identifier", "path": "Patient.identifier", "slicing": {"discriminator": [{"type": "value", "path": "system"}], "ordered": `+orderedJSON+`, "rules": "`+rules+`"}},
+		{"id": "Patient.identifier:mrn", "path": "Patient.identifier", "sliceName": "mrn", "min": 1, "max": "1"},
+		{"id": "Patient.identifier:mrn.system", "path": "Patient.identifier.system", "min": 1, "fixedUri": "http://example.org/mrn"},
+		{"id": "Patient.identifier:mrn.value", "path": "Patient.identifier.value", "min": 1},
+		{"id": "Patient.identifier:ssn", "path": "Patient.identifier", "sliceName": "ssn", "max": "1"},
+		{"id": "Patient.identifier:ssn.system", "path": "Patient.identifier.system", "min": 1, "fixedUri": "http://example.org/ssn"}
+	]`)
+}
+
+func TestValidateSlicing(t *testing.T) {
+	const (
+		mrn   = `{"system": "http://example.org/mrn", "value": "123"}`
+		ssn   = `{"system": "http://example.org/ssn", "value": "456"}`
+		other = `{"system": "http://example.org/other", "value": "789"}`
+	)
+
+	tests := []struct {
+		name        string
+		rules       string
+		ordered     bool
+		identifiers string
+		want        []string
+	}{
+		{"slices matched", "open", false, mrn + "," + ssn, nil},
+		{"open slicing accepts other items", "open", false, mrn + "," + other, []string{
+			"information: Item 'Patient.identifier[1]' does not match any slice of 'Patient.identifier' (rules: open)",
+		}},
+		{"closed slicing rejects other items", "closed", false, mrn + "," + other, []string{
+			"error: Item 'Patient.identifier[1]' does not match any slice of 'Patient.identifier' (rules: closed). Slices tried: mrn, ssn",
+		}},
+		{"missing required slice", "open", false, ssn, []string{
+			"error: Slice 'mrn' of 'Patient.identifier' has too few items: minimum is 1. Found 0 elements",
+		}},
+		{"too many items in a slice", "open", false, mrn + "," + mrn, []string{
+			"error: Slice 'mrn' of 'Patient.identifier' has too many items: maximum is 1. Found 2 elements",
+		}},
+		{"slice constraints apply to its items", "open", false, `{"system": "http://example.org/mrn"}`, []string{
+			"error: Field 'Patient.identifier[0].value' is required",
+		}},
+		{"ordered slices", "open", true, ssn + "," + mrn, []string{
+			"error: Item 'Patient.identifier[1]' of slice 'mrn' is out of order: the slices of 'Patient.identifier' are ordered (mrn, ssn)",
+		}},
+		{"openAtEnd slicing", "openAtEnd", false, other + "," + mrn, []string{
+			"information: Item 'Patient.identifier[0]' does not match any slice of 'Patient.identifier' (rules: openAtEnd)",
+			"error: Item 'Patient.identifier[1]' matches slice 'mrn' after items that match no slice; the slicing of 'Patient.identifier' is openAtEnd",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newProfileValidator(t, identifierSlicing(t, tt.rules, tt.ordered))
+			got := validateAgainst(t, v, identifierSlicingProfile, `{"resourceType": "Patient", "identifier": [`+tt.identifiers+`]}`)
+			assertIssues(t, got, tt.want...)
+		})
+	}
+}
+
+const dateExtensionURL = "http://example.org/StructureDefinition/date-extension"
+
+// dateExtension is an extension with a dateTime value that may be used on any element or resource.
+func dateExtension() map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType":   "StructureDefinition",
+		"id":             "date-extension",
+		"url":            dateExtensionURL,
+		"name":           "DateExtension",
+		"kind":           "complex-type",
+		"type":           "Extension",
+		"baseDefinition": "http://hl7.org/fhir/StructureDefinition/Extension",
+		"derivation":     "constraint",
+		"context": []interface{}{
+			map[string]interface{}{"type": "element", "expression": "Element"},
+			map[string]interface{}{"type": "element", "expression": "Resource"},
+		},
+		"differential": map[string]interface{}{"element": []interface{}{
+			map[string]interface{}{"id": "Extension.url", "path": "Extension.url", "fixedUri": dateExtensionURL},
+			map[string]interface{}{"id": "Extension.value[x]", "path": "Extension.value[x]", "type": []interface{}{map[string]interface{}{"code": "dateTime"}}},
+		}},
+	}
+}
+
+func TestValidateSlicingDiscriminators(t *testing.T) {
+	tests := []struct {
+		name     string
+		elements string
+		resource string
+		want     []string
+	}{
+		{
+			name: "pattern",
+			elements: `[
+				{"id": "Patient.telecom", "path": "Patient.telecom", "slicing": {"discriminator": [{"type": "pattern", "path": "$this"}], "rules": "open"}},
+				{"id": "Patient.telecom:phone", "path": "Patient.telecom", "sliceName": "phone", "min": 1, "patternContactPoint": {"system": "phone"}}
+			]`,
+			resource: `{"resourceType": "Patient", "telecom": [{"system": "email", "value": "a@example.org"}]}`,
+			want: []string{
+				"information: Item 'Patient.telecom[0]' does not match any slice of 'Patient.telecom' (rules: open)",
+				"error: Slice 'phone' of 'Patient.telecom' has too few items: minimum is 1. Found 0 elements",
+			},
+		},
+		{
+			name: "exists",
+			elements: `[
+				{"id": "Patient.name", "path": "Patient.name", "slicing": {"discriminator": [{"type": "exists", "path": "family"}], "rules": "closed"}},
+				{"id": "Patient.name:withFamily", "path": "Patient.name", "sliceName": "withFamily", "min": 1},
+				{"id": "Patient.name:withFamily.family", "path": "Patient.name.family", "min": 1}
+			]`,
+			resource: `{"resourceType": "Patient", "name": [{"family": "Doe"}, {"given": ["John"]}]}`,
+			want:     []string{"error: Item 'Patient.name[1]' does not match any slice of 'Patient.name' (rules: closed). Slices tried: withFamily"},
+		},
+		{
+			name: "type",
+			elements: `[
+				{"id": "Patient.deceased[x]", "path": "Patient.deceased[x]", "slicing": {"discriminator": [{"type": "type", "path": "$this"}], "rules": "closed"}},
+				{"id": "Patient.deceased[x]:deceasedBoolean", "path": "Patient.deceased[x]", "sliceName": "deceasedBoolean", "type": [{"code": "boolean"}]}
+			]`,
+			resource: `{"resourceType": "Patient", "deceasedBoolean": true}`,
+		},
+		{
+			name: "value of a number",
+			elements: `[
+				{"id": "Patient.photo", "path": "Patient.photo", "slicing": {"discriminator": [{"type": "value", "path": "size"}], "rules": "closed"}},
+				{"id": "Patient.photo:small", "path": "Patient.photo", "sliceName": "small"},
+				{"id": "Patient.photo:small.size", "path": "Patient.photo.size", "fixedUnsignedInt": 10}
+			]`,
+			resource: `{"resourceType": "Patient", "photo": [{"size": 10}, {"size": 20}]}`,
+			want:     []string{"error: Item 'Patient.photo[1]' does not match any slice of 'Patient.photo' (rules: closed). Slices tried: small"},
+		},
+		{
+			name: "value of an extension",
+			elements: `[
+				{"id": "Patient.contact", "path": "Patient.contact", "slicing": {"discriminator": [{"type": "value", "path": "extension('` + dateExtensionURL + `').value"}], "rules": "closed"}},
+				{"id": "Patient.contact:newborn", "path": "Patient.contact", "sliceName": "newborn"},
+				{"id": "Patient.contact:newborn.extension:birthTime", "path": "Patient.contact.extension", "sliceName": "birthTime", "type": [{"code": "Extension", "profile": ["` + dateExtensionURL + `"]}]},
+				{"id": "Patient.contact:newborn.extension:birthTime.value[x]", "path": "Patient.contact.extension.value[x]", "fixedDateTime": "2020-01-01T10:00:00Z"}
+			]`,
+			resource: `{"resourceType": "Patient", "contact": [
+				{"extension": [{"url": "` + dateExtensionURL + `", "valueDateTime": "2020-01-01T10:00:00Z"}], "name": {"family": "Doe"}},
+				{"extension": [{"url": "` + dateExtensionURL + `", "valueDateTime": "2021-01-01T10:00:00Z"}], "name": {"family": "Roe"}}
+			]}`,
+			want: []string{"error: Item 'Patient.contact[1]' does not match any slice of 'Patient.contact' (rules: closed). Slices tried: newborn"},
+		},
+		{
+			name: "value of a choice type",
+			elements: `[
+				{"id": "Patient.extension", "path": "Patient.extension", "slicing": {"discriminator": [{"type": "value", "path": "value.ofType(dateTime)"}], "rules": "closed"}},
+				{"id": "Patient.extension:born", "path": "Patient.extension", "sliceName": "born"},
+				{"id": "Patient.extension:born.value[x]:valueDateTime", "path": "Patient.extension.valueDateTime", "fixedDateTime": "2020-01-01T10:00:00Z"}
+			]`,
+			resource: `{"resourceType": "Patient", "extension": [
+				{"url": "` + dateExtensionURL + `", "valueDateTime": "2020-01-01T10:00:00Z"},
+				{"url": "` + dateExtensionURL + `", "valueDateTime": "2021-01-01T10:00:00Z"}
+			]}`,
+			want: []string{"error: Item 'Patient.extension[1]' does not match any slice of 'Patient.extension' (rules: closed). Slices tried: born"},
+		},
+		{
+			name: "type of a resolved reference",
+			elements: `[
+				{"id": "Patient.generalPractitioner", "path": "Patient.generalPractitioner", "slicing": {"discriminator": [{"type": "type", "path": "resolve()"}], "rules": "closed"}},
+				{"id": "Patient.generalPractitioner:practitioner", "path": "Patient.generalPractitioner", "sliceName": "practitioner", "type": [{"code": "Reference", "targetProfile": ["http://hl7.org/fhir/StructureDefinition/Practitioner"]}]}
+			]`,
+			resource: `{"resourceType": "Patient",
+				"contained": [{"resourceType": "Practitioner", "id": "gp"}, {"resourceType": "Organization", "id": "clinic", "name": "Clinic", "address": [{"city": "Springfield"}]}],
+				"generalPractitioner": [{"reference": "#gp"}, {"reference": "#clinic"}]
+			}`,
+			want: []string{"error: Item 'Patient.generalPractitioner[1]' does not match any slice of 'Patient.generalPractitioner' (rules: closed). Slices tried: practitioner"},
+		},
+		{
+			name: "unsupported path",
+			elements: `[
+				{"id": "Patient.identifier", "path": "Patient.identifier", "slicing": {"discriminator": [{"type": "value", "path": "type.coding.where(system = 'x')"}], "rules": "closed"}},
+				{"id": "Patient.identifier:mrn", "path": "Patient.identifier", "sliceName": "mrn", "min": 1}
+			]`,
+			resource: `{"resourceType": "Patient", "identifier": [{"value": "123"}]}`,
+			want:     []string{"warning: Discriminator 'type.coding.where(system = 'x')' of 'Patient.identifier' is not supported"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newProfileValidator(t, testDifferentialProfile(t, "discriminators", tt.elements), dateExtension())
+			got := validateAgainst(t, v, "http://example.org/StructureDefinition/discriminators", tt.resource)
+			assertIssues(t, got, tt.want...)
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
+
+// GenerateSnapshot returns the snapshot of structureDef. Definitions without one, such as
+// differential-only profiles, get a snapshot generated by applying their differential to
+// the snapshot of their baseDefinition; it is cached by canonical URL.
+func (l *LibraryData) GenerateSnapshot(structureDef StructureDefinition) (*Snapshot, error) {
+	return l.generateSnapshot(structureDef, make(map[string]bool))
+}
+
+// withSnapshot returns structureDef with its snapshot, generating it when needed.
+func (l *LibraryData) withSnapshot(structureDef StructureDefinition) (StructureDefinition, error) {
+	if structureDef.Snapshot != nil {
+		return structureDef, nil
+	}
+
+	snapshot, err := l.GenerateSnapshot(structureDef)
+	if err != nil {
+		return structureDef, err
+	}
+
+	structureDef.Snapshot = snapshot
+	return structureDef, nil
+}
+
+func (l *LibraryData) generateSnapshot(structureDef StructureDefinition, visiting map[string]bool) (*Snapshot, error) {
+	if structureDef.Snapshot != nil {
+		return structureDef.Snapshot, nil
+	}
+
+	key := structureDef.URL
+	if structureDef.Version != "" {
+		key += "|" + structureDef.Version
+	}
+
+	l.snapshotMu.Lock()
+	cached, ok := l.snapshots[key]
+	l.snapshotMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	if visiting[key] {
+		return nil, fmt.Errorf("circular baseDefinition for %s", key)
+	}
+	visiting[key] = true
+
+	if structureDef.BaseDefinition == "" {
+		return nil, fmt.Errorf("%s has neither a snapshot nor a baseDefinition", structureDef.URL)
+	}
+	if structureDef.Derivation == "specialization" {
+		return nil, fmt.Errorf("%s is a specialization; only constraint profiles can be generated", structureDef.URL)
+	}
+
+	base, ok := l.StructureDefinitionByURL(structureDef.BaseDefinition)
+	if !ok {
+		return nil, fmt.Errorf("base definition %s of %s not found", structureDef.BaseDefinition, structureDef.URL)
+	}
+
+	baseSnapshot, err := l.generateSnapshot(base, visiting)
+	if err != nil {
+		return nil, err
+	}
+
+	elements := make([]Element, len(baseSnapshot.Element))
+	copy(elements, baseSnapshot.Element)
+
+	for _, diff := range structureDef.Differential.Element {
+		elements, err = l.applyDifferential(elements, diff, structureDef.URL)
+		if err != nil {
+			return nil, fmt.Errorf("generating snapshot of %s: %w", structureDef.URL, err)
+		}
+	}
+
+	snapshot := &Snapshot{Element: elements}
+
+	l.snapshotMu.Lock()
+	if l.snapshots == nil {
+		l.snapshots = make(map[string]*Snapshot)
+	}
+	l.snapshots[key] = snapshot
+	l.snapshotMu.Unlock()
+
+	return snapshot, nil
+}
+
+// resetSnapshots drops the generated snapshots, e.g. after a package replaces a base
+// definition they were generated from.
+func (l *LibraryData) resetSnapshots() {
+	l.snapshotMu.Lock()
+	l.snapshots = nil
+	l.snapshotMu.Unlock()
+}
+
+// applyDifferential merges one differential element onto the matching snapshot element,
+// creating the slice or expanding the children of a complex type it refers to first.
+func (l *LibraryData) applyDifferential(elements []Element, diff DifferentialElement, source string) ([]Element, error) {
+	id := diff.ID
+	if id == "" {
+		id = diff.Path
+		if diff.SliceName != "" {
+			id += ":" + diff.SliceName
+		}
+	}
+
+	for {
+		if index := findElementByID(elements, id); index >= 0 {
+			if isTypeSlice(elements[index]) && len(diff.Type) > 0 {
+				diff.Type = restrictChoiceType(diff.Type, elements[index].Type[0].Code)
+			}
+			merged, err := mergeElement(elements[index], diff, source)
+			if err != nil {
+				return nil, err
+			}
+			elements[index] = merged
+			return elements, nil
+		}
+
+		// value[x]:valueQuantity and valueQuantity constrain the Quantity values of value[x]
+		if resolved, resolvedID, ok := resolveTypeSlice(elements, id); ok {
+			elements, id = resolved, resolvedID
+			continue
+		}
+
+		expanded, ok, err := l.expandFor(elements, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("differential element %s does not match an element of the base", id)
+		}
+		elements = expanded
+	}
+}
+
+// expandFor adds the element that id refers to: a new slice of an existing element, or
+// the children of the closest ancestor whose type was not expanded yet.
+func (l *LibraryData) expandFor(elements []Element, id string) ([]Element, bool, error) {
+	segments := strings.Split(id, ".")
+	last := segments[len(segments)-1]
+
+	// A new slice: copy the sliced element and its children under the slice id.
+	if name, sliceName, found := strings.Cut(last, ":"); found {
+		baseID := strings.Join(append(segments[:len(segments)-1:len(segments)-1], name), ".")
+		baseIndex := findElementByID(elements, baseID)
+		if baseIndex < 0 {
+			// the sliced element itself may need expanding first
+			return l.expandFor(elements, baseID)
+		}
+		return insertSlice(elements, baseIndex, sliceName), true, nil
+	}
+
+	for n := len(segments) - 1; n > 0; n-- {
+		ancestorIndex := findElementByID(elements, strings.Join(segments[:n], "."))
+		if ancestorIndex < 0 {
+			continue
+		}
+
+		children, err := l.typeChildren(elements[ancestorIndex])
+		if err != nil || len(children) == 0 {
+			return nil, false, err
+		}
+		return insertAfter(elements, ancestorIndex, children), true, nil
+	}
+
+	return nil, false, nil
+}
+
+// typeChildren returns the elements of the type of ancestor, rebased under it.
+func (l *LibraryData) typeChildren(ancestor Element) ([]Element, error) {
+	if len(ancestor.Type) != 1 {
+		return nil, fmt.Errorf("cannot expand %s: it must have exactly one type", ancestor.ID)
+	}
+
+	typeCode := ancestor.Type[0].Code
+	typeDef, ok := l.Config[typeCode].(StructureDefinition)
+	if !ok {
+		return nil, fmt.Errorf("cannot expand %s: no definition for type %s", ancestor.ID, typeCode)
+	}
+	typeDef, err := l.withSnapshot(typeDef)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make([]Element, 0, len(typeDef.Snapshot.Element))
+	for _, element := range typeDef.Snapshot.Element {
+		if !strings.HasPrefix(element.Path, typeDef.Type+".") {
+			continue // the root element of the type
+		}
+		element.Path = ancestor.Path + strings.TrimPrefix(element.Path, typeDef.Type)
+		element.ID = ancestor.ID + strings.TrimPrefix(element.ID, typeDef.Type)
+		children = append(children, element)
+	}
+
+	return children, nil
+}
+
+// insertSlice copies the element at baseIndex and its children as slice sliceName,
+// after the existing slices of the element.
+func insertSlice(elements []Element, baseIndex int, sliceName string) []Element {
+	base := elements[baseIndex]
+	sliceID := base.ID + ":" + sliceName
+
+	slice := base
+	slice.ID = sliceID
+	slice.SliceName = sliceName
+	slice.Slicing = nil
+	slice.Min = 0 // a slice is only required when the profile says so
+
+	inserted := []Element{slice}
+	end := baseIndex + 1
+	for ; end < len(elements); end++ {
+		child := elements[end]
+		if strings.HasPrefix(child.ID, base.ID+".") {
+			child.ID = sliceID + strings.TrimPrefix(child.ID, base.ID)
+			inserted = append(inserted, child)
+			continue
+		}
+		if !strings.HasPrefix(child.ID, base.ID+":") {
+			break
+		}
+	}
+
+	return insertAfter(elements, end-1, inserted)
+}
+
+func insertAfter(elements []Element, index int, inserted []Element) []Element {
+	result := make([]Element, 0, len(elements)+len(inserted))
+	result = append(result, elements[:index+1]...)
+	result = append(result, inserted...)
+	return append(result, elements[index+1:]...)
+}
+
+func findElementByID(elements []Element, id string) int {
+	for i := range elements {
+		if elements[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// findChoiceRename resolves an id such as Observation.value[x]:valueQuantity or
+// Observation.valueQuantity to the choice element and the type it selects.
+func findChoiceRename(elements []Element, id string) (int, string, bool) {
+	segments := strings.Split(id, ".")
+	last := segments[len(segments)-1]
+	if name, sliceName, found := strings.Cut(last, ":"); found {
+		if !strings.HasSuffix(name, "[x]") {
+			return 0, "", false
+		}
+		last = sliceName
+	}
+
+	prefix := strings.Join(segments[:len(segments)-1], ".")
+	for i, element := range elements {
+		if !strings.HasSuffix(element.ID, "[x]") || !strings.HasPrefix(element.ID, prefix+".") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(element.ID, prefix+"."), "[x]")
+		if strings.Contains(name, ".") {
+			continue
+		}
+		typeCode, ok := fhirpath.ChoiceTypeSuffix(name, last)
+		if !ok {
+			continue
+		}
+		for _, t := range element.Type {
+			if t.Code == typeCode {
+				return i, typeCode, true
+			}
+		}
+	}
+
+	return 0, "", false
+}
+
+// resolveTypeSlice rewrites the first segment of id that renames a choice to one of its
+// types, e.g. Observation.valueQuantity, to the id of the type slice of the choice,
+// Observation.value[x]:valueQuantity. The slice is added with the type as its only type
+// when the snapshot has none yet; the choice itself keeps all its types.
+func resolveTypeSlice(elements []Element, id string) ([]Element, string, bool) {
+	segments := strings.Split(id, ".")
+	for n := 2; n <= len(segments); n++ {
+		prefix := strings.Join(segments[:n], ".")
+		if findElementByID(elements, prefix) >= 0 {
+			continue
+		}
+
+		choiceIndex, typeCode, ok := findChoiceRename(elements, prefix)
+		if !ok {
+			return nil, "", false
+		}
+
+		choice := elements[choiceIndex]
+		name := strings.TrimSuffix(choice.ID[strings.LastIndex(choice.ID, ".")+1:], "[x]")
+		sliceName := name + fhirpath.UpperFirst(typeCode)
+		sliceID := choice.ID + ":" + sliceName
+
+		if findElementByID(elements, sliceID) < 0 {
+			// Type slices are discriminated by the type of the value, as in the core snapshots
+			if elements[choiceIndex].Slicing == nil {
+				elements[choiceIndex].Slicing = &Slicing{Discriminator: []Discriminator{{Type: "type", Path: "$this"}}, Rules: "open"}
+			}
+			elements = insertSlice(elements, choiceIndex, sliceName)
+			slice := &elements[findElementByID(elements, sliceID)]
+			slice.Type = restrictChoiceType(choice.Type, typeCode)
+		}
+
+		resolved := append([]string{sliceID}, segments[n:]...)
+		return elements, strings.Join(resolved, "."), true
+	}
+
+	return nil, "", false
+}
+
+// isTypeSlice reports whether element is the slice of a choice for one of its types.
+func isTypeSlice(element Element) bool {
+	return element.SliceName != "" && strings.HasSuffix(element.Path, "[x]") && len(element.Type) == 1
+}
+
+// restrictChoiceType keeps the differential types of typeCode, or typeCode alone.
+func restrictChoiceType(types []Type, typeCode string) []Type {
+	for _, t := range types {
+		if t.Code == typeCode {
+			return []Type{t}
+		}
+	}
+	return []Type{{Code: typeCode}}
+}
+
+// mergeElement applies the constraints of a differential element to the base element.
+func mergeElement(base Element, diff DifferentialElement, source string) (Element, error) {
+	merged := base
+
+	if diff.Min != nil {
+		if *diff.Min < base.Min {
+			return base, fmt.Errorf("min %d of %s is below the min %d of the base", *diff.Min, base.ID, base.Min)
+		}
+		merged.Min = *diff.Min
+	}
+	if diff.Max != "" {
+		if !maxAllowed(base.Max, diff.Max) {
+			return base, fmt.Errorf("max %s of %s is above the max %s of the base", diff.Max, base.ID, base.Max)
+		}
+		merged.Max = diff.Max
+	}
+	if diff.Short != "" {
+		merged.Short = diff.Short
+	}
+	if diff.Definition != "" {
+		merged.Definition = diff.Definition
+	}
+	if diff.MustSupport {
+		merged.MustSupport = true
+	}
+	if diff.Binding != nil {
+		merged.Binding = diff.Binding
+	}
+	if diff.Slicing != nil {
+		merged.Slicing = diff.Slicing
+	}
+	if diff.Fixed != nil {
+		merged.Fixed = diff.Fixed
+	}
+	if diff.Pattern != nil {
+		merged.Pattern = diff.Pattern
+	}
+	if diff.MaxLength > 0 {
+		merged.MaxLength = diff.MaxLength
+	}
+	if diff.MinValue != nil {
+		merged.MinValue = diff.MinValue
+	}
+	if diff.MaxValue != nil {
+		merged.MaxValue = diff.MaxValue
+	}
+
+	if len(diff.Type) > 0 {
+		for _, t := range diff.Type {
+			if !typeAllowed(base.Type, t.Code) {
+				return base, fmt.Errorf("type %s of %s is not allowed by the base", t.Code, base.ID)
+			}
+		}
+		merged.Type = diff.Type
+	}
+
+	if len(diff.Condition) > 0 {
+		merged.Condition = append(append([]string{}, base.Condition...), diff.Condition...)
+	}
+
+	if len(diff.Constraint) > 0 {
+		merged.Constraint = append([]Constraint{}, base.Constraint...)
+		for _, constraint := range diff.Constraint {
+			if constraintIndex(merged.Constraint, constraint.Key) >= 0 {
+				continue
+			}
+			if constraint.Source == "" {
+				constraint.Source = source
+			}
+			merged.Constraint = append(merged.Constraint, constraint)
+		}
+	}
+
+	return merged, nil
+}
+
+// typeAllowed reports whether a profile may restrict an element of the base types to code.
+func typeAllowed(baseTypes []Type, code string) bool {
+	if len(baseTypes) == 0 {
+		return true
+	}
+	for _, t := range baseTypes {
+		if t.Code == code || t.Code == "Resource" || t.Code == "DomainResource" {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAllowed reports whether a profile may restrict an element of the base max to max.
+func maxAllowed(baseMax, max string) bool {
+	baseItems, baseIsWildcard := ParseMaxItems(baseMax)
+	if baseMax == "" || baseIsWildcard {
+		return true
+	}
+	items, isWildcard := ParseMaxItems(max)
+	return !isWildcard && items <= baseItems
+}
+
+func constraintIndex(constraints []Constraint, key string) int {
+	for i := range constraints {
+		if constraints[i].Key == key {
+			return i
+		}
+	}
+	return -1
+}
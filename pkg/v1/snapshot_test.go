@@ -0,0 +1,202 @@
+package v1
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+// differentialProfile returns a Patient profile with the given differential elements.
+func differentialProfile(t *testing.T, elements string) StructureDefinition {
+	t.Helper()
+	var profile StructureDefinition
+	source := `{
+		"resourceType": "StructureDefinition",
+		"id": "test-patient",
+		"url": "http://example.org/StructureDefinition/test-patient",
+		"type": "Patient",
+		"baseDefinition": "http://hl7.org/fhir/StructureDefinition/Patient",
+		"derivation": "constraint",
+		"differential": {"element": ` + elements + `}
+	}`
+	if err := json.Unmarshal([]byte(source), &profile); err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func snapshotElement(t *testing.T, snapshot *Snapshot, id string) Element {
+	t.Helper()
+	if index := findElementByID(snapshot.Element, id); index >= 0 {
+		return snapshot.Element[index]
+	}
+	t.Fatalf("no element %s in the snapshot", id)
+	return Element{}
+}
+
+func TestGenerateSnapshot(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := library.GenerateSnapshot(differentialProfile(t, `[
+		{"id": "Patient.birthDate", "path": "Patient.birthDate", "min": 1},
+		{"id": "Patient.name", "path": "Patient.name", "max": "2"},
+		{"id": "Patient.deceased[x]", "path": "Patient.deceased[x]", "type": [{"code": "boolean"}]},
+		{"id": "Patient.identifier", "path": "Patient.identifier", "slicing": {"discriminator": [{"type": "value", "path": "system"}], "rules": "open"}},
+		{"id": "Patient.identifier:mrn", "path": "Patient.identifier", "sliceName": "mrn", "min": 1, "max": "1"},
+		{"id": "Patient.identifier:mrn.system", "path": "Patient.identifier.system", "min": 1},
+		{"id": "Patient.gender", "path": "Patient.gender", "constraint": [{"key": "test-1", "severity": "error", "human": "test", "expression": "true"}]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if element := snapshotElement(t, snapshot, "Patient.birthDate"); element.Min != 1 {
+		t.Errorf("birthDate min = %d, want 1", element.Min)
+	}
+	if element := snapshotElement(t, snapshot, "Patient.name"); element.Max != "2" {
+		t.Errorf("name max = %s, want 2", element.Max)
+	}
+	if element := snapshotElement(t, snapshot, "Patient.deceased[x]"); len(element.Type) != 1 || element.Type[0].Code != "boolean" {
+		t.Errorf("deceased[x] types = %+v, want boolean", element.Type)
+	}
+	if element := snapshotElement(t, snapshot, "Patient.identifier:mrn"); element.Min != 1 || element.Max != "1" || element.SliceName != "mrn" {
+		t.Errorf("mrn slice = %d..%s %q", element.Min, element.Max, element.SliceName)
+	}
+	if element := snapshotElement(t, snapshot, "Patient.identifier:mrn.system"); element.Min != 1 {
+		t.Errorf("mrn system min = %d, want 1", element.Min)
+	}
+	element := snapshotElement(t, snapshot, "Patient.gender")
+	if index := constraintIndex(element.Constraint, "test-1"); index < 0 || element.Constraint[index].Source != "http://example.org/StructureDefinition/test-patient" {
+		t.Errorf("gender constraints = %+v, want test-1 from the profile", element.Constraint)
+	}
+}
+
+func TestGenerateSnapshotRejectsLooserConstraints(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		elements string
+		want     string
+	}{
+		{
+			name:     "min below the base",
+			elements: `[{"id": "Patient.link.other", "path": "Patient.link.other", "min": 0}]`,
+			want:     "min 0 of Patient.link.other is below the min 1 of the base",
+		},
+		{
+			name:     "max above the base",
+			elements: `[{"id": "Patient.gender", "path": "Patient.gender", "max": "2"}]`,
+			want:     "max 2 of Patient.gender is above the max 1 of the base",
+		},
+		{
+			name:     "unbounded max on a single element",
+			elements: `[{"id": "Patient.birthDate", "path": "Patient.birthDate", "max": "*"}]`,
+			want:     "max * of Patient.birthDate is above the max 1 of the base",
+		},
+		{
+			name:     "type not in the base",
+			elements: `[{"id": "Patient.deceased[x]", "path": "Patient.deceased[x]", "type": [{"code": "string"}]}]`,
+			want:     "type string of Patient.deceased[x] is not allowed by the base",
+		},
+		{
+			name:     "unknown element",
+			elements: `[{"id": "Patient.unknown", "path": "Patient.unknown", "min": 1}]`,
+			want:     "cannot expand Patient",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := library.GenerateSnapshot(differentialProfile(t, tt.elements))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxAllowed(t *testing.T) {
+	tests := []struct {
+		baseMax, max string
+		want         bool
+	}{
+		{"*", "*", true},
+		{"*", "3", true},
+		{"3", "3", true},
+		{"3", "1", true},
+		{"3", "0", true},
+		{"3", "4", false},
+		{"1", "*", false},
+		{"", "*", true},
+	}
+	for _, tt := range tests {
+		if got := maxAllowed(tt.baseMax, tt.max); got != tt.want {
+			t.Errorf("maxAllowed(%q, %q) = %v, want %v", tt.baseMax, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateSnapshotTypeSlices(t *testing.T) {
+	library, err := LoadSpecFS(fhirspec.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"Patient.deceased[x]:deceasedBoolean", "Patient.deceasedBoolean"} {
+		t.Run(id, func(t *testing.T) {
+			snapshot, err := library.GenerateSnapshot(differentialProfile(t, `[
+				{"id": "`+id+`", "path": "Patient.deceasedBoolean", "fixedBoolean": true},
+				{"id": "`+id+`.extension", "path": "Patient.deceased[x].extension", "max": "0"}
+			]`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The choice keeps its types; the slice has the one it constrains.
+			choice := snapshotElement(t, snapshot, "Patient.deceased[x]")
+			if len(choice.Type) != 2 || choice.Fixed != nil {
+				t.Errorf("deceased[x] = %+v, fixed %+v, want boolean and dateTime without a fixed value", choice.Type, choice.Fixed)
+			}
+			if choice.Slicing == nil || len(choice.Slicing.Discriminator) != 1 || choice.Slicing.Discriminator[0].Type != "type" {
+				t.Errorf("deceased[x] slicing = %+v, want a type discriminator", choice.Slicing)
+			}
+
+			slice := snapshotElement(t, snapshot, "Patient.deceased[x]:deceasedBoolean")
+			if slice.SliceName != "deceasedBoolean" || len(slice.Type) != 1 || slice.Type[0].Code != "boolean" || slice.Fixed == nil {
+				t.Errorf("type slice = %q %+v, fixed %+v", slice.SliceName, slice.Type, slice.Fixed)
+			}
+			if element := snapshotElement(t, snapshot, "Patient.deceased[x]:deceasedBoolean.extension"); element.Max != "0" {
+				t.Errorf("type slice extension max = %s, want 0", element.Max)
+			}
+		})
+	}
+}
+
+func TestValidateTypeSlice(t *testing.T) {
+	profile := testDifferentialProfile(t, "deceased-patient", `[
+		{"id": "Patient.deceased[x]:deceasedBoolean", "path": "Patient.deceasedBoolean", "fixedBoolean": true}
+	]`)
+	v := newProfileValidator(t, profile)
+	url := profile["url"].(string)
+
+	assertIssues(t, validateAgainst(t, v, url, `{"resourceType": "Patient", "deceasedBoolean": true}`))
+	assertIssues(t, validateAgainst(t, v, url, `{"resourceType": "Patient", "deceasedDateTime": "2020-01-01"}`))
+	assertIssues(t, validateAgainst(t, v, url, `{"resourceType": "Patient", "deceasedBoolean": false}`),
+		"error: Value of 'Patient.deceasedBoolean' must be true")
+
+	required := testDifferentialProfile(t, "deceased-date-patient", `[
+		{"id": "Patient.deceased[x]:deceasedDateTime", "path": "Patient.deceasedDateTime", "min": 1}
+	]`)
+	v = newProfileValidator(t, required)
+	assertIssues(t, validateAgainst(t, v, required["url"].(string), `{"resourceType": "Patient", "deceasedBoolean": true}`),
+		"error: Field 'Patient.deceasedDateTime' is required")
+}
@@ -0,0 +1,129 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+func TestValidateUnknownResourceDefinition(t *testing.T) {
+	patient, err := fs.ReadFile(fhirspec.FS, "patient.profile.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(WithSpecFS(fstest.MapFS{"patient.profile.json": {Data: patient}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = v.Validate(context.Background(), decodeResource(t, `{"resourceType": "Observation", "status": "final"}`))
+	if err == nil || !strings.Contains(err.Error(), "go generate ./spec") {
+		t.Fatalf("got error %v, want one pointing at go generate ./spec", err)
+	}
+}
+
+func TestLoadSpecFSDoesNotPrint(t *testing.T) {
+	var loadErr error
+	printed := captureStdout(t, func() {
+		_, loadErr = LoadSpecFS(fhirspec.FS)
+	})
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if printed != "" {
+		t.Errorf("LoadSpecFS printed to stdout:\n%s", printed)
+	}
+}
+
+func TestLoadSpecFSOverride(t *testing.T) {
+	// The override requires Patient.gender, which the core Patient does not.
+	data, err := fs.ReadFile(fhirspec.FS, "patient.profile.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patient map[string]interface{}
+	if err := json.Unmarshal(data, &patient); err != nil {
+		t.Fatal(err)
+	}
+	for _, element := range patient["snapshot"].(map[string]interface{})["element"].([]interface{}) {
+		if element := element.(map[string]interface{}); element["id"] == "Patient.gender" {
+			element["min"] = 1
+		}
+	}
+
+	override := fstest.MapFS{
+		"core/patient.profile.json":    {Data: mustJSON(t, patient)},
+		"profiles/with-birthdate.json": {Data: mustJSON(t, testDifferentialProfile(t, "with-birthdate", `[{"id": "Patient.birthDate", "path": "Patient.birthDate", "min": 1}]`))},
+	}
+	library, err := LoadSpecFS(fhirspec.FS, override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(WithSpec(library))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertIssues(t, validate(t, v, `{"resourceType": "Patient"}`), "error: Field 'Patient.gender' is required")
+	assertIssues(t, validateAgainst(t, v, "http://example.org/StructureDefinition/with-birthdate", `{"resourceType": "Patient", "gender": "male"}`),
+		"error: Field 'Patient.birthDate' is required")
+
+	// The embedded spec alone keeps the core Patient and has no custom profile.
+	assertIssues(t, validate(t, newTestValidator(t), `{"resourceType": "Patient"}`))
+	if _, ok := newTestValidator(t).spec.StructureDefinitionByURL("http://example.org/StructureDefinition/with-birthdate"); ok {
+		t.Error("the custom profile was added to the embedded spec")
+	}
+}
+
+func TestValidateMeta(t *testing.T) {
+	v := newTestValidator(t)
+
+	assertIssues(t, validate(t, v, `{
+		"resourceType": "Patient",
+		"meta": {
+			"versionId": "1",
+			"lastUpdated": "2020-01-01T10:00:00Z",
+			"source": "http://example.org/ehr",
+			"profile": ["http://hl7.org/fhir/StructureDefinition/Patient"],
+			"tag": [{"system": "http://example.org/tags", "code": "reviewed"}]
+		}
+	}`))
+	assertIssues(t, validate(t, v, `{"resourceType": "Patient", "meta": {"lastUpdated": "2020-01-01"}}`),
+		"error: Field 'Patient.meta.lastUpdated' does not match the expected pattern")
+}
+
+// TestCoreBundlesCoverEveryResourceType needs the R4 core bundles, which CI generates
+// with `go generate ./spec` before running the tests.
+func TestCoreBundlesCoverEveryResourceType(t *testing.T) {
+	if _, err := fs.Stat(fhirspec.FS, "profiles-resources.json"); err != nil {
+		t.Fatal("the R4 core bundles are not embedded; run go generate ./spec")
+	}
+	v := newTestValidator(t)
+
+	for _, resourceType := range FhirR4ResourceTypes {
+		if _, ok := v.spec.Config[resourceType]; !ok {
+			t.Errorf("no definition loaded for %s", resourceType)
+		}
+	}
+
+	if _, ok := v.spec.StructureDefinitionByURL("http://hl7.org/fhir/StructureDefinition/patient-birthPlace"); !ok {
+		t.Error("core extension patient-birthPlace not loaded from extension-definitions.json")
+	}
+
+	got := validate(t, v, `{
+		"resourceType": "Observation",
+		"status": "final",
+		"code": {"coding": [{"system": "http://loinc.org", "code": "8867-4"}]},
+		"valueQuantity": {"value": 72, "unit": "/min", "system": "http://unitsofmeasure.org", "code": "/min"}
+	}`)
+	for _, issue := range got {
+		if strings.HasPrefix(issue, "error:") || strings.HasPrefix(issue, "fatal:") {
+			t.Errorf("unexpected issue: %s", issue)
+		}
+	}
+}
@@ -1,31 +1,86 @@
 package v1
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
+)
 
 type StructureDefinition struct {
-	ResourceType string       `json:"resourceType"`
-	ID           string       `json:"id"`
-	Text         Text         `json:"text"`
-	Extension    []Extension  `json:"extension"`
-	URL          string       `json:"url"`
-	Version      string       `json:"version"`
-	Name         string       `json:"name"`
-	Status       string       `json:"status"`
-	Date         time.Time    `json:"date"`
-	Publisher    string       `json:"publisher"`
-	Contact      []Contact    `json:"contact"`
-	Description  string       `json:"description"`
-	FHIRVersion  string       `json:"fhirVersion"`
-	Mapping      []Mapping    `json:"mapping"`
-	Kind         string       `json:"kind"`
-	Abstract     bool         `json:"abstract"`
-	Type         string       `json:"type"`
-	Snapshot     *Snapshot    `json:"snapshot"`
-	Differential Differential `json:"differential"`
+	ResourceType   string         `json:"resourceType"`
+	ID             string         `json:"id"`
+	Text           Text           `json:"text"`
+	Extension      []Extension    `json:"extension"`
+	URL            string         `json:"url"`
+	Version        string         `json:"version"`
+	Name           string         `json:"name"`
+	Status         string         `json:"status"`
+	Date           string         `json:"date"`
+	Publisher      string         `json:"publisher"`
+	Contact        []Contact      `json:"contact"`
+	Description    string         `json:"description"`
+	FHIRVersion    string         `json:"fhirVersion"`
+	Mapping        []Mapping      `json:"mapping"`
+	Kind           string         `json:"kind"`
+	Abstract       bool           `json:"abstract"`
+	Type           string         `json:"type"`
+	Context        []UsageContext `json:"context,omitempty"`
+	BaseDefinition string         `json:"baseDefinition,omitempty"`
+	Derivation     string         `json:"derivation,omitempty"`
+	Snapshot       *Snapshot      `json:"snapshot"`
+	Differential   Differential   `json:"differential"`
+}
+
+// UsageContext is where an extension may be used: an element path (type "element"),
+// the url of another extension ("extension") or a FHIRPath expression ("fhirpath").
+type UsageContext struct {
+	Type       string `json:"type"`
+	Expression string `json:"expression"`
 }
 
 // ValueSet representa un ValueSet de FHIR
 type ValueSet struct {
+	ResourceType string             `json:"resourceType"`
+	ID           string             `json:"id"`
+	Meta         Meta               `json:"meta"`
+	Text         Narrative          `json:"text"`
+	Extension    []Extension        `json:"extension"`
+	URL          string             `json:"url"`
+	Identifier   []Identifier       `json:"identifier"`
+	Version      string             `json:"version"`
+	Name         string             `json:"name"`
+	Title        string             `json:"title"`
+	Status       string             `json:"status"`
+	Experimental bool               `json:"experimental"`
+	Date         string             `json:"date"`
+	Publisher    string             `json:"publisher"`
+	Contact      []Contact          `json:"contact"`
+	Description  string             `json:"description"`
+	Immutable    bool               `json:"immutable"`
+	Compose      Compose            `json:"compose"`
+	Expansion    *ValueSetExpansion `json:"expansion,omitempty"`
+}
+
+// ValueSetExpansion representa la expansión de un ValueSet (ValueSet.expansion)
+type ValueSetExpansion struct {
+	Identifier string              `json:"identifier,omitempty"`
+	Timestamp  string              `json:"timestamp"`
+	Total      int                 `json:"total"`
+	Contains   []ExpansionContains `json:"contains,omitempty"`
+}
+
+// ExpansionContains representa un código de la expansión
+type ExpansionContains struct {
+	System  string `json:"system,omitempty"`
+	Version string `json:"version,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// CodeSystem representa un sistema de códigos en FHIR
+type CodeSystem struct {
 	ResourceType string       `json:"resourceType"`
 	ID           string       `json:"id"`
 	Meta         Meta         `json:"meta"`
@@ -38,36 +93,35 @@ type ValueSet struct {
 	Title        string       `json:"title"`
 	Status       string       `json:"status"`
 	Experimental bool         `json:"experimental"`
-	Date         time.Time    `json:"date"`
+	Date         string       `json:"date"`
 	Publisher    string       `json:"publisher"`
 	Contact      []Contact    `json:"contact"`
 	Description  string       `json:"description"`
-	Immutable    bool         `json:"immutable"`
-	Compose      Compose      `json:"compose"`
+	// CaseSensitive es nil cuando el CodeSystem no lo declara; ver IsCaseSensitive
+	CaseSensitive *bool     `json:"caseSensitive,omitempty"`
+	ValueSet      string    `json:"valueSet"`
+	Content       string    `json:"content"`
+	Concept       []Concept `json:"concept"`
 }
 
-// CodeSystem representa un sistema de códigos en FHIR
-type CodeSystem struct {
-	ResourceType  string       `json:"resourceType"`
-	ID            string       `json:"id"`
-	Meta          Meta         `json:"meta"`
-	Text          Narrative    `json:"text"`
-	Extension     []Extension  `json:"extension"`
-	URL           string       `json:"url"`
-	Identifier    []Identifier `json:"identifier"`
-	Version       string       `json:"version"`
-	Name          string       `json:"name"`
-	Title         string       `json:"title"`
-	Status        string       `json:"status"`
-	Experimental  bool         `json:"experimental"`
-	Date          time.Time    `json:"date"`
-	Publisher     string       `json:"publisher"`
-	Contact       []Contact    `json:"contact"`
-	Description   string       `json:"description"`
-	CaseSensitive bool         `json:"caseSensitive"`
-	ValueSet      string       `json:"valueSet"`
-	Content       string       `json:"content"`
-	Concept       []Concept    `json:"concept"`
+// IsCaseSensitive indica si los códigos distinguen mayúsculas; sin caseSensitive lo hacen
+func (c CodeSystem) IsCaseSensitive() bool {
+	return c.CaseSensitive == nil || *c.CaseSensitive
+}
+
+// Parameters representa un recurso Parameters de FHIR, p. ej. el resultado de $lookup
+type Parameters struct {
+	ResourceType string      `json:"resourceType"`
+	Parameter    []Parameter `json:"parameter,omitempty"`
+}
+
+// Parameter representa un parámetro de Parameters, con valor o con partes
+type Parameter struct {
+	Name         string      `json:"name"`
+	ValueBoolean *bool       `json:"valueBoolean,omitempty"`
+	ValueString  string      `json:"valueString,omitempty"`
+	ValueCode    string      `json:"valueCode,omitempty"`
+	Part         []Parameter `json:"part,omitempty"`
 }
 
 // OperationOutcome represents a FHIR OperationOutcome resource
@@ -88,16 +142,28 @@ type IssueEntry struct {
 
 // Concept representa un concepto en el CodeSystem
 type Concept struct {
-	Code       string    `json:"code"`
-	Display    string    `json:"display"`
-	Definition string    `json:"definition"`
-	Concept    []Concept `json:"concept,omitempty"`
+	Code       string            `json:"code"`
+	Display    string            `json:"display"`
+	Definition string            `json:"definition"`
+	Property   []ConceptProperty `json:"property,omitempty"`
+	Concept    []Concept         `json:"concept,omitempty"`
+}
+
+// ConceptProperty representa una propiedad de un concepto, p. ej. parent o status
+type ConceptProperty struct {
+	Code          string  `json:"code"`
+	ValueCode     string  `json:"valueCode,omitempty"`
+	ValueString   string  `json:"valueString,omitempty"`
+	ValueCoding   *Coding `json:"valueCoding,omitempty"`
+	ValueInteger  *int    `json:"valueInteger,omitempty"`
+	ValueBoolean  *bool   `json:"valueBoolean,omitempty"`
+	ValueDateTime string  `json:"valueDateTime,omitempty"`
 }
 
 // Meta representa la metadata del ValueSet
 type Meta struct {
-	LastUpdated time.Time `json:"lastUpdated"`
-	Profile     []string  `json:"profile"`
+	LastUpdated string   `json:"lastUpdated"`
+	Profile     []string `json:"profile"`
 }
 
 // Narrative representa el texto narrativo generado para el recurso
@@ -135,17 +201,23 @@ type Telecom struct {
 // Compose representa la composición del ValueSet
 type Compose struct {
 	Include []Include `json:"include"`
+	Exclude []Include `json:"exclude,omitempty"`
 }
 
-// Include representa los sistemas de código incluidos en el ValueSet
+// Include representa los sistemas de código incluidos (o excluidos) en el ValueSet
 type Include struct {
-	System  string    `json:"system"`
-	Concept []Concept `json:"concept"`
-	Filter  []struct {
-		Property string `json:"property"`
-		Op       string `json:"op"`
-		Value    string `json:"value"`
-	} `json:"filter"`
+	System   string          `json:"system"`
+	Version  string          `json:"version,omitempty"`
+	Concept  []Concept       `json:"concept"`
+	Filter   []ConceptFilter `json:"filter"`
+	ValueSet []string        `json:"valueSet,omitempty"`
+}
+
+// ConceptFilter representa un filtro de conceptos de un include, p. ej. is-a
+type ConceptFilter struct {
+	Property string `json:"property"`
+	Op       string `json:"op"`
+	Value    string `json:"value"`
 }
 
 type Text struct {
@@ -164,25 +236,157 @@ type Snapshot struct {
 }
 
 type Differential struct {
-	Element []Element `json:"element"`
+	Element []DifferentialElement `json:"element"`
+}
+
+// DifferentialElement is an Element of a differential, where an absent min means
+// "inherited from the base" rather than 0.
+type DifferentialElement struct {
+	Element
+	Min *int `json:"min,omitempty"`
+}
+
+// MarshalJSON encodes the Element, whose method would otherwise hide Min.
+func (d DifferentialElement) MarshalJSON() ([]byte, error) {
+	type element Element // without its methods
+	data, err := json.Marshal(struct {
+		element
+		Min *int `json:"min,omitempty"`
+	}{element(d.Element), d.Min})
+	if err != nil {
+		return nil, err
+	}
+	return d.Element.appendChoiceProperties(data)
+}
+
+// UnmarshalJSON decodes the Element, whose method would otherwise hide Min.
+func (d *DifferentialElement) UnmarshalJSON(data []byte) error {
+	if err := d.Element.UnmarshalJSON(data); err != nil {
+		return err
+	}
+
+	var min struct {
+		Min *int `json:"min"`
+	}
+	if err := json.Unmarshal(data, &min); err != nil {
+		return err
+	}
+	d.Min = min.Min
+	return nil
 }
 
 type Element struct {
-	ID         string           `json:"id"`
-	Extension  []Extension      `json:"extension,omitempty"`
-	Path       string           `json:"path"`
-	Short      string           `json:"short"`
-	Definition string           `json:"definition"`
-	Min        int              `json:"min"`
-	Max        string           `json:"max"`
-	Base       Base             `json:"base"`
-	Type       []Type           `json:"type"`
-	Condition  []string         `json:"condition,omitempty"`
-	Constraint []Constraint     `json:"constraint,omitempty"`
-	IsModifier bool             `json:"isModifier"`
-	IsSummary  bool             `json:"isSummary"`
-	Binding    *Binding         `json:"binding,omitempty"`
-	Mapping    []ElementMapping `json:"mapping,omitempty"`
+	ID               string           `json:"id"`
+	Extension        []Extension      `json:"extension,omitempty"`
+	Path             string           `json:"path"`
+	Short            string           `json:"short"`
+	Definition       string           `json:"definition"`
+	Min              int              `json:"min"`
+	Max              string           `json:"max"`
+	Base             Base             `json:"base"`
+	SliceName        string           `json:"sliceName,omitempty"`
+	Slicing          *Slicing         `json:"slicing,omitempty"`
+	ContentReference string           `json:"contentReference,omitempty"`
+	Type             []Type           `json:"type"`
+	Condition        []string         `json:"condition,omitempty"`
+	Constraint       []Constraint     `json:"constraint,omitempty"`
+	IsModifier       bool             `json:"isModifier"`
+	IsSummary        bool             `json:"isSummary"`
+	MustSupport      bool             `json:"mustSupport,omitempty"`
+	Binding          *Binding         `json:"binding,omitempty"`
+	Mapping          []ElementMapping `json:"mapping,omitempty"`
+	MaxLength        int              `json:"maxLength,omitempty"`
+	Fixed            *TypedValue      `json:"-"` // fixed[x]
+	Pattern          *TypedValue      `json:"-"` // pattern[x]
+	MinValue         *TypedValue      `json:"-"` // minValue[x]
+	MaxValue         *TypedValue      `json:"-"` // maxValue[x]
+}
+
+// TypedValue is the value of a choice property of an element definition, e.g.
+// fixedUri or patternCodeableConcept, with the type given by its name.
+type TypedValue struct {
+	Type  string
+	Value interface{}
+}
+
+// UnmarshalJSON decodes an element definition, including its choice properties.
+func (e *Element) UnmarshalJSON(data []byte) error {
+	type element Element // without this method
+	if err := json.Unmarshal(data, (*element)(e)); err != nil {
+		return err
+	}
+
+	if !bytes.Contains(data, []byte(`"fixed`)) && !bytes.Contains(data, []byte(`"pattern`)) &&
+		!bytes.Contains(data, []byte(`"minValue`)) && !bytes.Contains(data, []byte(`"maxValue`)) {
+		return nil // most elements have none
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key, value := range raw {
+		if typeCode, ok := fhirpath.ChoiceTypeSuffix("fixed", key); ok {
+			e.Fixed = &TypedValue{Type: typeCode, Value: value}
+		}
+		if typeCode, ok := fhirpath.ChoiceTypeSuffix("pattern", key); ok {
+			e.Pattern = &TypedValue{Type: typeCode, Value: value}
+		}
+		if typeCode, ok := fhirpath.ChoiceTypeSuffix("minValue", key); ok {
+			e.MinValue = &TypedValue{Type: typeCode, Value: value}
+		}
+		if typeCode, ok := fhirpath.ChoiceTypeSuffix("maxValue", key); ok {
+			e.MaxValue = &TypedValue{Type: typeCode, Value: value}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes an element definition, writing its choice properties with the
+// name of their type, e.g. fixedUri.
+func (e Element) MarshalJSON() ([]byte, error) {
+	type element Element // without this method
+	data, err := json.Marshal(element(e))
+	if err != nil {
+		return nil, err
+	}
+	return e.appendChoiceProperties(data)
+}
+
+// appendChoiceProperties adds the choice properties of e to the JSON object data.
+func (e Element) appendChoiceProperties(data []byte) ([]byte, error) {
+	properties := []struct {
+		name  string
+		value *TypedValue
+	}{
+		{"fixed", e.Fixed},
+		{"pattern", e.Pattern},
+		{"minValue", e.MinValue},
+		{"maxValue", e.MaxValue},
+	}
+
+	for _, property := range properties {
+		if property.value == nil {
+			continue
+		}
+
+		name, err := json.Marshal(property.name + fhirpath.UpperFirst(property.value.Type))
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(property.value.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s of %s: %w", name, e.ID, err)
+		}
+
+		data = data[:len(data)-1] // reopen the object
+		if len(data) > 1 {
+			data = append(data, ',')
+		}
+		data = append(append(append(data, name...), ':'), value...)
+		data = append(data, '}')
+	}
+	return data, nil
 }
 
 type Binding struct {
@@ -195,9 +399,22 @@ type Binding struct {
 type Type struct {
 	Code          string      `json:"code"`
 	Extension     []Extension `json:"extension,omitempty"`
+	Profile       []string    `json:"profile,omitempty"`
 	TargetProfile []string    `json:"targetProfile,omitempty"`
 }
 
+type Slicing struct {
+	Discriminator []Discriminator `json:"discriminator,omitempty"`
+	Description   string          `json:"description,omitempty"`
+	Ordered       bool            `json:"ordered,omitempty"`
+	Rules         string          `json:"rules,omitempty"`
+}
+
+type Discriminator struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
 type Base struct {
 	Path string `json:"path"`
 	Min  int    `json:"min"`
@@ -0,0 +1,106 @@
+package v1
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestElementJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"without choice properties", `{"id": "Patient.gender", "path": "Patient.gender", "min": 0, "max": "1"}`},
+		{"fixed", `{"id": "Patient.identifier.system", "path": "Patient.identifier.system", "min": 1, "max": "1", "fixedUri": "http://example.org/mrn"}`},
+		{"pattern", `{"id": "Patient.maritalStatus", "path": "Patient.maritalStatus", "min": 0, "max": "1", "patternCodeableConcept": {"coding": [{"system": "http://example.org/status", "code": "M"}]}}`},
+		{"fixed and pattern", `{"id": "Patient.active", "path": "Patient.active", "min": 0, "max": "1", "fixedBoolean": true, "patternBoolean": true}`},
+		{"minValue and maxValue", `{"id": "Patient.multipleBirth[x]", "path": "Patient.multipleBirth[x]", "min": 0, "max": "1", "minValueInteger": 1, "maxValueInteger": 10}`},
+		{"all choice properties", `{"id": "Patient.photo.size", "path": "Patient.photo.size", "min": 0, "max": "1", "fixedUnsignedInt": 5, "patternUnsignedInt": 5, "minValueUnsignedInt": 0, "maxValueUnsignedInt": 100}`},
+		{"two-word type", `{"id": "Patient.birthDate", "path": "Patient.birthDate", "min": 0, "max": "1", "fixedDateTime": "2020-01-01T00:00:00Z"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var element Element
+			if err := json.Unmarshal([]byte(tt.source), &element); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := json.Marshal(element)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded Element
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("%v: %s", err, data)
+			}
+			if !reflect.DeepEqual(decoded, element) {
+				t.Errorf("round trip changed the element:\n got %+v\nwant %+v\njson %s", decoded, element, data)
+			}
+
+			// The choice properties keep the names they were read with.
+			var want, got map[string]interface{}
+			_ = json.Unmarshal([]byte(tt.source), &want)
+			_ = json.Unmarshal(data, &got)
+			for key, value := range want {
+				if !reflect.DeepEqual(got[key], value) {
+					t.Errorf("%s = %v, want %v", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestElementMarshalPointer(t *testing.T) {
+	element := &Element{ID: "Patient.gender", Path: "Patient.gender", Fixed: &TypedValue{Type: "code", Value: "female"}}
+
+	data, err := json.Marshal(element)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"fixedCode":"female"`) {
+		t.Errorf("got %s", data)
+	}
+}
+
+func TestDifferentialElementJSONRoundTrip(t *testing.T) {
+	source := `{"id": "Patient.identifier:mrn.system", "path": "Patient.identifier.system", "fixedUri": "http://example.org/mrn"}`
+
+	var diff DifferentialElement
+	if err := json.Unmarshal([]byte(source), &diff); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A differential without min does not get one.
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["min"]; ok {
+		t.Errorf("min written for a differential without one: %s", data)
+	}
+	if raw["fixedUri"] != "http://example.org/mrn" {
+		t.Errorf("fixedUri = %v: %s", raw["fixedUri"], data)
+	}
+
+	min := 1
+	diff.Min = &min
+	data, err = json.Marshal(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded DifferentialElement
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Min == nil || *decoded.Min != 1 || !reflect.DeepEqual(decoded.Fixed, diff.Fixed) {
+		t.Errorf("got %+v from %s", decoded, data)
+	}
+}
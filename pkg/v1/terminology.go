@@ -0,0 +1,282 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateCodeResult is the outcome of $validate-code. A code with a wrong display is
+// still valid; Message then says which display was expected.
+type ValidateCodeResult struct {
+	Result  bool
+	System  string
+	Code    string
+	Display string
+	Message string
+}
+
+// Parameters returns the result as the Parameters resource of $validate-code.
+func (r ValidateCodeResult) Parameters() Parameters {
+	result := r.Result
+	parameters := Parameters{
+		ResourceType: "Parameters",
+		Parameter:    []Parameter{{Name: "result", ValueBoolean: &result}},
+	}
+	if r.Display != "" {
+		parameters.Parameter = append(parameters.Parameter, Parameter{Name: "display", ValueString: r.Display})
+	}
+	if r.Message != "" {
+		parameters.Parameter = append(parameters.Parameter, Parameter{Name: "message", ValueString: r.Message})
+	}
+	return parameters
+}
+
+// LookupResult is the outcome of CodeSystem/$lookup.
+type LookupResult struct {
+	Name       string
+	Version    string
+	Display    string
+	Definition string
+	Property   []ConceptProperty
+}
+
+// Parameters returns the result as the Parameters resource of $lookup.
+func (r LookupResult) Parameters() Parameters {
+	parameters := Parameters{ResourceType: "Parameters"}
+	add := func(name, value string) {
+		if value != "" {
+			parameters.Parameter = append(parameters.Parameter, Parameter{Name: name, ValueString: value})
+		}
+	}
+	add("name", r.Name)
+	add("version", r.Version)
+	add("display", r.Display)
+	add("definition", r.Definition)
+
+	for _, property := range r.Property {
+		value, ok := propertyValue(property)
+		if !ok {
+			continue
+		}
+		parameters.Parameter = append(parameters.Parameter, Parameter{
+			Name: "property",
+			Part: []Parameter{
+				{Name: "code", ValueCode: property.Code},
+				{Name: "value", ValueString: value},
+			},
+		})
+	}
+
+	return parameters
+}
+
+// CodeSystemLookup runs CodeSystem/$lookup with the spec loaded by LoadData.
+func CodeSystemLookup(system, code, version string) (*LookupResult, error) {
+	spec, err := GetSpec()
+	if err != nil {
+		return nil, err
+	}
+	return spec.CodeSystemLookup(system, code, version)
+}
+
+// CodeSystemValidateCode runs CodeSystem/$validate-code with the spec loaded by LoadData.
+func CodeSystemValidateCode(url, code, version, display string) (*ValidateCodeResult, error) {
+	spec, err := GetSpec()
+	if err != nil {
+		return nil, err
+	}
+	return spec.CodeSystemValidateCode(url, code, version, display)
+}
+
+// ValueSetValidateCode runs ValueSet/$validate-code with the spec loaded by LoadData.
+func ValueSetValidateCode(url, system, code, display string) (*ValidateCodeResult, error) {
+	spec, err := GetSpec()
+	if err != nil {
+		return nil, err
+	}
+	return spec.ValueSetValidateCode(url, system, code, display)
+}
+
+// CodeSystemLookup returns the details of code in the CodeSystem system, like
+// CodeSystem/$lookup. An unknown code is an error.
+func (l *LibraryData) CodeSystemLookup(system, code, version string) (*LookupResult, error) {
+	codeSystem, err := l.completeCodeSystem(system, version)
+	if err != nil {
+		return nil, err
+	}
+
+	concept := lookupConcept(codeSystem, code)
+	if concept == nil {
+		return nil, fmt.Errorf("unknown code '%s' in the code system '%s'", code, system)
+	}
+
+	return &LookupResult{
+		Name:       codeSystem.Name,
+		Version:    codeSystem.Version,
+		Display:    concept.Display,
+		Definition: concept.Definition,
+		Property:   concept.Property,
+	}, nil
+}
+
+// CodeSystemValidateCode checks that code is defined by the CodeSystem url, like
+// CodeSystem/$validate-code. Codes are compared honoring CodeSystem.caseSensitive, and
+// case sensitively when it is missing. The error is for a CodeSystem that is not loaded,
+// not for an invalid code.
+func (l *LibraryData) CodeSystemValidateCode(url, code, version, display string) (*ValidateCodeResult, error) {
+	codeSystem, err := l.completeCodeSystem(url, version)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ValidateCodeResult{System: url, Code: code}
+
+	concept := lookupConcept(codeSystem, code)
+	if concept == nil {
+		result.Message = fmt.Sprintf("Unknown code '%s' in the code system '%s'", code, url)
+		return result, nil
+	}
+
+	result.Result = true
+	result.Code = concept.Code
+	result.Display = concept.Display
+	result.Message = displayMessage(url, concept.Code, display, concept.Display)
+	return result, nil
+}
+
+// CodeSystemSubsumes tells how codeA and codeB of the CodeSystem system are related,
+// like CodeSystem/$subsumes: equivalent, subsumes (codeA subsumes codeB), subsumed-by or
+// not-subsumed. Unknown codes are an error.
+func (l *LibraryData) CodeSystemSubsumes(system, codeA, codeB string) (string, error) {
+	codeSystem, err := l.completeCodeSystem(system, "")
+	if err != nil {
+		return "", err
+	}
+
+	conceptA := lookupConcept(codeSystem, codeA)
+	if conceptA == nil {
+		return "", fmt.Errorf("unknown code '%s' in the code system '%s'", codeA, system)
+	}
+	conceptB := lookupConcept(codeSystem, codeB)
+	if conceptB == nil {
+		return "", fmt.Errorf("unknown code '%s' in the code system '%s'", codeB, system)
+	}
+
+	hierarchy := newConceptHierarchy(codeSystem)
+	switch {
+	case conceptA.Code == conceptB.Code:
+		return "equivalent", nil
+	case hierarchy.descendants(conceptA.Code)[conceptB.Code]:
+		return "subsumes", nil
+	case hierarchy.descendants(conceptB.Code)[conceptA.Code]:
+		return "subsumed-by", nil
+	}
+	return "not-subsumed", nil
+}
+
+// ValueSetValidateCode checks that system|code is in the expansion of the ValueSet url,
+// like ValueSet/$validate-code. An empty system accepts the code from any system of the
+// ValueSet. The error is for a ValueSet that cannot be expanded, not for an invalid code.
+func (l *LibraryData) ValueSetValidateCode(url, system, code, display string) (*ValidateCodeResult, error) {
+	// Bindings name the version of the spec they come from; use whatever is loaded.
+	url, _, _ = strings.Cut(url, "|")
+
+	expansion, err := l.ExpandValueSet(url, "")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ValidateCodeResult{System: system, Code: code}
+
+	caseSensitive := make(map[string]bool)
+	for _, contains := range expansion.Contains {
+		if system != "" && contains.System != system {
+			continue
+		}
+
+		sensitive, ok := caseSensitive[contains.System]
+		if !ok {
+			codeSystem, loaded := l.CodeSystemByURL(contains.System)
+			sensitive = !loaded || codeSystem.IsCaseSensitive()
+			caseSensitive[contains.System] = sensitive
+		}
+		if !codesEqual(contains.Code, code, sensitive) {
+			continue
+		}
+
+		result.Result = true
+		result.System = contains.System
+		result.Code = contains.Code
+		result.Display = contains.Display
+		result.Message = displayMessage(contains.System, contains.Code, display, contains.Display)
+		return result, nil
+	}
+
+	result.Message = fmt.Sprintf("The code '%s' is not in the value set '%s'", formatCode(system, code), url)
+	return result, nil
+}
+
+// ValueSetByURL returns the ValueSet with the given canonical URL. A "|version" suffix
+// is accepted; the loaded version is used whatever it says.
+func (l *LibraryData) ValueSetByURL(canonical string) (ValueSet, bool) {
+	url, _, _ := strings.Cut(canonical, "|")
+	valueSet, ok := l.Config[url].(ValueSet)
+	return valueSet, ok
+}
+
+// CodeSystemByURL returns the CodeSystem with the given canonical URL.
+func (l *LibraryData) CodeSystemByURL(canonical string) (CodeSystem, bool) {
+	url, _, _ := strings.Cut(canonical, "|")
+	codeSystem, ok := l.Config[url].(CodeSystem)
+	return codeSystem, ok
+}
+
+// completeCodeSystem returns the CodeSystem url when it is loaded with all its concepts.
+func (l *LibraryData) completeCodeSystem(url, version string) (CodeSystem, error) {
+	codeSystem, ok := l.CodeSystemByURL(url)
+	if !ok {
+		return codeSystem, fmt.Errorf("%w: code system '%s' is not loaded", ErrUnknownSystem, url)
+	}
+	if version != "" && codeSystem.Version != "" && codeSystem.Version != version {
+		return codeSystem, fmt.Errorf("code system '%s' version %s is not loaded (found %s)", url, version, codeSystem.Version)
+	}
+	if codeSystem.Content != "" && codeSystem.Content != "complete" {
+		return codeSystem, fmt.Errorf("%w: code system '%s' is loaded without its concepts (content: %s)", ErrUnknownSystem, url, codeSystem.Content)
+	}
+	return codeSystem, nil
+}
+
+// displayMessage explains a display that is not the one of system|code, if any.
+func displayMessage(system, code, display, expected string) string {
+	if display == "" || expected == "" || strings.EqualFold(strings.TrimSpace(display), expected) {
+		return ""
+	}
+	return fmt.Sprintf("The display '%s' is not the display of '%s'; expected '%s'", display, formatCode(system, code), expected)
+}
+
+// lookupConcept finds code in the CodeSystem, ignoring case only when it declares
+// caseSensitive false.
+func lookupConcept(codeSystem CodeSystem, code string) *Concept {
+	return findConceptFunc(codeSystem.Concept, func(c string) bool {
+		return codesEqual(c, code, codeSystem.IsCaseSensitive())
+	})
+}
+
+func codesEqual(a, b string, caseSensitive bool) bool {
+	if caseSensitive {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+func findConceptFunc(concepts []Concept, match func(string) bool) *Concept {
+	for i := range concepts {
+		if match(concepts[i].Code) {
+			return &concepts[i]
+		}
+		if found := findConceptFunc(concepts[i].Concept, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
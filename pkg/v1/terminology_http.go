@@ -0,0 +1,269 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxTerminologyResponse bounds the responses read from a terminology server.
+const maxTerminologyResponse = 32 << 20
+
+// HTTPTerminologyService is a TerminologyService that calls a FHIR terminology server,
+// e.g. https://tx.fhir.org/r4, with the GET form of the operations. A 404 response, or an
+// OperationOutcome with a not-found issue, is reported as ErrUnknownSystem.
+type HTTPTerminologyService struct {
+	BaseURL string
+	Client  *http.Client // http.DefaultClient when nil
+}
+
+// ValidateCode calls ValueSet/$validate-code.
+func (s HTTPTerminologyService) ValidateCode(ctx context.Context, valueSetURL, system, code, display string) (*ValidateCodeResult, error) {
+	query := url.Values{"url": {valueSetURL}, "code": {code}}
+	setQuery(query, "system", system)
+	setQuery(query, "display", display)
+
+	var parameters Parameters
+	if err := s.get(ctx, "/ValueSet/$validate-code", query, &parameters); err != nil {
+		return nil, err
+	}
+
+	result := &ValidateCodeResult{System: system, Code: code}
+	if parameter, ok := parameterByName(parameters, "result"); ok && parameter.ValueBoolean != nil {
+		result.Result = *parameter.ValueBoolean
+	}
+	if parameter, ok := parameterByName(parameters, "display"); ok {
+		result.Display = parameter.ValueString
+	}
+	if parameter, ok := parameterByName(parameters, "message"); ok {
+		result.Message = parameter.ValueString
+	}
+	return result, nil
+}
+
+// Expand calls ValueSet/$expand.
+func (s HTTPTerminologyService) Expand(ctx context.Context, valueSetURL, version string) (*ValueSetExpansion, error) {
+	query := url.Values{"url": {valueSetURL}}
+	setQuery(query, "valueSetVersion", version)
+
+	var valueSet ValueSet
+	if err := s.get(ctx, "/ValueSet/$expand", query, &valueSet); err != nil {
+		return nil, err
+	}
+	if valueSet.Expansion == nil {
+		return nil, fmt.Errorf("terminology server returned no expansion for '%s'", valueSetURL)
+	}
+	return valueSet.Expansion, nil
+}
+
+// Lookup calls CodeSystem/$lookup.
+func (s HTTPTerminologyService) Lookup(ctx context.Context, system, code, version string) (*LookupResult, error) {
+	query := url.Values{"system": {system}, "code": {code}}
+	setQuery(query, "version", version)
+
+	var parameters Parameters
+	if err := s.get(ctx, "/CodeSystem/$lookup", query, &parameters); err != nil {
+		return nil, err
+	}
+
+	result := &LookupResult{}
+	for _, parameter := range parameters.Parameter {
+		switch parameter.Name {
+		case "name":
+			result.Name = parameter.ValueString
+		case "version":
+			result.Version = parameter.ValueString
+		case "display":
+			result.Display = parameter.ValueString
+		case "definition":
+			result.Definition = parameter.ValueString
+		case "property":
+			property := ConceptProperty{}
+			for _, part := range parameter.Part {
+				switch part.Name {
+				case "code":
+					property.Code = part.ValueCode
+				case "value":
+					property.ValueCode = part.ValueCode
+					property.ValueString = part.ValueString
+					property.ValueBoolean = part.ValueBoolean
+				}
+			}
+			result.Property = append(result.Property, property)
+		}
+	}
+	return result, nil
+}
+
+// Subsumes calls CodeSystem/$subsumes.
+func (s HTTPTerminologyService) Subsumes(ctx context.Context, system, codeA, codeB string) (string, error) {
+	query := url.Values{"system": {system}, "codeA": {codeA}, "codeB": {codeB}}
+
+	var parameters Parameters
+	if err := s.get(ctx, "/CodeSystem/$subsumes", query, &parameters); err != nil {
+		return "", err
+	}
+
+	parameter, ok := parameterByName(parameters, "outcome")
+	if !ok {
+		return "", fmt.Errorf("terminology server returned no subsumption outcome")
+	}
+	return parameter.ValueCode, nil
+}
+
+// get calls an operation and decodes its JSON response into out.
+func (s HTTPTerminologyService) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	endpoint := strings.TrimSuffix(s.BaseURL, "/") + path + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/fhir+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("terminology server request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTerminologyResponse))
+	if err != nil {
+		return fmt.Errorf("failed to read terminology server response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return terminologyServerError(resp.StatusCode, body)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode terminology server response: %w", err)
+	}
+	return nil
+}
+
+// terminologyServerError turns an error response, usually an OperationOutcome, into an error.
+func terminologyServerError(status int, body []byte) error {
+	var outcome OperationOutcome
+	_ = json.Unmarshal(body, &outcome)
+
+	messages := make([]string, 0, len(outcome.Issue))
+	notFound := status == http.StatusNotFound
+	for _, issue := range outcome.Issue {
+		if issue.Code == "not-found" {
+			notFound = true
+		}
+		if issue.Diagnostics != "" {
+			messages = append(messages, issue.Diagnostics)
+		} else if issue.Details != nil && issue.Details.Text != "" {
+			messages = append(messages, issue.Details.Text)
+		}
+	}
+
+	// A server built with NewTerminologyHandler already says the system is unknown.
+	message := strings.TrimPrefix(strings.Join(messages, "; "), ErrUnknownSystem.Error()+": ")
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	if notFound {
+		return fmt.Errorf("%w: %s", ErrUnknownSystem, message)
+	}
+	return fmt.Errorf("terminology server returned %d: %s", status, message)
+}
+
+func setQuery(query url.Values, key, value string) {
+	if value != "" {
+		query.Set(key, value)
+	}
+}
+
+func parameterByName(parameters Parameters, name string) (Parameter, bool) {
+	for _, parameter := range parameters.Parameter {
+		if parameter.Name == name {
+			return parameter, true
+		}
+	}
+	return Parameter{}, false
+}
+
+// NewTerminologyHandler serves service with the GET form of the FHIR terminology REST API
+// that HTTPTerminologyService calls: ValueSet/$validate-code, ValueSet/$expand,
+// CodeSystem/$lookup and CodeSystem/$subsumes. With a LocalTerminologyService over a
+// directory of CodeSystems and ValueSets it is a stand-in for a terminology server.
+func NewTerminologyHandler(service TerminologyService) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /ValueSet/$validate-code", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		result, err := service.ValidateCode(r.Context(), q.Get("url"), q.Get("system"), q.Get("code"), q.Get("display"))
+		if err != nil {
+			writeTerminologyError(w, err)
+			return
+		}
+		writeFHIRJSON(w, http.StatusOK, result.Parameters())
+	})
+
+	mux.HandleFunc("GET /ValueSet/$expand", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		expansion, err := service.Expand(r.Context(), q.Get("url"), q.Get("valueSetVersion"))
+		if err != nil {
+			writeTerminologyError(w, err)
+			return
+		}
+		writeFHIRJSON(w, http.StatusOK, ValueSet{ResourceType: "ValueSet", URL: q.Get("url"), Status: "active", Expansion: expansion})
+	})
+
+	mux.HandleFunc("GET /CodeSystem/$lookup", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		result, err := service.Lookup(r.Context(), q.Get("system"), q.Get("code"), q.Get("version"))
+		if err != nil {
+			writeTerminologyError(w, err)
+			return
+		}
+		writeFHIRJSON(w, http.StatusOK, result.Parameters())
+	})
+
+	mux.HandleFunc("GET /CodeSystem/$subsumes", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		outcome, err := service.Subsumes(r.Context(), q.Get("system"), q.Get("codeA"), q.Get("codeB"))
+		if err != nil {
+			writeTerminologyError(w, err)
+			return
+		}
+		writeFHIRJSON(w, http.StatusOK, Parameters{
+			ResourceType: "Parameters",
+			Parameter:    []Parameter{{Name: "outcome", ValueCode: outcome}},
+		})
+	})
+
+	return mux
+}
+
+func writeTerminologyError(w http.ResponseWriter, err error) {
+	status, code := http.StatusBadRequest, "invalid"
+	if errors.Is(err, ErrUnknownSystem) {
+		status, code = http.StatusNotFound, "not-found"
+	}
+
+	outcome := &OperationOutcome{ResourceType: "OperationOutcome"}
+	addOperationOutcome(outcome, code, err.Error(), "", "", "error")
+	writeFHIRJSON(w, status, outcome)
+}
+
+func writeFHIRJSON(w http.ResponseWriter, status int, resource interface{}) {
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		fmt.Printf("Error writing terminology response %s\n", err)
+	}
+}
@@ -0,0 +1,162 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTerminologyServer serves testCodeSystem and a ValueSet of its mammals with
+// NewTerminologyHandler, and returns a client for it.
+func newTerminologyServer(t *testing.T) HTTPTerminologyService {
+	t.Helper()
+	library := testLibrary(t, testCodeSystem,
+		testValueSet("http://example.org/ValueSet/mammals", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "is-a", "value": "mammal"}]}]}`),
+	)
+
+	server := httptest.NewServer(NewTerminologyHandler(LocalTerminologyService{Spec: library}))
+	t.Cleanup(server.Close)
+
+	return HTTPTerminologyService{BaseURL: server.URL + "/", Client: server.Client()}
+}
+
+func TestHTTPTerminologyServiceValidateCode(t *testing.T) {
+	service := newTerminologyServer(t)
+
+	tests := []struct {
+		name        string
+		system      string
+		code        string
+		display     string
+		wantResult  bool
+		wantDisplay string
+		wantMessage string
+	}{
+		{"code in the value set", "http://example.org/animals", "dog", "", true, "Dog", ""},
+		{"any system", "", "cat", "", true, "Cat", ""},
+		{"wrong display", "http://example.org/animals", "dog", "Hound", true, "Dog", "The display 'Hound' is not the display of 'http://example.org/animals#dog'; expected 'Dog'"},
+		{"code not in the value set", "http://example.org/animals", "bird", "", false, "", "The code 'http://example.org/animals#bird' is not in the value set 'http://example.org/ValueSet/mammals'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := service.ValidateCode(context.Background(), "http://example.org/ValueSet/mammals", tt.system, tt.code, tt.display)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Result != tt.wantResult || result.Display != tt.wantDisplay || result.Message != tt.wantMessage {
+				t.Errorf("got %+v, want result %v, display %q and message %q", result, tt.wantResult, tt.wantDisplay, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestHTTPTerminologyServiceLookup(t *testing.T) {
+	service := newTerminologyServer(t)
+
+	result, err := service.Lookup(context.Background(), "http://example.org/animals", "cat", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &LookupResult{
+		Version:  "1.0.0",
+		Display:  "Cat",
+		Property: []ConceptProperty{{Code: "status", ValueString: "retired"}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+
+	_, err = service.Lookup(context.Background(), "http://example.org/animals", "unicorn", "")
+	if err == nil || errors.Is(err, ErrUnknownSystem) || !strings.Contains(err.Error(), "returned 400: unknown code 'unicorn'") {
+		t.Errorf("unknown code: got %v", err)
+	}
+}
+
+func TestHTTPTerminologyServiceExpandAndSubsumes(t *testing.T) {
+	service := newTerminologyServer(t)
+
+	expansion, err := service.Expand(context.Background(), "http://example.org/ValueSet/mammals", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := expansionCodes(expansion); !reflect.DeepEqual(got, []string{"cat", "dog", "mammal"}) {
+		t.Errorf("expansion = %v", got)
+	}
+
+	outcome, err := service.Subsumes(context.Background(), "http://example.org/animals", "mammal", "dog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != "subsumes" {
+		t.Errorf("outcome = %s, want subsumes", outcome)
+	}
+}
+
+func TestHTTPTerminologyServiceUnknownSystem(t *testing.T) {
+	service := newTerminologyServer(t)
+
+	_, err := service.Lookup(context.Background(), "http://example.org/unknown", "a", "")
+	if !errors.Is(err, ErrUnknownSystem) {
+		t.Fatalf("unknown code system: got %v, want ErrUnknownSystem", err)
+	}
+	// The prefix the handler wrote is not repeated.
+	if strings.Count(err.Error(), ErrUnknownSystem.Error()) != 1 {
+		t.Errorf("message = %q", err)
+	}
+
+	if _, err := service.ValidateCode(context.Background(), "http://example.org/ValueSet/unknown", "", "a", ""); !errors.Is(err, ErrUnknownSystem) {
+		t.Errorf("unknown value set: got %v, want ErrUnknownSystem", err)
+	}
+}
+
+func TestHTTPTerminologyServiceErrorResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantUnknown bool
+		want        string
+	}{
+		{"404 without a body", http.StatusNotFound, "", true, "Not Found"},
+		{"not-found issue", http.StatusBadRequest, `{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "not-found", "diagnostics": "Unknown system"}]}`, true, "Unknown system"},
+		{"server error", http.StatusInternalServerError, `{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "exception", "details": {"text": "boom"}}]}`, false, "terminology server returned 500: boom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			service := HTTPTerminologyService{BaseURL: server.URL, Client: server.Client()}
+			_, err := service.ValidateCode(context.Background(), "http://example.org/ValueSet/test", "", "a", "")
+			if err == nil || errors.Is(err, ErrUnknownSystem) != tt.wantUnknown || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q (unknown system: %v)", err, tt.want, tt.wantUnknown)
+			}
+		})
+	}
+}
+
+func TestChainTerminologyServiceFallsBackToServer(t *testing.T) {
+	remote := newTerminologyServer(t)
+	chain := ChainTerminologyService{LocalTerminologyService{Spec: testLibrary(t)}, remote}
+
+	result, err := chain.ValidateCode(context.Background(), "http://example.org/ValueSet/mammals", "http://example.org/animals", "dog", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Result {
+		t.Errorf("got %+v, want the code validated by the server", result)
+	}
+
+	if _, err := chain.Lookup(context.Background(), "http://example.org/unknown", "a", ""); !errors.Is(err, ErrUnknownSystem) {
+		t.Errorf("got %v, want ErrUnknownSystem when no service knows the system", err)
+	}
+}
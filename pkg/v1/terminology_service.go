@@ -0,0 +1,108 @@
+package v1
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnknownSystem is wrapped by the errors of a TerminologyService that does not know
+// the code system or value set it is asked about.
+var ErrUnknownSystem = errors.New("unknown system")
+
+// TerminologyService answers the terminology operations the validator needs. The
+// binding checks call ValidateCode; a code system or value set the service does not know
+// is reported with an error wrapping ErrUnknownSystem.
+type TerminologyService interface {
+	// ValidateCode is ValueSet/$validate-code. An empty system accepts the code from any
+	// system of the value set.
+	ValidateCode(ctx context.Context, valueSetURL, system, code, display string) (*ValidateCodeResult, error)
+	// Expand is ValueSet/$expand.
+	Expand(ctx context.Context, url, version string) (*ValueSetExpansion, error)
+	// Lookup is CodeSystem/$lookup.
+	Lookup(ctx context.Context, system, code, version string) (*LookupResult, error)
+	// Subsumes is CodeSystem/$subsumes; the outcome is equivalent, subsumes,
+	// subsumed-by or not-subsumed.
+	Subsumes(ctx context.Context, system, codeA, codeB string) (string, error)
+}
+
+// LocalTerminologyService answers from the CodeSystems and ValueSets loaded in Spec.
+// It is the default TerminologyService of a Validator.
+type LocalTerminologyService struct {
+	Spec *LibraryData
+}
+
+// ValidateCode calls Spec.ValueSetValidateCode.
+func (s LocalTerminologyService) ValidateCode(ctx context.Context, valueSetURL, system, code, display string) (*ValidateCodeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Spec.ValueSetValidateCode(valueSetURL, system, code, display)
+}
+
+// Expand calls Spec.ExpandValueSet.
+func (s LocalTerminologyService) Expand(ctx context.Context, url, version string) (*ValueSetExpansion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Spec.ExpandValueSet(url, version)
+}
+
+// Lookup calls Spec.CodeSystemLookup.
+func (s LocalTerminologyService) Lookup(ctx context.Context, system, code, version string) (*LookupResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Spec.CodeSystemLookup(system, code, version)
+}
+
+// Subsumes calls Spec.CodeSystemSubsumes.
+func (s LocalTerminologyService) Subsumes(ctx context.Context, system, codeA, codeB string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return s.Spec.CodeSystemSubsumes(system, codeA, codeB)
+}
+
+// ChainTerminologyService asks each service in turn until one knows the code system or
+// value set, e.g. the local definitions first and a terminology server for SNOMED CT.
+type ChainTerminologyService []TerminologyService
+
+// ValidateCode returns the answer of the first service that knows valueSetURL.
+func (c ChainTerminologyService) ValidateCode(ctx context.Context, valueSetURL, system, code, display string) (*ValidateCodeResult, error) {
+	return chainCall(c, func(s TerminologyService) (*ValidateCodeResult, error) {
+		return s.ValidateCode(ctx, valueSetURL, system, code, display)
+	})
+}
+
+// Expand returns the expansion of the first service that knows url.
+func (c ChainTerminologyService) Expand(ctx context.Context, url, version string) (*ValueSetExpansion, error) {
+	return chainCall(c, func(s TerminologyService) (*ValueSetExpansion, error) {
+		return s.Expand(ctx, url, version)
+	})
+}
+
+// Lookup returns the answer of the first service that knows system.
+func (c ChainTerminologyService) Lookup(ctx context.Context, system, code, version string) (*LookupResult, error) {
+	return chainCall(c, func(s TerminologyService) (*LookupResult, error) {
+		return s.Lookup(ctx, system, code, version)
+	})
+}
+
+// Subsumes returns the answer of the first service that knows system.
+func (c ChainTerminologyService) Subsumes(ctx context.Context, system, codeA, codeB string) (string, error) {
+	return chainCall(c, func(s TerminologyService) (string, error) {
+		return s.Subsumes(ctx, system, codeA, codeB)
+	})
+}
+
+func chainCall[T any](services []TerminologyService, call func(TerminologyService) (T, error)) (T, error) {
+	var result T
+	err := error(ErrUnknownSystem)
+	for _, service := range services {
+		result, err = call(service)
+		if !errors.Is(err, ErrUnknownSystem) {
+			return result, err
+		}
+	}
+	return result, err
+}
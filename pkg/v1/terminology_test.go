@@ -0,0 +1,167 @@
+package v1
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCodeSystemValidateCode(t *testing.T) {
+	library := testLibrary(t, testCodeSystem,
+		`{"resourceType": "CodeSystem", "url": "http://example.org/insensitive", "content": "complete", "caseSensitive": false, "concept": [{"code": "ABC", "display": "Abc"}]}`,
+		`{"resourceType": "CodeSystem", "url": "http://example.org/undeclared", "content": "complete", "concept": [{"code": "ABC", "display": "Abc"}]}`,
+	)
+
+	tests := []struct {
+		name        string
+		url, code   string
+		display     string
+		wantResult  bool
+		wantCode    string
+		wantMessage string
+	}{
+		{"nested code", "http://example.org/animals", "dog", "", true, "dog", ""},
+		{"matching display", "http://example.org/animals", "dog", "dog ", true, "dog", ""},
+		{"wrong display", "http://example.org/animals", "dog", "Hound", true, "dog", "The display 'Hound' is not the display of 'http://example.org/animals#dog'; expected 'Dog'"},
+		{"unknown code", "http://example.org/animals", "unicorn", "", false, "unicorn", "Unknown code 'unicorn' in the code system 'http://example.org/animals'"},
+		{"case sensitive", "http://example.org/animals", "Dog", "", false, "Dog", "Unknown code 'Dog'"},
+		{"case insensitive", "http://example.org/insensitive", "abc", "", true, "ABC", ""},
+		{"caseSensitive missing", "http://example.org/undeclared", "abc", "", false, "abc", "Unknown code 'abc'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := library.CodeSystemValidateCode(tt.url, tt.code, "", tt.display)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Result != tt.wantResult || result.Code != tt.wantCode || !strings.HasPrefix(result.Message, tt.wantMessage) || (tt.wantMessage == "" && result.Message != "") {
+				t.Errorf("got %+v, want result %v, code %q and message %q", result, tt.wantResult, tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestCodeSystemValidateCodeErrors(t *testing.T) {
+	library := testLibrary(t, testCodeSystem,
+		`{"resourceType": "CodeSystem", "url": "http://example.org/fragment", "content": "not-present"}`,
+	)
+
+	if _, err := library.CodeSystemValidateCode("http://example.org/unknown", "a", "", ""); !errors.Is(err, ErrUnknownSystem) {
+		t.Errorf("unknown system: got %v, want ErrUnknownSystem", err)
+	}
+	if _, err := library.CodeSystemValidateCode("http://example.org/fragment", "a", "", ""); !errors.Is(err, ErrUnknownSystem) {
+		t.Errorf("code system without concepts: got %v, want ErrUnknownSystem", err)
+	}
+	if _, err := library.CodeSystemValidateCode("http://example.org/animals", "dog", "2.0.0", ""); err == nil {
+		t.Error("no error for a version that is not loaded")
+	}
+}
+
+func TestValueSetValidateCode(t *testing.T) {
+	library := testLibrary(t, testCodeSystem,
+		`{"resourceType": "CodeSystem", "url": "http://example.org/undeclared", "content": "complete", "concept": [{"code": "ABC", "display": "Abc"}]}`,
+		testValueSet("http://example.org/ValueSet/mammals", `{"include": [{"system": "http://example.org/animals", "filter": [{"property": "concept", "op": "is-a", "value": "mammal"}]}]}`),
+		testValueSet("http://example.org/ValueSet/undeclared", `{"include": [{"system": "http://example.org/undeclared"}]}`),
+	)
+
+	tests := []struct {
+		name       string
+		url        string
+		system     string
+		code       string
+		display    string
+		wantResult bool
+		wantSystem string
+	}{
+		{"code in the value set", "http://example.org/ValueSet/mammals", "http://example.org/animals", "cat", "", true, "http://example.org/animals"},
+		{"versioned canonical", "http://example.org/ValueSet/mammals|4.0.1", "http://example.org/animals", "cat", "", true, "http://example.org/animals"},
+		{"any system", "http://example.org/ValueSet/mammals", "", "dog", "", true, "http://example.org/animals"},
+		{"code not in the value set", "http://example.org/ValueSet/mammals", "http://example.org/animals", "bird", "", false, "http://example.org/animals"},
+		{"other system", "http://example.org/ValueSet/mammals", "http://example.org/other", "cat", "", false, "http://example.org/other"},
+		{"case sensitive", "http://example.org/ValueSet/mammals", "http://example.org/animals", "CAT", "", false, "http://example.org/animals"},
+		{"caseSensitive missing", "http://example.org/ValueSet/undeclared", "http://example.org/undeclared", "abc", "", false, "http://example.org/undeclared"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := library.ValueSetValidateCode(tt.url, tt.system, tt.code, tt.display)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Result != tt.wantResult || result.System != tt.wantSystem {
+				t.Errorf("got %+v, want result %v and system %q", result, tt.wantResult, tt.wantSystem)
+			}
+			if !tt.wantResult && !strings.Contains(result.Message, "is not in the value set") {
+				t.Errorf("message = %q", result.Message)
+			}
+		})
+	}
+
+	if _, err := library.ValueSetValidateCode("http://example.org/ValueSet/unknown", "", "a", ""); !errors.Is(err, ErrUnknownSystem) {
+		t.Errorf("unknown value set: got %v, want ErrUnknownSystem", err)
+	}
+}
+
+func TestCodeSystemLookup(t *testing.T) {
+	library := testLibrary(t, testCodeSystem)
+
+	result, err := library.CodeSystemLookup("http://example.org/animals", "cat", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Display != "Cat" || result.Version != "1.0.0" {
+		t.Errorf("got %+v", result)
+	}
+
+	got := result.Parameters()
+	want := Parameters{
+		ResourceType: "Parameters",
+		Parameter: []Parameter{
+			{Name: "version", ValueString: "1.0.0"},
+			{Name: "display", ValueString: "Cat"},
+			{Name: "property", Part: []Parameter{{Name: "code", ValueCode: "status"}, {Name: "value", ValueString: "retired"}}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parameters() = %+v, want %+v", got, want)
+	}
+
+	if _, err := library.CodeSystemLookup("http://example.org/animals", "unicorn", ""); err == nil {
+		t.Error("no error for an unknown code")
+	}
+}
+
+func TestValidateCodeResultParameters(t *testing.T) {
+	result := ValidateCodeResult{Result: true, Display: "Dog", Message: "check the display"}
+	parameters := result.Parameters()
+
+	if len(parameters.Parameter) != 3 || parameters.Parameter[0].Name != "result" || parameters.Parameter[0].ValueBoolean == nil || !*parameters.Parameter[0].ValueBoolean {
+		t.Fatalf("got %+v", parameters)
+	}
+	if parameters.Parameter[1].ValueString != "Dog" || parameters.Parameter[2].ValueString != "check the display" {
+		t.Errorf("got %+v", parameters)
+	}
+}
+
+func TestCodeSystemSubsumes(t *testing.T) {
+	library := testLibrary(t, testCodeSystem)
+
+	tests := []struct{ codeA, codeB, want string }{
+		{"dog", "dog", "equivalent"},
+		{"animal", "dog", "subsumes"},
+		{"animal", "bird", "subsumes"},
+		{"cat", "mammal", "subsumed-by"},
+		{"cat", "bird", "not-subsumed"},
+	}
+	for _, tt := range tests {
+		got, err := library.CodeSystemSubsumes("http://example.org/animals", tt.codeA, tt.codeB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("CodeSystemSubsumes(%s, %s) = %s, want %s", tt.codeA, tt.codeB, got, tt.want)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
 )
 
 // IsArrayElement determines if the given element should be treated as an array based on its max cardinality.
@@ -80,6 +82,95 @@ func joinPath(parent, field string) string {
 	return parent + "." + field
 }
 
+// isDirectChild reports whether path is a field of rootPath, e.g. Patient.name of Patient.
+func isDirectChild(rootPath, path string) bool {
+	field, found := strings.CutPrefix(path, rootPath+".")
+	return found && !strings.Contains(field, ".")
+}
+
+// hasElementPath reports whether spec has an element with the given path.
+func hasElementPath(spec StructureDefinition, path string) bool {
+	for _, element := range spec.Snapshot.Element {
+		if element.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// closestName returns the name closest to key by edit distance, ignoring case, or ""
+// when none is close enough to be a likely misspelling.
+func closestName(key string, names map[string]bool) string {
+	best, bestDistance := "", -1
+	for name := range names {
+		distance := editDistance(strings.ToLower(key), strings.ToLower(name))
+		if bestDistance < 0 || distance < bestDistance || (distance == bestDistance && name < best) {
+			best, bestDistance = name, distance
+		}
+	}
+
+	if bestDistance < 0 || bestDistance > 2 && bestDistance > len(key)/3 {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case nil:
+		return "null"
+	}
+	return "object"
+}
+
+// expectedJSONType returns the JSON type that represents a FHIR type: booleans and
+// numbers for their primitives, strings for the other primitives and objects for
+// complex types.
+func expectedJSONType(typeCode string) string {
+	switch strings.TrimPrefix(typeCode, "http://hl7.org/fhirpath/System.") {
+	case "boolean", "Boolean":
+		return "boolean"
+	case "integer", "positiveInt", "unsignedInt", "decimal", "Integer", "Decimal":
+		return "number"
+	}
+	if strings.HasPrefix(typeCode, "http://hl7.org/fhirpath/System.") || fhirpath.IsPrimitiveType(typeCode) {
+		return "string"
+	}
+	return "object"
+}
+
 func IsMultipleType(element Element) bool {
 	if strings.Contains(element.Path, "[x]") {
 		return true
@@ -3,9 +3,13 @@ package v1
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"math"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/robertoAraneda/go-fhir-validator/pkg/fhirpath"
 )
 
 // FhirR4ResourceTypes contains all resource types in FHIR R4.
@@ -42,8 +46,6 @@ var FhirR4ResourceTypes = []string{
 	"VisionPrescription",
 }
 
-var payload []*FhirPathPayload
-
 // addOperationOutcome appends an issue to the OperationOutcome, with optional details about the incoming value type
 func addOperationOutcome(outcome *OperationOutcome, code, diagnostic, location, details, severity string) {
 	issue := IssueEntry{
@@ -64,7 +66,7 @@ func addOperationOutcome(outcome *OperationOutcome, code, diagnostic, location,
 }
 
 // validateElements applies a validation function to multiple elements.
-func validateElements(
+func (c *validation) validateElements(
 	rootData map[string]interface{},
 	data map[string]interface{},
 	elements []Element,
@@ -80,6 +82,10 @@ func validateElements(
 
 	// Use index-based iteration to prevent range aliasing issues
 	for i := 0; i < len(elements); i++ {
+		if c.done() {
+			return // Validator.Validate reports the partial outcome
+		}
+
 		if elements[i].Path == "" {
 			addOperationOutcome(outcome, "invalid", "Element has an empty path", parentPath, "Path is empty", "error")
 			continue
@@ -89,77 +95,6 @@ func validateElements(
 	}
 }
 
-func ValidateResource(data map[string]interface{}) (*OperationOutcome, error) {
-
-	outcome := &OperationOutcome{ResourceType: "OperationOutcome"}
-	payload = []*FhirPathPayload{}
-
-	// extract the resource type
-	resourceType, ok := data["resourceType"].(string)
-
-	if !ok {
-		return nil, fmt.Errorf("resource type not found")
-	}
-
-	// check if the resource type is valid
-	if !contains(FhirR4ResourceTypes, resourceType) {
-		// stringify the resource types
-		resourceTypes := strings.Join(FhirR4ResourceTypes, ", ")
-		addOperationOutcome(outcome, "error", fmt.Sprintf("Invalid resource type '%s'. Expected one of: %s", resourceType, resourceTypes), "", "Invalid resource type", "error")
-		return outcome, nil
-	}
-
-	spec, ok := specLibraryData.Config[resourceType]
-	if !ok {
-		return nil, fmt.Errorf("resource type '%s' not found in definitions", resourceType)
-	}
-
-	Validate(data, data, spec.(StructureDefinition), spec.(StructureDefinition), resourceType, outcome)
-
-	// create a file with the payload
-	payloadJSON, _ := json.MarshalIndent(payload, "", "  ")
-	err := os.WriteFile("payload.json", payloadJSON, 0644)
-	if err != nil {
-		fmt.Printf("Error writing payload file %s\n", err)
-	}
-
-	//response, err := FhirPathValidator(rootData, specLibraryData, constraint.Expression)
-
-	results, trace, err := FhirPathValidatorMultiple(payload)
-
-	if err != nil {
-		fmt.Printf("Error validating constraint %s\n", err)
-		addOperationOutcome(outcome, "exception", fmt.Sprintf("Error validating constraint %s", err), "", "", "fatal")
-		return outcome, nil
-	}
-
-	fmt.Printf("Results: %v\n", results)
-	fmt.Printf("Trace: %v\n", trace)
-
-	if len(outcome.Issue) == 0 && len(*results) == 0 {
-		addOperationOutcome(outcome, "information", "Validation successful", "", "", "information")
-	} else {
-		for i := 0; i < len(*results); i++ {
-			diagnostics := fmt.Sprintf("Failed constraint '%s'", (*results)[i].Key)
-			code := "invariant"
-			details := fmt.Sprintf("%s: %s", (*results)[i].Key, (*results)[i].Human)
-			if (*results)[i].Source != "" {
-				diagnostics = fmt.Sprintf("Failed constraint '%s' (source: %s)", (*results)[i].Key, (*results)[i].Source)
-			}
-
-			if (*results)[i].Key == "dom-6" {
-				diagnostics = fmt.Sprintf("Failed constraint '%s' (source: %s)", (*results)[i].Key, (*results)[i].Source)
-				code = "informational"
-
-			}
-			// generate better response "Failed constraint '%s'" if (*results)[i].Source is present, use it
-			addOperationOutcome(outcome, code, diagnostics, (*results)[i].Path, details, (*results)[i].Severity)
-		}
-	}
-
-	return outcome, nil
-}
-
 type FhirPathPayload struct {
 	RootData             map[string]interface{} `json:"rootData"`
 	Data                 map[string]interface{} `json:"data"`
@@ -170,11 +105,10 @@ type FhirPathPayload struct {
 	ConstraintSeverity   string                 `json:"constraintSeverity"`
 	ConstraintSource     string                 `json:"constraintSource"`
 	ParentPath           string                 `json:"parentPath"`
+	DataType             string                 `json:"dataType,omitempty"`
 }
 
-func Validate(rootData map[string]interface{}, data map[string]interface{}, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
-
-	fmt.Printf("Validating %s, %s, from %s\n", rootSpec.ID, spec.ID, parentPath)
+func (c *validation) Validate(rootData map[string]interface{}, data map[string]interface{}, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
 
 	if len(data) == 0 {
 		return // Exit early if no specLibraryData to validate
@@ -183,34 +117,41 @@ func Validate(rootData map[string]interface{}, data map[string]interface{}, root
 	elements := spec.Snapshot.Element
 	backboneElementLookup := make(map[string]struct{}) // Efficient lookup for backbone elements
 	topLevelElements := make([]Element, 0, len(elements))
-	nestedBackboneElements := make([]Element, 0, len(elements))
+	backboneElements := make([]Element, 0, len(elements))
 	elementsWithVariableTypes := make([]Element, 0, len(elements))
 
 	// Categorize elements into separate groups
-	CategorizeElements(elements, backboneElementLookup, &topLevelElements, &nestedBackboneElements, &elementsWithVariableTypes)
+	CategorizeElements(elements, backboneElementLookup, &topLevelElements, &backboneElements, &elementsWithVariableTypes)
+
+	// Properties that are not elements of the type are reported with a suggestion
+	c.validateUnknownElements(data, spec, parentPath, outcome)
 
 	// Validate each category separately
-	validateElements(rootData, data, topLevelElements, rootSpec, spec, parentPath, outcome, ValidateElement)
-	validateElements(rootData, data, nestedBackboneElements, rootSpec, spec, parentPath, outcome, ValidateBackboneElement)
-	validateElements(rootData, data, elementsWithVariableTypes, rootSpec, spec, parentPath, outcome, ValidateElementWithMultipleTypes)
-	// ValidateUnderscoreFields(rootData, specLibraryData, parentPath, rootSpec, specLibraryData, outcome)
+	c.validateElements(rootData, data, topLevelElements, rootSpec, spec, parentPath, outcome, c.ValidateElement)
+	c.validateElements(rootData, data, backboneElements, rootSpec, spec, parentPath, outcome, c.ValidateBackboneElement)
+	c.validateElements(rootData, data, elementsWithVariableTypes, rootSpec, spec, parentPath, outcome, c.ValidateElementWithMultipleTypes)
 
 	// find the constraints in the specLibraryData.Snapshot.Element when id is equal to specLibraryData.ID
+	// The constraints of the children are queued with their values (see ValidateValue)
+	constraints, _ := findMatchingElementDos(data, spec, c.skippedConstraints)
 
-	constraints, _ := findMatchingElementDos(data, spec)
-
-	// Map to track unique payload entries (key: constraintKey + parentPath)
-	payloadSet := make(map[string]bool)
+	c.queueConstraints(rootData, data, *constraints, spec.Type, parentPath)
+}
 
-	// TODO: fix this not getting all constrains for all elements.
-	for i := 0; i < len(*constraints); i++ {
-		constraint := (*constraints)[i]
+// queueConstraints adds the constraints to evaluate on data to the FHIRPath payload.
+func (c *validation) queueConstraints(rootData map[string]interface{}, data map[string]interface{}, constraints []Constraint, dataType string, path string) {
+	for i := 0; i < len(constraints); i++ {
+		constraint := constraints[i]
+		if contains(c.skippedConstraints, constraint.Key) {
+			continue
+		}
 
-		payloadKey := fmt.Sprintf("%s|%s", constraint.Key, parentPath)
-		if _, exists := payloadSet[payloadKey]; exists {
+		// A profile repeats the constraints of its base, so track them for the whole validation
+		payloadKey := fmt.Sprintf("%s|%s", constraint.Key, path)
+		if _, exists := c.payloadSet[payloadKey]; exists {
 			continue // Skip duplicates
 		}
-		payloadSet[payloadKey] = true
+		c.payloadSet[payloadKey] = true
 
 		var item = FhirPathPayload{
 			RootData:             rootData,
@@ -220,10 +161,11 @@ func Validate(rootData map[string]interface{}, data map[string]interface{}, root
 			ConstraintHuman:      constraint.Human,
 			ConstraintSeverity:   constraint.Severity,
 			ConstraintSource:     constraint.Source,
-			ParentPath:           parentPath,
+			ParentPath:           path,
+			DataType:             dataType,
 		}
 
-		payload = append(payload, &item)
+		c.payload = append(c.payload, &item)
 	}
 }
 
@@ -232,19 +174,33 @@ func CategorizeElements(
 	elements []Element,
 	backboneElementMap map[string]struct{},
 	topLevelElements *[]Element,
-	nestedBackboneElements *[]Element,
+	backboneElements *[]Element,
 	multiTypeElements *[]Element,
 ) {
+	if len(elements) == 0 {
+		return
+	}
+	rootPath := elements[0].Path
+
 	for i := range elements {
 		element := &elements[i]
 
 		switch {
+		case i == 0:
+			// The root element, e.g. Patient or the backbone element of a backbone type
+		case strings.Contains(element.ID, ":"):
+			// Slices and their children constrain the items of the sliced element
 		case IsBackboneElement(*element):
 			backboneElementMap[element.ID] = struct{}{}
+			if isDirectChild(rootPath, element.Path) {
+				*backboneElements = append(*backboneElements, *element)
+			}
+		case IsNestedInBackbone(element.Path, backboneElementMap):
+			// Children of a backbone element, validated with it (see backboneType)
+		case !isDirectChild(rootPath, element.Path):
+			// Children of a complex-type element, validated with the type (see constrainedType)
 		case IsMultipleType(*element):
 			*multiTypeElements = append(*multiTypeElements, *element)
-		case IsNestedInBackbone(element.Path, backboneElementMap):
-			*nestedBackboneElements = append(*nestedBackboneElements, *element)
 		default:
 			if !strings.Contains(element.Path, "[x]") {
 				*topLevelElements = append(*topLevelElements, *element)
@@ -253,13 +209,190 @@ func CategorizeElements(
 	}
 }
 
-func ValidateElementWithMultipleTypes(rootData map[string]interface{}, data map[string]interface{}, element Element, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
-	fmt.Printf("Validating element with multiple types %s\n", element.Path)
+// validateUnknownElements reports the properties of data that are not elements of spec,
+// e.g. birthdate instead of birthDate, suggesting the closest element name.
+func (c *validation) validateUnknownElements(data map[string]interface{}, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
+	if len(spec.Snapshot.Element) == 0 {
+		return
+	}
+	rootPath := spec.Snapshot.Element[0].Path
+
+	// The JSON names of the elements; a choice element has one per allowed type.
+	names := make(map[string]bool)
+	var choices []string
+	for _, element := range spec.Snapshot.Element {
+		if strings.Contains(element.ID, ":") || !isDirectChild(rootPath, element.Path) {
+			continue
+		}
+
+		name := strings.TrimPrefix(element.Path, rootPath+".")
+		if choice, found := strings.CutSuffix(name, "[x]"); found {
+			for _, t := range element.Type {
+				names[choice+fhirpath.UpperFirst(t.Code)] = true
+			}
+			choices = append(choices, choice)
+			continue
+		}
+		names[name] = true
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // report in a stable order
+
+	for _, key := range keys {
+		if names[key] || (key == "resourceType" && spec.Kind == "resource") {
+			continue
+		}
+		// _birthDate holds the id and extensions of the primitive birthDate
+		if primitive, found := strings.CutPrefix(key, "_"); found && names[primitive] {
+			continue
+		}
+		// A choice with a type that is not allowed is reported by ValidateElementWithMultipleTypes
+		if choiceKey(key, choices) {
+			continue
+		}
+
+		path := joinPath(parentPath, key)
+		diagnostics := fmt.Sprintf("Unknown element '%s' at '%s'", key, path)
+		if suggestion := closestName(key, names); suggestion != "" {
+			diagnostics += fmt.Sprintf(". Did you mean '%s'?", suggestion)
+		}
+		addOperationOutcome(outcome, "structure", diagnostics, path, "Unknown element", "error")
+	}
 }
 
-// ValidateBackboneElement validates a single element against the specification
-func ValidateBackboneElement(rootData map[string]interface{}, data map[string]interface{}, element Element, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
-	fmt.Printf("Validating backbone element %s\n", element.Path)
+// ValidateElementWithMultipleTypes validates a choice element, e.g. Condition.onset[x].
+// The type of the value is given by the suffix of its property name (onsetDateTime,
+// onsetAge); it must be one of the types of the element, and only one of them may be
+// present. The value is then validated as an element of that type.
+func (c *validation) ValidateElementWithMultipleTypes(rootData map[string]interface{}, data map[string]interface{}, element Element, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
+	name := strings.TrimSuffix(strings.TrimPrefix(element.Path, spec.Type+"."), "[x]")
+	choicePath := joinPath(parentPath, name+"[x]")
+
+	allowed := make([]string, 0, len(element.Type))
+	for _, t := range element.Type {
+		allowed = append(allowed, t.Code)
+	}
+
+	// The properties of data that hold a value of the choice, or only its extensions (_valueString)
+	var keys []string
+	seen := make(map[string]bool)
+	for key := range data {
+		key = strings.TrimPrefix(key, "_")
+		if _, ok := fhirpath.ChoiceTypeSuffix(name, key); !ok || seen[key] {
+			continue
+		}
+		if hasElementPath(spec, spec.Type+"."+key) {
+			continue // another element whose name starts like the choice
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// A profile may require one of the types, e.g. with value[x]:valueQuantity min 1
+	for _, slice := range slicesOf(element, spec) {
+		if slice.Min > 0 && !seen[slice.SliceName] {
+			slicePath := joinPath(parentPath, slice.SliceName)
+			addOperationOutcome(outcome, "required", fmt.Sprintf("Field '%s' is required", slicePath), slicePath, "Field is required", "error")
+		}
+	}
+
+	if len(keys) == 0 {
+		if element.Min > 0 {
+			addOperationOutcome(outcome, "required", fmt.Sprintf("Field '%s' is required, as one of %s", choicePath, choiceNames(name, allowed)), choicePath, "Field is required", "error")
+		}
+		return
+	}
+
+	if len(keys) > 1 {
+		addOperationOutcome(outcome, "structure", fmt.Sprintf("Only one value is allowed for '%s', found %s", choicePath, strings.Join(keys, ", ")), choicePath, "Only one choice allowed", "error")
+	}
+
+	for _, key := range keys {
+		typeCode, _ := fhirpath.ChoiceTypeSuffix(name, key)
+		fullPath := joinPath(parentPath, key)
+
+		var typed *Type
+		for i := range element.Type {
+			if element.Type[i].Code == typeCode {
+				typed = &element.Type[i]
+				break
+			}
+		}
+		if typed == nil {
+			addOperationOutcome(outcome, "structure", fmt.Sprintf("Type '%s' is not allowed for '%s': expected one of %s", typeCode, choicePath, choiceNames(name, allowed)), fullPath, "Type not allowed", "error")
+			continue
+		}
+
+		// Validate the value as an element of the chosen type, with the constraints a
+		// profile sets on that type only (value[x]:valueQuantity)
+		choice := element
+		choice.Type = []Type{*typed}
+		if index := findElementByID(spec.Snapshot.Element, element.ID+":"+key); index >= 0 {
+			choice = spec.Snapshot.Element[index]
+		}
+		if data[key] != nil {
+			c.ValidateField(rootData, data[key], choice, fullPath, rootSpec, spec, outcome, false)
+		}
+		if primitiveExtension, ok := data["_"+key]; ok {
+			c.validatePrimitiveExtension(rootData, data[key], primitiveExtension, choice, parentPath, key, rootSpec, spec, outcome)
+		}
+	}
+}
+
+// choiceKey reports whether key names a type of one of the choice elements, e.g.
+// deceasedString for deceased, whether the type is allowed or not.
+func choiceKey(key string, choices []string) bool {
+	for _, choice := range choices {
+		if _, ok := fhirpath.ChoiceTypeSuffix(choice, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// choiceNames returns the property names of a choice element, e.g. 'deceasedBoolean', 'deceasedDateTime'.
+func choiceNames(name string, types []string) string {
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, fmt.Sprintf("'%s%s'", name, fhirpath.UpperFirst(t)))
+	}
+	return strings.Join(names, ", ")
+}
+
+// ValidateBackboneElement validates a backbone element, e.g. Patient.contact, against the
+// specification. Its cardinality is checked like any element; each of its values is then
+// validated as a type of its own, made of the children of the element (see backboneType).
+func (c *validation) ValidateBackboneElement(rootData map[string]interface{}, data map[string]interface{}, element Element, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
+	c.ValidateElement(rootData, data, element, rootSpec, spec, parentPath, outcome)
+}
+
+// backboneType returns a definition whose type is the path of the backbone element, with
+// the element as its root and the elements below it, so that a backbone value is validated
+// by Validate like the value of a complex type. The FHIRPath engine resolves such a path
+// to the backbone element when the constraints are evaluated.
+func backboneType(element Element, spec StructureDefinition) StructureDefinition {
+	root := element
+	root.ID, root.Path = element.Path, element.Path
+
+	elements := []Element{root}
+	for _, child := range spec.Snapshot.Element {
+		if strings.HasPrefix(child.ID, element.ID+".") {
+			child.ID = element.Path + strings.TrimPrefix(child.ID, element.ID)
+			elements = append(elements, child)
+		}
+	}
+
+	backbone := spec
+	backbone.ID = element.Path
+	backbone.Type = element.Path
+	backbone.Kind = "complex-type"
+	backbone.Snapshot = &Snapshot{Element: elements}
+	return backbone
 }
 
 func findMatchingElement(spec StructureDefinition) (*Element, error) {
@@ -273,58 +406,36 @@ func findMatchingElement(spec StructureDefinition) (*Element, error) {
 	return nil, fmt.Errorf("Element not found")
 }
 
-func findMatchingElementDos(data map[string]interface{}, spec StructureDefinition) (*[]Constraint, error) {
-	fmt.Printf("Finding constraints for %s\n", spec.ID)
-	fmt.Printf("Data: %v\n", data)
+// findMatchingElementDos returns the constraints of the root element of spec, i.e. the
+// constraints to evaluate on data. The constraints of the children apply to their own
+// values and are not evaluated here.
+func findMatchingElementDos(data map[string]interface{}, spec StructureDefinition, skippedKeys []string) (*[]Constraint, error) {
 	var constraints []Constraint
-	// Iterate over the keys in the specLibraryData map
-	for key := range data {
-		// Construct the expected ID to match with specLibraryData elements
-		expectedID := spec.ID + "." + key
 
-		// Search for a match in the specLibraryData's Snapshot.Element array
-		for _, element := range spec.Snapshot.Element {
-
-			if spec.ID == element.ID {
-				fmt.Printf("Element %s\n", element.ID)
-				for _, constraint := range element.Constraint {
-					var skippedKeys = []string{"txt-1", "txt-2", "ele-1"}
-					if contains(skippedKeys, constraint.Key) {
-						continue
-					}
-
-					fmt.Printf("Constraint %s\n", constraint.Key)
+	// Search for the root element in the specLibraryData's Snapshot.Element array
+	for _, element := range spec.Snapshot.Element {
+		if spec.Type != element.ID {
+			continue
+		}
 
-					constraints = append(constraints, constraint)
-				}
+		for _, constraint := range element.Constraint {
+			if contains(skippedKeys, constraint.Key) {
+				continue
 			}
 
-			if element.ID == expectedID {
-				fmt.Println("Element found")
-				fmt.Printf("Element %s\n", element.ID)
-				for _, constraint := range element.Constraint {
-					var skippedKeys = []string{"txt-1", "txt-2", "ele-1"}
-					if contains(skippedKeys, constraint.Key) {
-						continue
-					}
-
-					fmt.Printf("Constraint %s\n", constraint.Key)
-
-					constraints = append(constraints, constraint)
-				}
-
-				break
-			}
+			constraints = append(constraints, constraint)
 		}
+
+		return &constraints, nil
 	}
 
 	return &constraints, fmt.Errorf("no constraints found")
 }
 
 // ValidateElement validates a single element against the specification
-func ValidateElement(rootData map[string]interface{}, data map[string]interface{}, element Element, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
+func (c *validation) ValidateElement(rootData map[string]interface{}, data map[string]interface{}, element Element, rootSpec StructureDefinition, spec StructureDefinition, parentPath string, outcome *OperationOutcome) {
 
-	fieldName := strings.TrimPrefix(element.Path, spec.ID+".")
+	fieldName := strings.TrimPrefix(element.Path, spec.Type+".")
 
 	fullPath := joinPath(parentPath, fieldName)
 	if underscorePart := extractUnderscorePart(element.ID); underscorePart != "" {
@@ -333,31 +444,48 @@ func ValidateElement(rootData map[string]interface{}, data map[string]interface{
 
 	childData := data[fieldName]
 
+	// _birthDate holds the id and extensions of birthDate, _given those of each given
+	primitiveExtension, hasPrimitiveExtension := data["_"+fieldName]
+	if _, isArray := childData.([]interface{}); hasPrimitiveExtension || isArray {
+		c.validatePrimitiveExtension(rootData, childData, primitiveExtension, element, parentPath, fieldName, rootSpec, spec, outcome)
+	}
+
 	if childData == nil {
-		if element.Min > 0 {
+		// A primitive with only extensions, e.g. a data-absent-reason, is present
+		if element.Min > 0 && !hasPrimitiveExtension {
 			addOperationOutcome(outcome, "required", fmt.Sprintf("Field '%s' is required", fullPath), fullPath, "Field is required", "error")
 		}
+		// A profile may require a slice of an element that is optional in the base
+		if slices := slicesOf(element, spec); len(slices) > 0 {
+			validateSliceCardinality(slices, make([]int, len(slices)), fullPath, outcome)
+		}
 		return
 	}
 
-	ValidateField(rootData, childData, element, fullPath, rootSpec, spec, outcome, false)
+	c.ValidateField(rootData, childData, element, fullPath, rootSpec, spec, outcome, false)
 
 }
 
 // ValidateField validates a single field against the specification
-func ValidateField(rootData map[string]interface{}, value interface{}, element Element, fullPath string, rootSpec StructureDefinition, spec StructureDefinition, outcome *OperationOutcome, comingFromArray bool) {
+func (c *validation) ValidateField(rootData map[string]interface{}, value interface{}, element Element, fullPath string, rootSpec StructureDefinition, spec StructureDefinition, outcome *OperationOutcome, comingFromArray bool) {
+
+	// A profile may prohibit a single-valued element, e.g. the value[x] of a complex extension
+	if element.Max == "0" && !IsArrayElement(element) {
+		addOperationOutcome(outcome, "invalid", fmt.Sprintf("Field '%s' is not allowed: maximum is 0", fullPath), fullPath, "Field is not allowed", "error")
+		return
+	}
 
 	if IsArrayElement(element) && !comingFromArray {
 		// Validate each element in the array
-		ValidateArray(rootData, value, element, fullPath, rootSpec, spec, outcome)
+		c.ValidateArray(rootData, value, element, fullPath, rootSpec, spec, outcome)
 	} else {
 		// Validate the single value
-		ValidateValue(rootData, value, element, fullPath, rootSpec, spec, outcome)
+		c.ValidateValue(rootData, value, element, fullPath, rootSpec, spec, outcome)
 	}
 }
 
 // ValidateArray validates an array field against the specification
-func ValidateArray(
+func (c *validation) ValidateArray(
 	rootData map[string]interface{},
 	value interface{},
 	element Element,
@@ -387,23 +515,35 @@ func ValidateArray(
 		addOperationOutcome(outcome, "invalid", fmt.Sprintf("Field '%s' has too many items: maximum is %d. Found %d elements", fullPath, maxItems, length), fullPath, "Field has too many items", "error")
 	}
 
+	// Items of a sliced element are validated against the slice they match
+	slices := c.assignSlices(rootData, array, element, fullPath, rootSpec, spec, outcome)
+
 	// Validate each element in the array
 	for i, item := range array {
 		itemPath := fmt.Sprintf("%s[%d]", fullPath, i)
 
-		// check if item is a string
+		itemElement := element
+		if slices != nil && slices[i] != nil {
+			itemElement = *slices[i]
+		}
 
 		switch v := item.(type) {
-		case string, map[string]interface{}:
-			ValidateField(rootData, v, element, itemPath, rootSpec, spec, outcome, true)
-		default:
+		case []interface{}:
 			addOperationOutcome(outcome, "invalid", fmt.Sprintf("Field '%s' must be a single value", fullPath), fullPath, "Field must be a single value", "error")
+		case nil:
+			// A null primitive keeps the place of its extensions in _name (see validatePrimitiveExtension)
+			if len(itemElement.Type) > 0 && expectedJSONType(itemElement.Type[0].Code) != "object" {
+				continue
+			}
+			c.ValidateField(rootData, v, itemElement, itemPath, rootSpec, spec, outcome, true)
+		default:
+			c.ValidateField(rootData, v, itemElement, itemPath, rootSpec, spec, outcome, true)
 		}
 	}
 }
 
 // ValidateValue validates a single value against the specification
-func ValidateValue(
+func (c *validation) ValidateValue(
 	rootData map[string]interface{},
 	value interface{},
 	element Element,
@@ -418,31 +558,134 @@ func ValidateValue(
 		return
 	}
 
-	switch v := value.(type) {
-	case []interface{}:
+	// Coded values have to come from the value set of the binding
+	if element.Binding != nil {
+		c.validateBinding(value, element, fullPath, outcome)
+	}
+
+	if _, isArray := value.([]interface{}); isArray {
 		addOperationOutcome(outcome, "invalid", fmt.Sprintf("Field '%s' must be a single value", fullPath), fullPath, "Field must be a single value", "error")
+		return
+	}
+
+	if len(element.Type) == 0 {
+		return // elements defined by a contentReference are not supported
+	}
+	typeCode := element.Type[0].Code
+
+	// The JSON type has to be the one of the FHIR type before its content is checked
+	expected, actual := expectedJSONType(typeCode), jsonType(value)
+	if expected != actual {
+		addOperationOutcome(outcome, "structure", fmt.Sprintf("Field '%s' must be a JSON %s for type '%s', found a JSON %s", fullPath, expected, typeCode, actual), fullPath, "Wrong JSON type", "error")
+		return
+	}
+
+	// Values set or limited by a profile: fixed[x], pattern[x], maxLength, minValue[x], maxValue[x]
+	validateFixedAndPattern(value, element, fullPath, outcome)
+	validateLimits(value, element, typeCode, fullPath, outcome)
+
+	switch v := value.(type) {
 	case map[string]interface{}:
+		// Backbone elements are validated with their children, as a type of their own
+		if IsBackboneElement(element) {
+			c.Validate(rootData, v, rootSpec, backboneType(element, spec), fullPath, outcome)
+			return
+		}
+
+		// The constraints of the element, e.g. added by a profile, apply to its value
+		c.queueConstraints(rootData, v, element.Constraint, typeCode, fullPath)
+
+		// A profile may constrain the children of the type, e.g. Patient.identifier.system
+		if typeSpec, ok := c.constrainedType(element, typeCode, spec); ok {
+			c.Validate(rootData, v, rootSpec, typeSpec, fullPath, outcome)
+			return
+		}
+
+		// Extensions are validated against their own definition
+		if typeCode == "Extension" {
+			c.validateExtension(rootData, v, element, fullPath, rootSpec, spec, outcome)
+			return
+		}
+
 		// Validate nested object
-		ValidateComplexType(rootData, v, element.Type[0].Code, fullPath, rootSpec, spec, outcome)
+		c.ValidateComplexType(rootData, v, typeCode, fullPath, rootSpec, spec, outcome)
 	case string:
 		// Validate primitive type
-		ValidatePrimitiveType(v, element.Type[0].Code, fullPath, rootSpec, spec, outcome)
+		c.ValidatePrimitiveType(v, typeCode, fullPath, rootSpec, spec, outcome)
 	default:
-		// Additional type checks can be added here if needed
+		// booleans and numbers are checked in their canonical string form, when the
+		// definition of their type is loaded; their JSON type and range are checked already
+		canonical, ok := canonicalPrimitive(value, typeCode, fullPath, outcome)
+		if _, found := c.spec.Config[typeCode]; ok && found {
+			c.ValidatePrimitiveType(canonical, typeCode, fullPath, rootSpec, spec, outcome)
+		}
+	}
+}
+
+// canonicalPrimitive returns the string form of a JSON boolean or number, after checking
+// that integer types hold an integral value within their range.
+func canonicalPrimitive(value interface{}, typeCode string, fullPath string, outcome *OperationOutcome) (string, bool) {
+	var number float64
+	var text string
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v), true
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			addOperationOutcome(outcome, "value", fmt.Sprintf("Field '%s' has an invalid number '%s'", fullPath, v), fullPath, "Invalid number", "error")
+			return "", false
+		}
+		number, text = f, v.String()
+	case float64:
+		number, text = v, strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "", false
+	}
+
+	var minimum float64
+	switch strings.TrimPrefix(typeCode, "http://hl7.org/fhirpath/System.") {
+	case "integer", "Integer":
+		minimum = math.MinInt32
+	case "unsignedInt":
+		minimum = 0
+	case "positiveInt":
+		minimum = 1
+	default:
+		return text, true // decimal
+	}
+
+	if number != math.Trunc(number) || strings.ContainsAny(text, ".eE") {
+		addOperationOutcome(outcome, "value", fmt.Sprintf("Field '%s' must be an integer for type '%s', found %s", fullPath, typeCode, text), fullPath, "Value is not an integer", "error")
+		return "", false
+	}
+	if number < minimum || number > math.MaxInt32 {
+		addOperationOutcome(outcome, "value", fmt.Sprintf("Field '%s' is out of range for type '%s': %s is not between %d and %d", fullPath, typeCode, text, int64(minimum), math.MaxInt32), fullPath, "Value out of range", "error")
+		return "", false
 	}
+	return strconv.FormatInt(int64(number), 10), true
 }
 
 // ValidateComplexType validates nested complex types like Address, Organization, etc.
 // It handles both single objects and slices of complex types.
-func ValidateComplexType(rootData map[string]interface{}, value interface{}, typeCode, path string, rootSpec, spec StructureDefinition, outcome *OperationOutcome) {
+func (c *validation) ValidateComplexType(rootData map[string]interface{}, value interface{}, typeCode, path string, rootSpec, spec StructureDefinition, outcome *OperationOutcome) {
 
 	// Load the structure definition for the type
-	nestedSpec, found := specLibraryData.Config[typeCode]
+	nestedSpec, found := c.spec.Config[typeCode]
 	if !found {
 		addOperationOutcome(outcome, "invalid", fmt.Sprintf("No structure definition found for type '%s'", typeCode), path, "No structure definition found", "error")
 		return
 	}
 
+	// Contained resources are validated as the resource they are
+	if typeCode == "Resource" || typeCode == "DomainResource" {
+		if resourceType, ok := value.(map[string]interface{})["resourceType"].(string); ok {
+			if resourceSpec, found := c.spec.Config[resourceType]; found {
+				nestedSpec = resourceSpec
+			}
+		}
+	}
+
 	// Ensure correct type assertion
 	specDefinition, valid := nestedSpec.(StructureDefinition)
 	if !valid {
@@ -450,26 +693,73 @@ func ValidateComplexType(rootData map[string]interface{}, value interface{}, typ
 		return
 	}
 
-	Validate(rootData, value.(map[string]interface{}), rootSpec, specDefinition, path, outcome)
+	specDefinition, err := c.spec.withSnapshot(specDefinition)
+	if err != nil {
+		addOperationOutcome(outcome, "not-supported", fmt.Sprintf("No snapshot for type '%s': %s", typeCode, err), path, "No snapshot", "error")
+		return
+	}
+
+	c.Validate(rootData, value.(map[string]interface{}), rootSpec, specDefinition, path, outcome)
+}
+
+// constrainedType returns the definition of typeCode with the children of element that
+// spec constrains, e.g. the Identifier children a profile sets on Patient.identifier.
+// It reports false when spec has no children for element.
+func (c *validation) constrainedType(element Element, typeCode string, spec StructureDefinition) (StructureDefinition, bool) {
+	var children []Element
+	for _, child := range spec.Snapshot.Element {
+		if strings.HasPrefix(child.ID, element.ID+".") {
+			children = append(children, child)
+		}
+	}
+	if len(children) == 0 {
+		return StructureDefinition{}, false
+	}
+
+	typeSpec, ok := c.spec.Config[typeCode].(StructureDefinition)
+	if !ok {
+		return StructureDefinition{}, false
+	}
+	typeSpec, err := c.spec.withSnapshot(typeSpec)
+	if err != nil || len(typeSpec.Snapshot.Element) == 0 {
+		return StructureDefinition{}, false
+	}
+
+	elements := make([]Element, 0, len(children)+1)
+	elements = append(elements, typeSpec.Snapshot.Element[0])
+	for _, child := range children {
+		child.Path = typeSpec.Type + strings.TrimPrefix(child.Path, element.Path)
+		child.ID = typeSpec.Type + strings.TrimPrefix(child.ID, element.ID)
+		elements = append(elements, child)
+	}
+
+	typeSpec.Snapshot = &Snapshot{Element: elements}
+	return typeSpec, true
 }
 
 // ValidatePrimitiveType validates a FHIR primitive type against its expected regex pattern.
-func ValidatePrimitiveType(value string, typeCode, path string, rootSpec StructureDefinition, spec StructureDefinition, outcome *OperationOutcome) {
+func (c *validation) ValidatePrimitiveType(value string, typeCode, path string, rootSpec StructureDefinition, spec StructureDefinition, outcome *OperationOutcome) {
 
 	if typeCode == "http://hl7.org/fhirpath/System.String" {
 		typeCode = "string" // Normalize FHIRPath string type
 	}
 
-	definition, found := specLibraryData.Config[typeCode]
+	definition, found := c.spec.Config[typeCode]
 	if !found {
 		addOperationOutcome(outcome, "invalid", fmt.Sprintf("No definition found for type '%s'", typeCode), path, "No definition found", "error")
 		return
 	}
 
+	primitiveDefinition, err := c.spec.withSnapshot(definition.(StructureDefinition))
+	if err != nil {
+		addOperationOutcome(outcome, "not-supported", fmt.Sprintf("No snapshot for type '%s': %s", typeCode, err), path, "No snapshot", "error")
+		return
+	}
+
 	// Extract the value element definition from the snapshot
 	var valueElement *Element
-	if valueElement = ExtractValueElementID(definition.(StructureDefinition).ID, definition.(StructureDefinition).Snapshot); valueElement == nil {
-		addOperationOutcome(outcome, "invalid", fmt.Sprintf("No value element found for '%s'", path), path, "No value element found", "error")
+	if valueElement = ExtractValueElementID(primitiveDefinition.ID, primitiveDefinition.Snapshot); valueElement == nil {
+		addOperationOutcome(outcome, "invalid", fmt.Sprintf("No value element found for '%s': the definition of type '%s' has no '%s.value'", path, typeCode, primitiveDefinition.ID), path, "No value element found", "error")
 		return
 	}
 
@@ -520,11 +810,11 @@ func ExtractRegexFromElement(element Element) string {
 }
 
 // ExtractValueElementID searches for an element with ID `rootId + ".value"` in the snapshot.
+// It returns nil when the snapshot is missing or has no such element; the caller reports it.
 func ExtractValueElementID(rootId string, snapshot *Snapshot) *Element {
 
-	if snapshot == nil || len(snapshot.Element) == 0 {
-		fmt.Printf("⚠️ Warning: Snapshot is empty or nil for rootId '%s'\n", rootId)
-		return nil // Return empty element if snapshot is missing
+	if snapshot == nil {
+		return nil
 	}
 
 	targetID := rootId + ".value"
@@ -535,8 +825,7 @@ func ExtractValueElementID(rootId string, snapshot *Snapshot) *Element {
 		}
 	}
 
-	fmt.Printf("⚠️ Warning: No value element found for rootId '%s'\n", rootId)
-	return nil // Return empty struct if no match is found
+	return nil
 }
 
 // getFHIRTypeFromExtensions extracts the FHIR type from element extensions
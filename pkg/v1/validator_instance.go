@@ -0,0 +1,299 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+// Validator validates FHIR resources against a spec library using a FHIRPath engine
+// for the constraints. It holds no per-call state, so Validate may be called from
+// many goroutines at the same time.
+type Validator struct {
+	spec               *LibraryData
+	engine             FhirPathEngine
+	terminology        TerminologyService
+	unknownSystem      string
+	unknownExtension   string
+	skippedConstraints []string
+
+	dumpMu    sync.Mutex
+	debugDump io.Writer
+}
+
+// validation holds the state of a single Validate call: the constraints collected
+// while walking the resource, to be evaluated in one batch at the end.
+type validation struct {
+	ctx                context.Context
+	spec               *LibraryData
+	terminology        TerminologyService
+	unknownSystem      string // severity of a binding the terminology service cannot check
+	unknownExtension   string // severity of an extension whose definition is not loaded
+	skippedConstraints []string
+	payload            []*FhirPathPayload
+	payloadSet         map[string]bool // constraintKey|parentPath already in payload
+}
+
+// New returns a Validator configured by opts. Without WithSpec or WithSpecFS it uses
+// the spec loaded by LoadData, by default the one embedded in the spec package.
+func New(opts ...Option) (*Validator, error) {
+	options := validatorOptions{
+		unknownSystem:      "warning",
+		unknownExtension:   "warning",
+		skippedConstraints: DefaultSkippedConstraints,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	spec := options.spec
+	if spec != nil && len(options.packages) > 0 {
+		return nil, fmt.Errorf("WithPackage cannot be combined with WithSpec; load the package with LoadPackage instead")
+	}
+	if spec == nil {
+		var err error
+		switch {
+		case len(options.specFS) > 0:
+			spec, err = LoadSpecFS(options.specFS...)
+		case len(options.packages) > 0:
+			// Packages are added to the library, so do not use the shared one.
+			spec, err = LoadSpecFS(fhirspec.FS)
+		default:
+			spec, err = LoadData()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading spec: %w", err)
+		}
+
+		for _, pkg := range options.packages {
+			if err := spec.LoadPackage(pkg.path, pkg.cacheDirs...); err != nil {
+				return nil, fmt.Errorf("error loading package %s: %w", pkg.path, err)
+			}
+		}
+	}
+
+	engine := options.engine
+	if engine == nil {
+		engine = NativeFhirPathEngine{Spec: spec}
+	}
+
+	terminology := options.terminology
+	if terminology == nil {
+		terminology = LocalTerminologyService{Spec: spec}
+	}
+
+	switch options.unknownSystem {
+	case "error", "warning", "information":
+	default:
+		return nil, fmt.Errorf("invalid unknown system severity '%s': use error, warning or information", options.unknownSystem)
+	}
+
+	switch options.unknownExtension {
+	case "error", "warning", "information":
+	default:
+		return nil, fmt.Errorf("invalid unknown extension severity '%s': use error, warning or information", options.unknownExtension)
+	}
+
+	return &Validator{
+		spec:               spec,
+		engine:             engine,
+		terminology:        terminology,
+		unknownSystem:      options.unknownSystem,
+		unknownExtension:   options.unknownExtension,
+		skippedConstraints: options.skippedConstraints,
+		debugDump:          options.debugDump,
+	}, nil
+}
+
+// ValidateResource validates data with the spec loaded by LoadData and the engine set
+// with SetFhirPathEngine.
+func ValidateResource(data map[string]interface{}) (*OperationOutcome, error) {
+	return ValidateResourceContext(context.Background(), data)
+}
+
+// ValidateResourceContext is like ValidateResource but stops when ctx is done, see
+// Validator.Validate.
+func ValidateResourceContext(ctx context.Context, data map[string]interface{}) (*OperationOutcome, error) {
+	spec, err := GetSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := New(WithSpec(spec), WithFHIRPathEngine(getFhirPathEngine()))
+	if err != nil {
+		return nil, err
+	}
+
+	return validator.Validate(ctx, data)
+}
+
+// Validate validates a resource against the base definition of its type and every
+// profile declared in meta.profile, and returns the issues found as an OperationOutcome.
+// Unknown profiles are reported as warnings.
+// When ctx is done before validation finishes, the issues found so far are returned
+// together with a timeout (deadline) or incomplete (cancellation) issue.
+func (v *Validator) Validate(ctx context.Context, data map[string]interface{}) (*OperationOutcome, error) {
+	return v.validate(ctx, data, "")
+}
+
+// validate validates data against profileURL, or against its base definition and
+// declared profiles when profileURL is empty.
+func (v *Validator) validate(ctx context.Context, data map[string]interface{}, profileURL string) (*OperationOutcome, error) {
+	outcome := &OperationOutcome{ResourceType: "OperationOutcome"}
+	c := &validation{
+		ctx:                ctx,
+		spec:               v.spec,
+		terminology:        v.terminology,
+		unknownSystem:      v.unknownSystem,
+		unknownExtension:   v.unknownExtension,
+		skippedConstraints: v.skippedConstraints,
+		payloadSet:         make(map[string]bool),
+	}
+
+	// extract the resource type
+	resourceType, ok := data["resourceType"].(string)
+
+	if !ok {
+		return nil, fmt.Errorf("resource type not found")
+	}
+
+	// check if the resource type is valid
+	if !contains(FhirR4ResourceTypes, resourceType) {
+		// stringify the resource types
+		resourceTypes := strings.Join(FhirR4ResourceTypes, ", ")
+		addOperationOutcome(outcome, "error", fmt.Sprintf("Invalid resource type '%s'. Expected one of: %s", resourceType, resourceTypes), "", "Invalid resource type", "error")
+		return outcome, nil
+	}
+
+	// The definitions to validate against; the first one reports its issues as they are.
+	var structures []StructureDefinition
+
+	if profileURL != "" {
+		profile, ok := v.spec.StructureDefinitionByURL(profileURL)
+		if !ok {
+			return nil, fmt.Errorf("profile '%s' not found in definitions", profileURL)
+		}
+		if profile.Type != resourceType {
+			return nil, fmt.Errorf("profile '%s' constrains %s, not %s", profileURL, profile.Type, resourceType)
+		}
+		structures = append(structures, profile)
+	} else {
+		spec, ok := v.spec.Config[resourceType]
+		if !ok {
+			return nil, fmt.Errorf("resource type '%s' not found in definitions; embed the R4 core bundles with 'go generate ./spec' or load a definition for it", resourceType)
+		}
+		structures = append(structures, spec.(StructureDefinition))
+		structures = append(structures, c.declaredProfiles(data, resourceType, outcome)...)
+	}
+
+	for i, structure := range structures {
+		if c.done() {
+			break
+		}
+
+		// Differential-only profiles get a snapshot generated from their base definition.
+		structure, err := v.spec.withSnapshot(structure)
+		if err != nil {
+			addOperationOutcome(outcome, "not-supported", fmt.Sprintf("Profile '%s' has no snapshot and none could be generated (%s); the resource was not validated against it", structure.URL, err), "", "Profile without snapshot", "warning")
+			continue
+		}
+
+		if i == 0 {
+			c.Validate(data, data, structure, structure, resourceType, outcome)
+			continue
+		}
+
+		profileOutcome := &OperationOutcome{ResourceType: "OperationOutcome"}
+		c.Validate(data, data, structure, structure, resourceType, profileOutcome)
+		mergeProfileOutcome(outcome, profileOutcome, structure.URL)
+	}
+
+	if c.done() {
+		addContextOutcome(outcome, ctx.Err())
+		return outcome, nil
+	}
+
+	v.dumpPayload(c.payload)
+
+	response, err := v.engine.Evaluate(ctx, c.payload)
+
+	if ctx.Err() != nil {
+		addContextOutcome(outcome, ctx.Err())
+		return outcome, nil
+	}
+
+	if err != nil {
+		addOperationOutcome(outcome, "exception", fmt.Sprintf("Error validating constraint %s", err), "", "", "fatal")
+		return outcome, nil
+	}
+
+	results := response.Failed()
+
+	// A constraint that cannot be evaluated is reported on its own and does not hide the others.
+	for _, constraintError := range response.Errors {
+		diagnostics := fmt.Sprintf("Error evaluating constraint '%s': %s", constraintError.Key, constraintError.Message)
+		if constraintError.Source != "" {
+			diagnostics = fmt.Sprintf("Error evaluating constraint '%s' (source: %s): %s", constraintError.Key, constraintError.Source, constraintError.Message)
+		}
+		addOperationOutcome(outcome, "exception", diagnostics, constraintError.Path, "", "error")
+	}
+
+	if len(outcome.Issue) == 0 && len(results) == 0 {
+		addOperationOutcome(outcome, "information", "Validation successful", "", "", "information")
+	} else {
+		for i := 0; i < len(results); i++ {
+			diagnostics := fmt.Sprintf("Failed constraint '%s'", results[i].Key)
+			code := "invariant"
+			details := fmt.Sprintf("%s: %s", results[i].Key, results[i].Human)
+			if results[i].Source != "" {
+				diagnostics = fmt.Sprintf("Failed constraint '%s' (source: %s)", results[i].Key, results[i].Source)
+			}
+
+			if results[i].Key == "dom-6" {
+				diagnostics = fmt.Sprintf("Failed constraint '%s' (source: %s)", results[i].Key, results[i].Source)
+				code = "informational"
+
+			}
+			// generate better response "Failed constraint '%s'" if results[i].Source is present, use it
+			addOperationOutcome(outcome, code, diagnostics, results[i].Path, details, results[i].Severity)
+		}
+	}
+
+	return outcome, nil
+}
+
+// done reports whether the validation has to stop because its context is done.
+func (c *validation) done() bool {
+	return c.ctx.Err() != nil
+}
+
+// addContextOutcome records why a validation stopped before checking everything.
+func addContextOutcome(outcome *OperationOutcome, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		addOperationOutcome(outcome, "timeout", "Validation did not complete before the deadline; the issues reported are partial", "", err.Error(), "fatal")
+		return
+	}
+	addOperationOutcome(outcome, "incomplete", "Validation was canceled; the issues reported are partial", "", err.Error(), "fatal")
+}
+
+// dumpPayload writes the payload to the WithDebugDump writer, if any.
+func (v *Validator) dumpPayload(payload []*FhirPathPayload) {
+	if v.debugDump == nil {
+		return
+	}
+
+	payloadJSON, _ := json.MarshalIndent(payload, "", "  ")
+
+	v.dumpMu.Lock()
+	defer v.dumpMu.Unlock()
+
+	if _, err := v.debugDump.Write(append(payloadJSON, '\n')); err != nil {
+		fmt.Printf("Error writing payload dump %s\n", err)
+	}
+}
@@ -0,0 +1,143 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	testValidatorOnce sync.Once
+	testValidator     *Validator
+	testValidatorErr  error
+)
+
+// newTestValidator returns a Validator with the embedded specification, shared by the
+// tests because loading it is slow.
+func newTestValidator(t *testing.T) *Validator {
+	t.Helper()
+	testValidatorOnce.Do(func() {
+		testValidator, testValidatorErr = New()
+	})
+	if testValidatorErr != nil {
+		t.Fatal(testValidatorErr)
+	}
+	return testValidator
+}
+
+// decodeResource decodes a resource keeping its numbers as json.Number, as callers
+// that care about decimal precision do.
+func decodeResource(t *testing.T, source string) map[string]interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(strings.NewReader(source))
+	decoder.UseNumber()
+	var resource map[string]interface{}
+	if err := decoder.Decode(&resource); err != nil {
+		t.Fatal(err)
+	}
+	return resource
+}
+
+// validate validates a resource and returns the diagnostics of its issues, leaving out
+// the dom-6 warning of resources without a narrative.
+func validate(t *testing.T, v *Validator, source string) []string {
+	t.Helper()
+	outcome, err := v.Validate(context.Background(), decodeResource(t, source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var diagnostics []string
+	for _, issue := range outcome.Issue {
+		if strings.Contains(issue.Diagnostics, "'dom-6'") || issue.Code == "information" {
+			continue
+		}
+		diagnostics = append(diagnostics, issue.Severity+": "+issue.Diagnostics)
+	}
+	return diagnostics
+}
+
+// assertIssues checks that each of want is contained in one diagnostic, and that there
+// are no other issues.
+func assertIssues(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d issues, want %d:\n%s", len(got), len(want), strings.Join(got, "\n"))
+	}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if strings.Contains(g, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no issue contains %q:\n%s", w, strings.Join(got, "\n"))
+		}
+	}
+}
+
+// captureStdout returns what f prints to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	printed := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- data
+	}()
+	f()
+	w.Close()
+	return string(<-printed)
+}
+
+func TestValidateDoesNotPrint(t *testing.T) {
+	v := newTestValidator(t)
+	resource := decodeResource(t, `{"resourceType": "Patient", "name": [{"family": "Chalmers"}], "contact": [{"gender": "male"}]}`)
+
+	var validateErr error
+	printed := captureStdout(t, func() {
+		_, validateErr = v.Validate(context.Background(), resource)
+	})
+	if validateErr != nil {
+		t.Fatal(validateErr)
+	}
+	if printed != "" {
+		t.Errorf("Validate printed to stdout:\n%s", printed)
+	}
+}
+
+func TestValidateConcurrently(t *testing.T) {
+	v := newTestValidator(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcome, err := v.Validate(context.Background(), decodeResource(t, `{"resourceType": "Patient", "gender": "unknown-gender"}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, issue := range outcome.Issue {
+				if issue.Severity == "error" {
+					return
+				}
+			}
+			t.Error("the invalid gender was not reported")
+		}()
+	}
+	wg.Wait()
+}
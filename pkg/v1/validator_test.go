@@ -0,0 +1,275 @@
+package v1
+
+import (
+	"encoding/json"
+	"testing"
+	"testing/fstest"
+
+	fhirspec "github.com/robertoAraneda/go-fhir-validator/spec"
+)
+
+func TestValidateUnknownElements(t *testing.T) {
+	v := newTestValidator(t)
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "misspelled element",
+			resource: `{"resourceType": "Patient", "birthdate": "1990-01-01"}`,
+			want:     []string{"error: Unknown element 'birthdate' at 'Patient.birthdate'. Did you mean 'birthDate'?"},
+		},
+		{
+			name:     "unknown element without a close name",
+			resource: `{"resourceType": "Patient", "favouriteColour": "blue"}`,
+			want:     []string{"error: Unknown element 'favouriteColour' at 'Patient.favouriteColour'"},
+		},
+		{
+			name:     "misspelled element of a complex type",
+			resource: `{"resourceType": "Patient", "name": [{"famly": "Doe"}]}`,
+			want:     []string{"error: Unknown element 'famly' at 'Patient.name[0].famly'. Did you mean 'family'?"},
+		},
+		{
+			name:     "primitive extension and choice are known",
+			resource: `{"resourceType": "Patient", "gender": "female", "_gender": {"id": "g1"}, "deceasedBoolean": false}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validate(t, v, tt.resource), tt.want...)
+		})
+	}
+}
+
+func TestClosestName(t *testing.T) {
+	names := map[string]bool{"birthDate": true, "gender": true, "name": true}
+
+	tests := map[string]string{
+		"birthdate": "birthDate",
+		"gendr":     "gender",
+		"nmae":      "name",
+		"telecom":   "",
+	}
+	for key, want := range tests {
+		if got := closestName(key, names); got != want {
+			t.Errorf("closestName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestValidatePrimitiveJSONTypes(t *testing.T) {
+	v := newTestValidator(t)
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "valid primitives",
+			resource: `{"resourceType": "Patient", "active": true, "birthDate": "1932-09-24", "multipleBirthInteger": 2, "photo": [{"size": 0}]}`,
+		},
+		{
+			name:     "boolean as a string",
+			resource: `{"resourceType": "Patient", "active": "yes"}`,
+			want:     []string{"error: Field 'Patient.active' must be a JSON boolean for type 'boolean', found a JSON string"},
+		},
+		{
+			name:     "boolean as a number",
+			resource: `{"resourceType": "Patient", "active": 1}`,
+			want:     []string{"error: Field 'Patient.active' must be a JSON boolean for type 'boolean', found a JSON number"},
+		},
+		{
+			name:     "date as a number",
+			resource: `{"resourceType": "Patient", "birthDate": 19320924}`,
+			want:     []string{"error: Field 'Patient.birthDate' must be a JSON string for type 'date', found a JSON number"},
+		},
+		{
+			name:     "integer as a string",
+			resource: `{"resourceType": "Patient", "multipleBirthInteger": "2"}`,
+			want:     []string{"error: Field 'Patient.multipleBirthInteger' must be a JSON number for type 'integer', found a JSON string"},
+		},
+		{
+			name:     "fractional integer",
+			resource: `{"resourceType": "Patient", "multipleBirthInteger": 1.5}`,
+			want:     []string{"error: Field 'Patient.multipleBirthInteger' must be an integer for type 'integer', found 1.5"},
+		},
+		{
+			name:     "integer out of range",
+			resource: `{"resourceType": "Patient", "multipleBirthInteger": 3000000000}`,
+			want:     []string{"error: Field 'Patient.multipleBirthInteger' is out of range for type 'integer': 3000000000 is not between -2147483648 and 2147483647"},
+		},
+		{
+			name:     "negative unsignedInt",
+			resource: `{"resourceType": "Patient", "photo": [{"size": -1}]}`,
+			want:     []string{"error: Field 'Patient.photo[0].size' is out of range for type 'unsignedInt': -1 is not between 0 and 2147483647"},
+		},
+		{
+			name:     "object for a primitive",
+			resource: `{"resourceType": "Patient", "gender": {"code": "female"}}`,
+			want:     []string{"error: Field 'Patient.gender' must be a JSON string for type 'code', found a JSON object"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validate(t, v, tt.resource), tt.want...)
+		})
+	}
+}
+
+func TestCanonicalPrimitive(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		typeCode string
+		want     string
+		ok       bool
+	}{
+		{true, "boolean", "true", true},
+		{json.Number("1.50"), "decimal", "1.50", true},
+		{json.Number("1e3"), "decimal", "1e3", true},
+		{json.Number("42"), "integer", "42", true},
+		{json.Number("-2147483648"), "integer", "-2147483648", true},
+		{json.Number("1e3"), "integer", "", false},
+		{json.Number("2.0"), "integer", "", false},
+		{json.Number("0"), "unsignedInt", "0", true},
+		{json.Number("0"), "positiveInt", "", false},
+		{json.Number("1"), "positiveInt", "1", true},
+		{json.Number("2147483648"), "positiveInt", "", false},
+		{float64(7), "http://hl7.org/fhirpath/System.Integer", "7", true},
+	}
+
+	for _, tt := range tests {
+		outcome := &OperationOutcome{}
+		got, ok := canonicalPrimitive(tt.value, tt.typeCode, "Test.value", outcome)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("canonicalPrimitive(%v, %s) = %q, %v, want %q, %v", tt.value, tt.typeCode, got, ok, tt.want, tt.ok)
+		}
+		if ok == (len(outcome.Issue) > 0) {
+			t.Errorf("canonicalPrimitive(%v, %s) issues: %+v", tt.value, tt.typeCode, outcome.Issue)
+		}
+	}
+}
+
+func TestValidateBackboneElements(t *testing.T) {
+	v := newTestValidator(t)
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "valid backbone element",
+			resource: `{"resourceType": "Patient", "contact": [{"name": {"family": "Doe"}, "gender": "female"}]}`,
+		},
+		{
+			name:     "unknown child",
+			resource: `{"resourceType": "Patient", "contact": [{"gendr": "female", "name": {"family": "Doe"}}]}`,
+			want:     []string{"error: Unknown element 'gendr' at 'Patient.contact[0].gendr'. Did you mean 'gender'?"},
+		},
+		{
+			name:     "missing required child",
+			resource: `{"resourceType": "Patient", "link": [{"other": {"reference": "Patient/2"}}]}`,
+			want:     []string{"error: Field 'Patient.link[0].type' is required"},
+		},
+		{
+			name:     "wrong JSON type of a child",
+			resource: `{"resourceType": "Patient", "communication": [{"language": {"text": "English"}, "preferred": "yes"}]}`,
+			want:     []string{"error: Field 'Patient.communication[0].preferred' must be a JSON boolean for type 'boolean', found a JSON string"},
+		},
+		{
+			name:     "constraint of the backbone element",
+			resource: `{"resourceType": "Patient", "contact": [{"relationship": [{"text": "friend"}]}]}`,
+			want:     []string{"error: Failed constraint 'pat-1'"},
+		},
+		{
+			name:     "backbone element that is not an array",
+			resource: `{"resourceType": "Patient", "contact": {"name": {"family": "Doe"}}}`,
+			want:     []string{"error: Field 'Patient.contact' must be an array"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validate(t, v, tt.resource), tt.want...)
+		})
+	}
+}
+
+func TestValidateChoiceElements(t *testing.T) {
+	v := newTestValidator(t)
+
+	tests := []struct {
+		name     string
+		resource string
+		want     []string
+	}{
+		{
+			name:     "allowed type",
+			resource: `{"resourceType": "Patient", "deceasedDateTime": "2020-01-01"}`,
+		},
+		{
+			name:     "allowed primitive type of another choice",
+			resource: `{"resourceType": "Condition", "subject": {"reference": "Patient/1"}, "onsetString": "childhood"}`,
+		},
+		{
+			name:     "type not allowed",
+			resource: `{"resourceType": "Patient", "deceasedString": "yes"}`,
+			want:     []string{"error: Type 'string' is not allowed for 'Patient.deceased[x]': expected one of 'deceasedBoolean', 'deceasedDateTime'"},
+		},
+		{
+			name:     "more than one type",
+			resource: `{"resourceType": "Patient", "deceasedDateTime": "2020-01-01", "deceasedBoolean": true}`,
+			want:     []string{"error: Only one value is allowed for 'Patient.deceased[x]', found deceasedBoolean, deceasedDateTime"},
+		},
+		{
+			name:     "value validated as the type of its name",
+			resource: `{"resourceType": "Patient", "multipleBirthBoolean": "true"}`,
+			want:     []string{"error: Field 'Patient.multipleBirthBoolean' must be a JSON boolean for type 'boolean', found a JSON string"},
+		},
+		{
+			name:     "invalid value of the type",
+			resource: `{"resourceType": "Patient", "deceasedDateTime": "yesterday"}`,
+			want:     []string{"Patient.deceasedDateTime"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertIssues(t, validate(t, v, tt.resource), tt.want...)
+		})
+	}
+}
+
+func TestValidatePrimitiveWithoutValueElement(t *testing.T) {
+	boolean := mustJSON(t, map[string]interface{}{
+		"resourceType":   "StructureDefinition",
+		"id":             "boolean",
+		"url":            "http://hl7.org/fhir/StructureDefinition/boolean",
+		"name":           "boolean",
+		"kind":           "primitive-type",
+		"type":           "boolean",
+		"baseDefinition": "http://hl7.org/fhir/StructureDefinition/Element",
+		"derivation":     "specialization",
+		"snapshot": map[string]interface{}{"element": []interface{}{
+			map[string]interface{}{"id": "boolean", "path": "boolean", "min": 0, "max": "*"},
+		}},
+	})
+	v, err := New(WithSpecFS(fhirspec.FS, fstest.MapFS{"boolean.profile.json": {Data: boolean}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	printed := captureStdout(t, func() {
+		got = validate(t, v, `{"resourceType": "Patient", "active": true}`)
+	})
+	assertIssues(t, got, "error: No value element found for 'Patient.active': the definition of type 'boolean' has no 'boolean.value'")
+	if printed != "" {
+		t.Errorf("Validate printed to stdout:\n%s", printed)
+	}
+}
@@ -0,0 +1,23 @@
+#!/bin/sh
+# Downloads the FHIR R4 core definition bundles (profiles-resources.json,
+# profiles-types.json, valuesets.json and extension-definitions.json) into spec/,
+# where LoadData picks them up and go:embed compiles them into the binary.
+# `go generate ./spec` runs it.
+#
+# Usage: scripts/fetch-r4-spec.sh [destination directory]
+set -eu
+
+url="${FHIR_DEFINITIONS_URL:-https://hl7.org/fhir/R4/definitions.json.zip}"
+dest="${1:-$(dirname "$0")/../spec}"
+
+tmp="$(mktemp -d)"
+trap 'rm -rf "$tmp"' EXIT
+
+echo "Downloading $url"
+curl -fsSL "$url" -o "$tmp/definitions.json.zip"
+
+unzip -o -j -q "$tmp/definitions.json.zip" \
+  profiles-resources.json profiles-types.json valuesets.json extension-definitions.json \
+  -d "$dest"
+
+echo "Wrote profiles-resources.json, profiles-types.json, valuesets.json and extension-definitions.json to $dest"
@@ -0,0 +1,17 @@
+// Package spec embeds the FHIR R4 StructureDefinitions, ValueSets and CodeSystems
+// that the validator loads by default, so it does not depend on the working directory.
+//
+// The definitions checked in cover a few resources and the data types they use,
+// including Meta. `go generate ./spec` downloads the R4 core bundles (every resource and
+// data type, the value sets and the core extensions) into this directory, and the next
+// build embeds them; CI runs it before the tests.
+package spec
+
+import "embed"
+
+//go:generate sh ../scripts/fetch-r4-spec.sh .
+
+// FS holds the JSON definitions of this directory.
+//
+//go:embed *.json
+var FS embed.FS